@@ -0,0 +1,440 @@
+package carbon
+
+/*
+
+the carbon consumer listens for carbon's plaintext and pickle protocols, so a
+relay can send it a copy of everything it relays. the values are thrown away:
+each metric name is matched against the configured rules, and each rule that
+matches joins the metric to a join key value made from the name, e.g.
+
+	match: '^server\.([^.]+)\.'
+	join: 'fqdn:$1'
+
+makes server.hostname-1234.cpu.i7z a metric of fqdn hostname-1234, as if a
+metric message had been sent for it. that way every host's metrics are
+joinable without anything having to produce metric messages.
+
+a relay sends the same names over and over, so they're batched: new names are
+collected by join key value and inserted every flush_interval. a name already
+inserted is only inserted again once refresh_interval has passed, which keeps
+it from expiring while it's still being sent.
+
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/consumer"
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+const (
+	defaultFlushInterval   = 10 * time.Second
+	defaultRefreshInterval = time.Hour
+	// the largest pickle carbon itself accepts
+	maxPickleSize = 1 << 20
+)
+
+type RuleConfig struct {
+	// a regular expression for metric names
+	Match string `yaml:"match"`
+	// the join key and value for matching metrics, as 'key:value'. the value
+	// can refer to groups in Match, like $1 or ${host}
+	Join string `yaml:"join"`
+}
+
+type CarbonConfig struct {
+	// 0 for either port means not listening for that protocol
+	PlaintextPort int          `yaml:"plaintext_port"`
+	PicklePort    int          `yaml:"pickle_port"`
+	Rules         []RuleConfig `yaml:"rules"`
+	// how often to insert the new metrics
+	FlushInterval string `yaml:"flush_interval"`
+	// how often to insert metrics again while they're still being sent
+	RefreshInterval string `yaml:"refresh_interval"`
+}
+
+type rule struct {
+	match *regexp.Regexp
+	key   string
+	value string
+}
+
+type join struct {
+	key   string
+	value string
+}
+
+type CarbonConsumer struct {
+	name            string
+	plaintextPort   int
+	picklePort      int
+	rules           []rule
+	flushInterval   time.Duration
+	refreshInterval time.Duration
+
+	listeners []net.Listener
+	shutdown  chan bool
+	// closed once the last of the pending metrics have been inserted
+	done chan bool
+	// the goroutines handling connections, which Stop waits for
+	running sync.WaitGroup
+
+	connMutex sync.Mutex
+	conns     map[net.Conn]bool
+
+	mutex sync.Mutex
+	// metrics waiting to be inserted, by what they join to
+	pending map[join][]string
+	// when each metric was last queued to be inserted, so it isn't again
+	// until refresh_interval has passed
+	seen map[string]time.Time
+}
+
+func init() {
+	consumer.Register("carbon", func(name string, configPath string) (consumer.Consumer, error) {
+		return New(name, configPath)
+	})
+}
+
+func New(name string, configPath string) (*CarbonConsumer, error) {
+	config := &CarbonConfig{}
+	err := util.ReadConfig(configPath, config)
+	if err != nil {
+		return nil, err
+	}
+	return newConsumer(name, config)
+}
+
+func newConsumer(name string, config *CarbonConfig) (*CarbonConsumer, error) {
+	if config.PlaintextPort == 0 && config.PicklePort == 0 {
+		return nil, fmt.Errorf("carbon consumer: neither plaintext_port nor pickle_port is set, so there's nothing to listen on")
+	}
+
+	if len(config.Rules) == 0 {
+		return nil, fmt.Errorf("carbon consumer: there are no rules, so no metric would ever be joined to anything")
+	}
+
+	rules := make([]rule, 0, len(config.Rules))
+	for _, rc := range config.Rules {
+		re, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("carbon consumer: bad rule %q: %s", rc.Match, err)
+		}
+
+		parts := strings.SplitN(rc.Join, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("carbon consumer: the rule for %q should join to 'key:value', but it joins to %q", rc.Match, rc.Join)
+		}
+		rules = append(rules, rule{match: re, key: parts[0], value: parts[1]})
+	}
+
+	flushInterval, err := parseInterval("flush_interval", config.FlushInterval, defaultFlushInterval)
+	if err != nil {
+		return nil, err
+	}
+	refreshInterval, err := parseInterval("refresh_interval", config.RefreshInterval, defaultRefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CarbonConsumer{
+		name:            name,
+		plaintextPort:   config.PlaintextPort,
+		picklePort:      config.PicklePort,
+		rules:           rules,
+		flushInterval:   flushInterval,
+		refreshInterval: refreshInterval,
+		shutdown:        make(chan bool),
+		done:            make(chan bool),
+		conns:           make(map[net.Conn]bool),
+		pending:         make(map[join][]string),
+		seen:            make(map[string]time.Time),
+	}, nil
+}
+
+func parseInterval(name string, raw string, fallback time.Duration) (time.Duration, error) {
+	if raw == "" {
+		return fallback, nil
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("carbon consumer: could not parse %s %q: %s", name, raw, err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("carbon consumer: %s must be positive, but it is %q", name, raw)
+	}
+	return interval, nil
+}
+
+func (c *CarbonConsumer) Start(wg *sync.WaitGroup, db *database.Database) error {
+	// started first, so that Stop works the same way even if a port can't be
+	// listened on
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(c.done)
+		c.flushEvery(db)
+	}()
+
+	protocols := []struct {
+		port   int
+		handle func(net.Conn)
+	}{
+		{c.plaintextPort, c.handlePlaintext},
+		{c.picklePort, c.handlePickle},
+	}
+
+	for _, protocol := range protocols {
+		if protocol.port == 0 {
+			continue
+		}
+
+		// listen here rather than in the goroutine, so a port that's in use
+		// is an error from Start
+		addr := fmt.Sprintf(":%d", protocol.port)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("carbon consumer: could not listen on %s: %s", addr, err)
+		}
+		c.listeners = append(c.listeners, listener)
+		log.Printf("carbon consumer %s listening on %s", c.name, addr)
+
+		c.running.Add(1)
+		go c.accept(listener, protocol.handle)
+	}
+	return nil
+}
+
+func (c *CarbonConsumer) accept(listener net.Listener, handle func(net.Conn)) {
+	defer c.running.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !c.stopping() {
+				log.Printf("carbon consumer: stopped accepting connections on %s: %s", listener.Addr(), err)
+			}
+			return
+		}
+
+		c.connMutex.Lock()
+		// Stop might have closed the others already
+		if c.stopping() {
+			c.connMutex.Unlock()
+			conn.Close()
+			continue
+		}
+		c.conns[conn] = true
+		c.connMutex.Unlock()
+
+		c.running.Add(1)
+		go func() {
+			defer c.running.Done()
+			defer func() {
+				c.connMutex.Lock()
+				delete(c.conns, conn)
+				c.connMutex.Unlock()
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// handlePlaintext reads "name value timestamp" lines.
+func (c *CarbonConsumer) handlePlaintext(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// carbon ignores anything else, so this does too
+		if len(fields) == 3 {
+			c.add(fields[0])
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil && !c.stopping() {
+		log.Printf("carbon consumer: error reading from %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// handlePickle reads pickles, each preceded by its length as a 32 bit
+// big-endian integer.
+func (c *CarbonConsumer) handlePickle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			if err != io.EOF && !c.stopping() {
+				log.Printf("carbon consumer: error reading from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if size > maxPickleSize {
+			log.Printf("carbon consumer: %s sent a %d byte pickle, but the limit is %d", conn.RemoteAddr(), size, maxPickleSize)
+			return
+		}
+
+		payload := make([]byte, size)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			if !c.stopping() {
+				log.Printf("carbon consumer: error reading from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		names, err := unpickleMetrics(payload)
+		if err != nil {
+			// like carbon, give up on the connection
+			log.Printf("carbon consumer: bad pickle from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		for _, name := range names {
+			c.add(name)
+		}
+	}
+}
+
+// add queues a metric to be inserted, unless it was recently.
+func (c *CarbonConsumer) add(metric string) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if last, ok := c.seen[metric]; ok && now.Sub(last) < c.refreshInterval {
+		return
+	}
+	// even if no rule matches, so the rules aren't tried on every datapoint
+	c.seen[metric] = now
+
+	for _, join := range c.joins(metric) {
+		c.pending[join] = append(c.pending[join], metric)
+	}
+}
+
+// joins finds the join key values a metric belongs to, according to the rules.
+func (c *CarbonConsumer) joins(metric string) []join {
+	var joins []join
+	for _, r := range c.rules {
+		submatches := r.match.FindStringSubmatchIndex(metric)
+		if submatches == nil {
+			continue
+		}
+
+		value := string(r.match.ExpandString(nil, r.value, metric, submatches))
+		if value != "" {
+			joins = append(joins, join{key: r.key, value: value})
+		}
+	}
+	return joins
+}
+
+func (c *CarbonConsumer) flushEvery(db *database.Database) {
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.shutdown:
+			// the connections are closed by now, so this is the last of it
+			c.running.Wait()
+			c.flush(db)
+			return
+		case <-ticker.C:
+			c.flush(db)
+		}
+	}
+}
+
+// flush inserts the pending metrics, and forgets the ones which are due to be
+// inserted again anyway.
+func (c *CarbonConsumer) flush(db *database.Database) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	pending := c.pending
+	c.pending = make(map[join][]string)
+	for metric, last := range c.seen {
+		if now.Sub(last) >= c.refreshInterval {
+			delete(c.seen, metric)
+		}
+	}
+	c.mutex.Unlock()
+
+	stats := db.Stats()
+	for join, metrics := range pending {
+		msg := &m.KeyMetric{
+			Key:     join.key,
+			Value:   join.value,
+			Metrics: metrics,
+		}
+
+		stats.ConsumerMessages.Add(c.name, 1)
+		err := db.InsertMetrics(msg)
+		if err != nil {
+			stats.ConsumerErrors.Add(c.name, 1)
+			log.Printf("carbon consumer: could not insert the metrics for %s:%s: %s", join.key, join.value, err)
+			// so they can be replayed as a metric message
+			payload, _ := json.Marshal(msg)
+			db.DeadLetter(c.name, m.MetricType, payload, err)
+		}
+	}
+}
+
+func (c *CarbonConsumer) stopping() bool {
+	select {
+	case <-c.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *CarbonConsumer) closeListeners() {
+	for _, listener := range c.listeners {
+		listener.Close()
+	}
+}
+
+// Stop stops listening and closes the connections, then waits for whatever
+// metrics are still pending to be inserted.
+func (c *CarbonConsumer) Stop() error {
+	close(c.shutdown)
+	c.closeListeners()
+
+	c.connMutex.Lock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.connMutex.Unlock()
+
+	<-c.done
+	return nil
+}
+
+// CaughtUp is always true: a relay only sends what's happening now, so there's
+// nothing to catch up on.
+func (c *CarbonConsumer) CaughtUp() bool {
+	return true
+}
+
+func (c *CarbonConsumer) Name() string {
+	return c.name
+}
@@ -0,0 +1,214 @@
+package carbon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	c "github.com/kanatohodets/carbonsearch/consumer"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+// make sure that it implements the Consumer interface
+var _ c.Consumer = &CarbonConsumer{}
+
+var stats = util.InitStats()
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestUnpickle(t *testing.T) {
+	// as pickled by python 2 and 3, with various protocols
+	pickles := map[string]string{
+		"protocol 0, python 2": "(lp0\n(S'server.host1.cpu'\np1\n(I1500000000\nF1.5\ntp2\ntp3\na(S'server.host2.cpu'\np4\n(I1500000000\nI2\ntp5\ntp6\na.",
+		"protocol 0, python 3": "(lp0\n(Vserver.host1.cpu\np1\n(I1500000000\nF1.5\ntp2\ntp3\na(Vserver.host2.cpu\np4\n(I1500000000\nI2\ntp5\ntp6\na.",
+		"protocol 2, python 2": "\x80\x02]q\x00(U\x10server.host1.cpuq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03U\x10server.host2.cpuq\x04J\x00/hYK\x02\x86q\x05\x86q\x06e.",
+		"protocol 2, python 3": "\x80\x02]q\x00(X\x10\x00\x00\x00server.host1.cpuq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x10\x00\x00\x00server.host2.cpuq\x04J\x00/hYK\x02\x86q\x05\x86q\x06e.",
+		"protocol 4, python 3": "\x80\x04\x95H\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x10server.host1.cpu\x94J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x10server.host2.cpu\x94J\x00/hYK\x02\x86\x94\x86\x94e.",
+	}
+
+	expected := []string{"server.host1.cpu", "server.host2.cpu"}
+	for desc, pickle := range pickles {
+		names, err := unpickleMetrics([]byte(pickle))
+		if err != nil {
+			t.Errorf("carbon test: could not unpickle %s: %s", desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("carbon test: expected %v from %s, but got %v", expected, desc, names)
+		}
+	}
+
+	bad := map[string]string{
+		// python 3 pickling bytes calls _codecs.encode
+		"a global":   "\x80\x02]q\x00c_codecs\nencode\nq\x01X\x10\x00\x00\x00server.host1.cpuq\x02X\x06\x00\x00\x00latin1q\x03\x86q\x04Rq\x05J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x06\x86q\x07a.",
+		"truncated":  "\x80\x02]q\x00(X\x10\x00\x00\x00server.host1",
+		"not a list": "\x80\x02X\x10\x00\x00\x00server.host1.cpu.",
+	}
+	for desc, pickle := range bad {
+		_, err := unpickleMetrics([]byte(pickle))
+		if err == nil {
+			t.Errorf("carbon test: expected an error unpickling %s", desc)
+		}
+	}
+}
+
+func TestJoins(t *testing.T) {
+	consumer, err := newConsumer("carbon", &CarbonConfig{
+		PlaintextPort: 2003,
+		Rules: []RuleConfig{
+			{Match: `^server\.([^.]+)\.`, Join: "fqdn:$1"},
+			{Match: `^server\.(?P<host>[^.]+?)-\d+\.`, Join: "cluster:${host}"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]join{
+		"server.hostname-1234.cpu.i7z": {{"fqdn", "hostname-1234"}, {"cluster", "hostname"}},
+		"server.db.load":               {{"fqdn", "db"}},
+		"monitors.is_the_site_up":      nil,
+	}
+	for metric, expected := range tests {
+		joins := consumer.joins(metric)
+		if !reflect.DeepEqual(joins, expected) {
+			t.Errorf("carbon test: expected %s to join to %v, but got %v", metric, expected, joins)
+		}
+	}
+
+	_, err = newConsumer("carbon", &CarbonConfig{
+		PlaintextPort: 2003,
+		Rules:         []RuleConfig{{Match: `^server\.([^.]+)\.`, Join: "$1"}},
+	})
+	if err == nil {
+		t.Errorf("carbon test: a rule without a join key should be an error")
+	}
+}
+
+func TestListen(t *testing.T) {
+	db := database.New(100, stats)
+	consumer, err := newConsumer("carbon", &CarbonConfig{
+		PlaintextPort: freePort(t),
+		PicklePort:    freePort(t),
+		Rules:         []RuleConfig{{Match: `^server\.([^.]+)\.`, Join: "fqdn:$1"}},
+		FlushInterval: "10ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	err = consumer.Start(wg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", consumer.plaintextPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plaintext.Close()
+	fmt.Fprintf(plaintext, "server.host1.cpu 1.5 1500000000\nnot a datapoint\nmonitors.is_the_site_up 1 1500000000\n")
+
+	pickled, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", consumer.picklePort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pickled.Close()
+	payload := "\x80\x02]q\x00(X\x10\x00\x00\x00server.host2.cpuq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03e."
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	pickled.Write(append(header, payload...))
+
+	for _, host := range []string{"host1", "host2"} {
+		metric := "server." + host + ".cpu"
+		var result *database.MetricTags
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			result, err = db.TagsForMetric(metric)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Errorf("carbon test: %s never showed up: %s", metric, err)
+			continue
+		}
+		joins := result.Split["fqdn"]
+		if len(joins) != 1 || joins[0].Join != host {
+			t.Errorf("carbon test: expected %s to be joined to fqdn %s, but got %v", metric, host, joins)
+		}
+	}
+
+	// nothing joins it to anything
+	_, err = db.TagsForMetric("monitors.is_the_site_up")
+	if err == nil {
+		t.Errorf("carbon test: a metric which doesn't match any rule shouldn't be inserted")
+	}
+
+	err = consumer.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+func TestStopAfterFailedStart(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	db := database.New(100, stats)
+	consumer, err := newConsumer("carbon", &CarbonConfig{
+		PlaintextPort: freePort(t),
+		// already taken
+		PicklePort: listener.Addr().(*net.TCPAddr).Port,
+		Rules:      []RuleConfig{{Match: `^server\.([^.]+)\.`, Join: "fqdn:$1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	err = consumer.Start(wg, db)
+	if err == nil {
+		t.Fatalf("carbon test: expected an error starting on a port that's in use")
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- consumer.Stop()
+	}()
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("carbon test: Stop never returned after Start failed")
+	}
+	wg.Wait()
+
+	// the plaintext port was let go of
+	plaintext, err := net.Listen("tcp", fmt.Sprintf(":%d", consumer.plaintextPort))
+	if err != nil {
+		t.Errorf("carbon test: the plaintext port is still in use after Stop: %s", err)
+	} else {
+		plaintext.Close()
+	}
+}
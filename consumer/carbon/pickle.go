@@ -0,0 +1,444 @@
+package carbon
+
+/*
+
+a minimal unpickler for what carbon's pickle protocol sends: a list of
+(name, (timestamp, value)) tuples. it understands lists, tuples, strings,
+numbers, None and booleans in any pickle protocol, plus the memo and framing
+opcodes that go with them. anything that would construct some other kind of
+object (globals, reduce, builds, dicts...) is an error, so a pickle can't make
+carbonsearch do anything but read names.
+
+numbers are skipped rather than decoded, since only the names are wanted.
+
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opPopMark        = '1'
+	opDup            = '2'
+	opFloat          = 'F'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opBinInt2        = 'M'
+	opLong           = 'L'
+	opLong1          = 0x8a
+	opLong4          = 0x8b
+	opNone           = 'N'
+	opNewTrue        = 0x88
+	opNewFalse       = 0x89
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opShortBinUni    = 0x8c
+	opBinUnicode8    = 0x8d
+	opBinBytes       = 'B'
+	opShortBinBytes  = 'C'
+	opBinFloat       = 'G'
+	opEmptyList      = ']'
+	opAppend         = 'a'
+	opAppends        = 'e'
+	opList           = 'l'
+	opEmptyTuple     = ')'
+	opTuple          = 't'
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opMemoize        = 0x94
+	opProto          = 0x80
+	opFrame          = 0x95
+)
+
+// pickleList is a pointer, since appending to a list changes it wherever it
+// has been memoized
+type pickleList struct {
+	items []interface{}
+}
+
+type pickleTuple []interface{}
+
+// pickleMark separates the items on the stack which belong to the next list
+// or tuple
+type pickleMark struct{}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// unpickleMetrics decodes a carbon pickle payload and returns the metric
+// names in it.
+func unpickleMetrics(data []byte) ([]string, error) {
+	u := &unpickler{data: data, memo: make(map[int]interface{})}
+	value, err := u.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := value.(*pickleList)
+	if !ok {
+		return nil, fmt.Errorf("carbon consumer: expected a pickled list, but got %T", value)
+	}
+
+	names := make([]string, 0, len(list.items))
+	for _, item := range list.items {
+		datapoint, ok := item.(pickleTuple)
+		if !ok || len(datapoint) != 2 {
+			return nil, fmt.Errorf("carbon consumer: expected a (name, (timestamp, value)) tuple, but got %v", item)
+		}
+		name, ok := datapoint[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("carbon consumer: expected a metric name, but got %v", datapoint[0])
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		op, err := u.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opStop:
+			if len(u.stack) != 1 {
+				return nil, fmt.Errorf("carbon consumer: pickle stopped with %d things on the stack", len(u.stack))
+			}
+			return u.stack[0], nil
+
+		case opProto:
+			_, err = u.read(1)
+		case opFrame:
+			_, err = u.read(8)
+
+		case opMark:
+			u.push(pickleMark{})
+		case opPop:
+			_, err = u.pop()
+		case opPopMark:
+			_, err = u.popMark()
+		case opDup:
+			var top interface{}
+			top, err = u.top()
+			u.push(top)
+
+		// numbers, none and booleans
+		case opFloat, opInt, opLong:
+			_, err = u.line()
+			u.push(nil)
+		case opBinInt:
+			_, err = u.read(4)
+			u.push(nil)
+		case opBinInt1:
+			_, err = u.read(1)
+			u.push(nil)
+		case opBinInt2:
+			_, err = u.read(2)
+			u.push(nil)
+		case opBinFloat:
+			_, err = u.read(8)
+			u.push(nil)
+		case opLong1:
+			var n int
+			n, err = u.length(1)
+			if err == nil {
+				_, err = u.read(n)
+			}
+			u.push(nil)
+		case opLong4:
+			var n int
+			n, err = u.length(4)
+			if err == nil {
+				_, err = u.read(n)
+			}
+			u.push(nil)
+		case opNone, opNewTrue, opNewFalse:
+			u.push(nil)
+
+		// strings
+		case opString:
+			var line []byte
+			line, err = u.line()
+			if err == nil {
+				var s string
+				s, err = unquote(line)
+				u.push(s)
+			}
+		case opUnicode:
+			var line []byte
+			line, err = u.line()
+			u.push(string(line))
+		case opBinString, opBinUnicode, opBinBytes:
+			err = u.pushString(4)
+		case opShortBinString, opShortBinUni, opShortBinBytes:
+			err = u.pushString(1)
+		case opBinUnicode8:
+			err = u.pushString(8)
+
+		// lists and tuples
+		case opEmptyList:
+			u.push(&pickleList{})
+		case opList:
+			var items []interface{}
+			items, err = u.popMark()
+			u.push(&pickleList{items: items})
+		case opAppend:
+			var item interface{}
+			item, err = u.pop()
+			if err == nil {
+				err = u.appendTo([]interface{}{item})
+			}
+		case opAppends:
+			var items []interface{}
+			items, err = u.popMark()
+			if err == nil {
+				err = u.appendTo(items)
+			}
+		case opEmptyTuple:
+			u.push(pickleTuple{})
+		case opTuple:
+			var items []interface{}
+			items, err = u.popMark()
+			u.push(pickleTuple(items))
+		case opTuple1, opTuple2, opTuple3:
+			err = u.pushTuple(int(op-opTuple1) + 1)
+
+		// the memo
+		case opPut:
+			var line []byte
+			line, err = u.line()
+			if err == nil {
+				err = u.put(strconv.Atoi(string(line)))
+			}
+		case opBinPut:
+			err = u.put(u.length(1))
+		case opLongBinPut:
+			err = u.put(u.length(4))
+		case opMemoize:
+			err = u.put(len(u.memo), nil)
+		case opGet:
+			var line []byte
+			line, err = u.line()
+			if err == nil {
+				err = u.get(strconv.Atoi(string(line)))
+			}
+		case opBinGet:
+			err = u.get(u.length(1))
+		case opLongBinGet:
+			err = u.get(u.length(4))
+
+		default:
+			return nil, fmt.Errorf("carbon consumer: unsupported pickle opcode 0x%02x", op)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) byte() (byte, error) {
+	b, err := u.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, fmt.Errorf("carbon consumer: pickle ended early")
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+// line reads up to the next newline, for the text opcodes
+func (u *unpickler) line() ([]byte, error) {
+	i := bytes.IndexByte(u.data[u.pos:], '\n')
+	if i < 0 {
+		return nil, fmt.Errorf("carbon consumer: pickle ended early")
+	}
+	line := u.data[u.pos : u.pos+i]
+	u.pos += i + 1
+	return line, nil
+}
+
+// length reads a little-endian unsigned integer of size bytes
+func (u *unpickler) length(size int) (int, error) {
+	b, err := u.read(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	switch size {
+	case 1:
+		n = uint64(b[0])
+	case 4:
+		n = uint64(binary.LittleEndian.Uint32(b))
+	case 8:
+		n = binary.LittleEndian.Uint64(b)
+	}
+	if n > uint64(len(u.data)) {
+		return 0, fmt.Errorf("carbon consumer: pickle ended early")
+	}
+	return int(n), nil
+}
+
+func (u *unpickler) pushString(size int) error {
+	n, err := u.length(size)
+	if err != nil {
+		return err
+	}
+	b, err := u.read(n)
+	if err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) pushTuple(n int) error {
+	if len(u.stack) < n {
+		return fmt.Errorf("carbon consumer: bad pickle: not enough on the stack for a tuple")
+	}
+	items := make(pickleTuple, n)
+	copy(items, u.stack[len(u.stack)-n:])
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(items)
+	return nil
+}
+
+func (u *unpickler) appendTo(items []interface{}) error {
+	top, err := u.top()
+	if err != nil {
+		return err
+	}
+	list, ok := top.(*pickleList)
+	if !ok {
+		return fmt.Errorf("carbon consumer: bad pickle: appending to %T", top)
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) put(index int, err error) error {
+	if err != nil {
+		return err
+	}
+	top, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[index] = top
+	return nil
+}
+
+func (u *unpickler) get(index int, err error) error {
+	if err != nil {
+		return err
+	}
+	value, ok := u.memo[index]
+	if !ok {
+		return fmt.Errorf("carbon consumer: bad pickle: nothing memoized at %d", index)
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) push(value interface{}) {
+	u.stack = append(u.stack, value)
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("carbon consumer: bad pickle: the stack is empty")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	top, err := u.top()
+	if err != nil {
+		return nil, err
+	}
+	u.stack = u.stack[:len(u.stack)-1]
+	return top, nil
+}
+
+// popMark pops everything down to the last mark, and the mark itself
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}(nil), u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("carbon consumer: bad pickle: there's no mark on the stack")
+}
+
+// unquote decodes the Python string literal of a protocol 0 STRING opcode
+func unquote(quoted []byte) (string, error) {
+	if len(quoted) < 2 || (quoted[0] != '\'' && quoted[0] != '"') || quoted[len(quoted)-1] != quoted[0] {
+		return "", fmt.Errorf("carbon consumer: bad pickle: %q isn't a quoted string", quoted)
+	}
+	quoted = quoted[1 : len(quoted)-1]
+
+	var buf bytes.Buffer
+	for i := 0; i < len(quoted); i++ {
+		if quoted[i] != '\\' || i == len(quoted)-1 {
+			buf.WriteByte(quoted[i])
+			continue
+		}
+
+		i++
+		switch quoted[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'x':
+			if i+2 >= len(quoted) {
+				return "", fmt.Errorf("carbon consumer: bad pickle: truncated escape in %q", quoted)
+			}
+			b, err := strconv.ParseUint(string(quoted[i+1:i+3]), 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("carbon consumer: bad pickle: bad escape in %q", quoted)
+			}
+			buf.WriteByte(byte(b))
+			i += 2
+		default:
+			// \\, \' and \"
+			buf.WriteByte(quoted[i])
+		}
+	}
+	return buf.String(), nil
+}
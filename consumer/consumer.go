@@ -9,5 +9,11 @@ import (
 type Consumer interface {
 	Name() string
 	Start(*sync.WaitGroup, *database.Database) error
+	// Stop is also called if Start fails, to release whatever the consumer
+	// holds (like connections made by New), so it can't wait for anything
+	// Start didn't get as far as starting.
 	Stop() error
+	// CaughtUp reports whether the consumer has applied everything its
+	// source had when it started, so that queries see the whole picture.
+	CaughtUp() bool
 }
@@ -0,0 +1,445 @@
+package file
+
+/*
+
+the file consumer loads messages from newline-delimited JSON files: one message
+per line, with a 'type' field saying which kind of message it is (any of the
+message.*Type names). the rest of the line is the message itself:
+
+	{"type": "metric", "key": "fqdn", "value": "host1", "metrics": ["server.host1.cpu"]}
+	{"type": "tag", "key": "fqdn", "value": "host1", "tags": ["servers-dc:us_east"]}
+	{"type": "custom", "tags": ["custom-favorites:btyler"], "metrics": ["server.host1.cpu"]}
+
+this is for bootstrapping a fresh carbonsearch, or rebuilding one after a
+disaster, from something like a CMDB dump, without going through kafka.
+
+each configured path is either a file, or a directory whose files (matching
+'pattern') are read in name order. gzipped files are decompressed, whatever
+they're called. with 'follow' set, the consumer keeps going after reading
+everything: lines appended to plain files are applied as they're written, and
+new files showing up in the directories are read too. files are polled rather
+than watched, since that works everywhere (including NFS).
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/consumer"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/database/deadletter"
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+const defaultPollInterval = time.Second
+
+type FileConfig struct {
+	// files, or directories of files, to read
+	Paths []string `yaml:"paths"`
+	// which files in a directory to read, as a filepath.Match pattern
+	Pattern string `yaml:"pattern"`
+	// keep reading lines appended to the files, and new files in the directories
+	Follow bool `yaml:"follow"`
+	// how often to look for new lines and files when following
+	PollInterval string `yaml:"poll_interval"`
+}
+
+type FileConsumer struct {
+	name         string
+	paths        []string
+	pattern      string
+	follow       bool
+	pollInterval time.Duration
+	shutdown     chan bool
+	// closed once the goroutine reading the files has returned
+	done chan bool
+
+	// set once everything there was at startup has been read
+	caughtUp int32
+}
+
+func init() {
+	consumer.Register("file", func(name string, configPath string) (consumer.Consumer, error) {
+		return New(name, configPath)
+	})
+}
+
+func New(name string, configPath string) (*FileConsumer, error) {
+	config := &FileConfig{}
+	err := util.ReadConfig(configPath, config)
+	if err != nil {
+		return nil, err
+	}
+	return newConsumer(name, config)
+}
+
+func newConsumer(name string, config *FileConfig) (*FileConsumer, error) {
+	if len(config.Paths) == 0 {
+		return nil, fmt.Errorf("file consumer: 'paths' is empty, so there is nothing to read")
+	}
+
+	pattern := config.Pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+	_, err := filepath.Match(pattern, "")
+	if err != nil {
+		return nil, fmt.Errorf("file consumer: bad pattern %q: %s", pattern, err)
+	}
+
+	pollInterval := defaultPollInterval
+	if config.PollInterval != "" {
+		pollInterval, err = time.ParseDuration(config.PollInterval)
+		if err != nil {
+			return nil, fmt.Errorf("file consumer: could not parse poll_interval %q: %s", config.PollInterval, err)
+		}
+		if pollInterval <= 0 {
+			return nil, fmt.Errorf("file consumer: poll_interval must be positive, but it is %q", config.PollInterval)
+		}
+	}
+
+	return &FileConsumer{
+		name:         name,
+		paths:        config.Paths,
+		pattern:      pattern,
+		follow:       config.Follow,
+		pollInterval: pollInterval,
+		shutdown:     make(chan bool),
+		done:         make(chan bool),
+	}, nil
+}
+
+func (f *FileConsumer) Start(wg *sync.WaitGroup, db *database.Database) error {
+	// a path that isn't there is probably a typo, so say so now rather than
+	// reading nothing
+	for _, path := range f.paths {
+		_, err := os.Stat(path)
+		if err != nil {
+			// nothing was started, so there's nothing for Stop to wait for
+			close(f.done)
+			return fmt.Errorf("file consumer: %s", err)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(f.done)
+		f.run(db)
+	}()
+	return nil
+}
+
+func (f *FileConsumer) run(db *database.Database) {
+	sources := make(map[string]*source)
+	defer func() {
+		for _, src := range sources {
+			src.close()
+		}
+	}()
+
+	for {
+		for _, path := range f.find() {
+			src, ok := sources[path]
+			if !ok {
+				var err error
+				src, err = openSource(path)
+				if err != nil {
+					log.Printf("file consumer: %s", err)
+					continue
+				}
+				sources[path] = src
+			}
+
+			if !f.read(db, src) {
+				return
+			}
+		}
+
+		if atomic.CompareAndSwapInt32(&f.caughtUp, 0, 1) {
+			log.Printf("file consumer: %s caught up after reading %d files", f.name, len(sources))
+		}
+
+		if !f.follow {
+			return
+		}
+
+		if !f.dropDeleted(db, sources) {
+			return
+		}
+
+		select {
+		case <-f.shutdown:
+			return
+		case <-time.After(f.pollInterval):
+		}
+	}
+}
+
+// find lists the files to read, in order: each configured file, or the files
+// in each configured directory which match the pattern, sorted by name.
+func (f *FileConsumer) find() []string {
+	paths := []string{}
+	for _, path := range f.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("file consumer: %s", err)
+			continue
+		}
+
+		if !info.IsDir() {
+			paths = append(paths, path)
+			continue
+		}
+
+		// sorted by name
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			log.Printf("file consumer: %s", err)
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			if matched, _ := filepath.Match(f.pattern, entry.Name()); matched {
+				paths = append(paths, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	return paths
+}
+
+// dropDeleted closes the sources whose files have been deleted, and forgets
+// them: nothing more will be written to them, and holding them open would keep
+// the space they take up on disk. whatever was written to them since the last
+// poll is read first. like read, it reports whether to carry on.
+func (f *FileConsumer) dropDeleted(db *database.Database, sources map[string]*source) bool {
+	for path, src := range sources {
+		if !src.deleted() {
+			continue
+		}
+
+		if !f.read(db, src) {
+			return false
+		}
+		// nobody is going to finish the last line now
+		if len(src.partial) > 0 {
+			f.apply(db, src, src.partial)
+			src.partial = nil
+		}
+		log.Printf("file consumer: %s was deleted, so it won't be read any more", path)
+		src.close()
+		delete(sources, path)
+	}
+	return true
+}
+
+// read applies the lines of src that haven't been read yet, and reports
+// whether to carry on: false means the consumer is shutting down.
+func (f *FileConsumer) read(db *database.Database, src *source) bool {
+	if src.finished {
+		return true
+	}
+
+	if f.follow && !src.gzipped {
+		src.checkReplaced()
+	}
+
+	for {
+		select {
+		case <-f.shutdown:
+			return false
+		default:
+		}
+
+		line, err := src.reader.ReadBytes('\n')
+		src.offset += int64(len(line))
+		if err == nil {
+			f.apply(db, src, append(src.partial, line...))
+			src.partial = nil
+			continue
+		}
+
+		if err != io.EOF {
+			log.Printf("file consumer: could not read %s: %s", src.path, err)
+			src.finished = true
+			return true
+		}
+
+		// the last line might still be being written
+		if f.follow && !src.gzipped {
+			src.partial = append(src.partial, line...)
+			return true
+		}
+
+		if len(src.partial)+len(line) > 0 {
+			f.apply(db, src, append(src.partial, line...))
+			src.partial = nil
+		}
+		// gzipped files can't be followed, so they're only read once
+		src.finished = true
+		return true
+	}
+}
+
+func (f *FileConsumer) apply(db *database.Database, src *source, line []byte) {
+	src.line++
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	envelope := struct {
+		Type string `json:"type"`
+	}{}
+	err := json.Unmarshal(line, &envelope)
+	if err == nil && envelope.Type == "" {
+		err = fmt.Errorf("there's no 'type'")
+	}
+	if err != nil {
+		err = fmt.Errorf("file consumer: could not decode line: %s", err)
+		log.Printf("%s line %d: %s", src.path, src.line, err)
+		// without a type, there's no way to replay it
+		db.DeadLetter(f.name, deadletter.UnknownType, line, err)
+		return
+	}
+
+	err = db.ApplyFrom(f.name, envelope.Type, line)
+	if err != nil {
+		log.Printf("file consumer: %s line %d: %s", src.path, src.line, err)
+	}
+}
+
+// Stop stops reading, and waits for the line being applied (if any).
+func (f *FileConsumer) Stop() error {
+	close(f.shutdown)
+	<-f.done
+	return nil
+}
+
+// CaughtUp reports whether every file there was at startup has been read to
+// the end.
+func (f *FileConsumer) CaughtUp() bool {
+	return atomic.LoadInt32(&f.caughtUp) == 1
+}
+
+func (f *FileConsumer) Name() string {
+	return f.name
+}
+
+// source is a file being read, and how far it has got.
+type source struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	gzipped bool
+	// bytes read from the file so far; only for plain files
+	offset int64
+	// the start of a line which hasn't been finished yet
+	partial []byte
+	// the number of lines read so far
+	line int
+	// whether there's nothing more to read
+	finished bool
+}
+
+func openSource(path string) (*source, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	src := &source{
+		path:   path,
+		file:   file,
+		info:   info,
+		reader: bufio.NewReader(file),
+	}
+
+	// gzipped files are recognized by their magic number rather than their name
+	magic, _ := src.reader.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(src.reader)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not decompress %s: %s", path, err)
+		}
+		src.reader = bufio.NewReader(gz)
+		src.gzipped = true
+	}
+	return src, nil
+}
+
+// checkReplaced starts src again from the beginning if it has been truncated,
+// or replaced by a new file with the same name (after being rotated, say).
+func (src *source) checkReplaced() {
+	info, err := os.Stat(src.path)
+	if err != nil {
+		// if it's gone, dropDeleted takes care of it
+		return
+	}
+
+	if os.SameFile(info, src.info) {
+		if info.Size() < src.offset {
+			log.Printf("file consumer: %s was truncated, so reading it again from the start", src.path)
+			_, err = src.file.Seek(0, io.SeekStart)
+			if err != nil {
+				log.Printf("file consumer: could not go back to the start of %s: %s", src.path, err)
+				src.finished = true
+				return
+			}
+			src.reset(src.file, info)
+		}
+		return
+	}
+
+	file, err := os.Open(src.path)
+	if err != nil {
+		log.Printf("file consumer: could not reopen %s: %s", src.path, err)
+		return
+	}
+	log.Printf("file consumer: %s was replaced, so reading the new one from the start", src.path)
+	// whatever was left of the old one is lost, though in the usual case
+	// (rotation), it was read on the last poll
+	src.file.Close()
+	src.reset(file, info)
+}
+
+// deleted reports whether src's file is no longer there.
+func (src *source) deleted() bool {
+	_, err := os.Stat(src.path)
+	return os.IsNotExist(err)
+}
+
+func (src *source) reset(file *os.File, info os.FileInfo) {
+	src.file = file
+	src.info = info
+	src.reader = bufio.NewReader(file)
+	src.offset = 0
+	src.partial = nil
+	src.line = 0
+}
+
+func (src *source) close() {
+	src.file.Close()
+}
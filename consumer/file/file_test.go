@@ -0,0 +1,300 @@
+package file
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	c "github.com/kanatohodets/carbonsearch/consumer"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/database/deadletter"
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+// make sure that it implements the Consumer interface
+var _ c.Consumer = &FileConsumer{}
+
+var stats = util.InitStats()
+
+func writeFile(t *testing.T, path string, contents string) {
+	err := ioutil.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendFile(t *testing.T, path string, contents string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.WriteString(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeGzipFile(t *testing.T, path string, contents string) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	_, err = gz.Write([]byte(contents))
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor waits for a condition to hold, and reports whether it did
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func hasMetric(db *database.Database, metric string) bool {
+	_, err := db.TagsForMetric(metric)
+	return err == nil
+}
+
+func TestReadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonsearch-file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "1-dump.ndjson"), `{"type": "metric", "key": "fqdn", "value": "host1", "metrics": ["server.host1.cpu"]}
+{"type": "tag", "key": "fqdn", "value": "host1", "tags": ["servers-dc:us_east"]}
+
+{"type": "metric", "key": "fqdn", "value": `+`
+{"key": "fqdn", "value": "host2", "metrics": ["server.host2.cpu"]}
+{"type": "metric", "key": "fqdn", "value": "host3", "metrics": ["server.host3.cpu"]}`)
+	// gzipped, whatever the name says
+	writeGzipFile(t, filepath.Join(dir, "2-custom.ndjson"), `{"type": "custom", "tags": ["custom-favorites:tester"], "metrics": ["server.host4.cpu"]}
+`)
+	writeFile(t, filepath.Join(dir, "README"), "not messages\n")
+
+	db := database.New(100, stats)
+	queue, err := deadletter.NewQueue(nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetDeadLetters(queue)
+
+	f, err := newConsumer("file", &FileConfig{
+		Paths:   []string{dir},
+		Pattern: "*.ndjson",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	err = f.Start(wg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without follow, the consumer is done once it has read everything
+	wg.Wait()
+
+	if !f.CaughtUp() {
+		t.Errorf("file test: not caught up after reading every file")
+	}
+
+	result, err := db.Query(map[string][]string{"servers": {"servers-dc:us_east"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0] != "server.host1.cpu" {
+		t.Errorf("file test: expected the tag message to select server.host1.cpu, but got %v", result)
+	}
+
+	// the last line doesn't have a newline, but there's nothing more coming
+	if !hasMetric(db, "server.host3.cpu") {
+		t.Errorf("file test: the last line of the file wasn't applied")
+	}
+	if !hasMetric(db, "server.host4.cpu") {
+		t.Errorf("file test: the gzipped file wasn't read")
+	}
+
+	letters := queue.Letters()
+	if len(letters) != 2 {
+		t.Fatalf("file test: expected dead letters for the truncated line and the one without a type, but got %v", letters)
+	}
+	for _, letter := range letters {
+		if letter.Source != "file" {
+			t.Errorf("file test: expected dead letters from 'file', but got one from %q", letter.Source)
+		}
+		if letter.MsgType != deadletter.UnknownType {
+			t.Errorf("file test: expected dead letters for lines without a type to have type %q, but got %q", deadletter.UnknownType, letter.MsgType)
+		}
+	}
+
+	// they can't be replayed, so they're left alone
+	replay, err := db.ReplayDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay.Replayed) != 0 || len(replay.Failed) != 0 || len(queue.Letters()) != 2 {
+		t.Errorf("file test: expected letters of unknown type to be left out of replays, but got %+v", replay)
+	}
+
+	err = f.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonsearch-file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "1.ndjson")
+	writeFile(t, first, `{"type": "metric", "key": "fqdn", "value": "host1", "metrics": ["server.host1.cpu"]}
+`)
+
+	db := database.New(100, stats)
+	f, err := newConsumer("file", &FileConfig{
+		Paths:        []string{dir},
+		Follow:       true,
+		PollInterval: "10ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	err = f.Start(wg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitFor(f.CaughtUp) {
+		t.Fatalf("file test: never caught up")
+	}
+	if !hasMetric(db, "server.host1.cpu") {
+		t.Errorf("file test: the existing file wasn't read before catching up")
+	}
+
+	// half a line isn't applied until the rest of it shows up
+	appendFile(t, first, `{"type": "metric", "key": "fqdn", `)
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, first, `"value": "host2", "metrics": ["server.host2.cpu"]}
+`)
+	if !waitFor(func() bool { return hasMetric(db, "server.host2.cpu") }) {
+		t.Errorf("file test: the line appended to the file was never applied")
+	}
+
+	writeFile(t, filepath.Join(dir, "2.ndjson"), `{"type": "metric", "key": "fqdn", "value": "host3", "metrics": ["server.host3.cpu"]}
+`)
+	if !waitFor(func() bool { return hasMetric(db, "server.host3.cpu") }) {
+		t.Errorf("file test: the new file was never read")
+	}
+
+	err = f.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+func TestDropDeleted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonsearch-file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kept := filepath.Join(dir, "1.ndjson")
+	deleted := filepath.Join(dir, "2.ndjson")
+	writeFile(t, kept, "")
+	writeFile(t, deleted, "")
+
+	db := database.New(100, stats)
+	f, err := newConsumer("file", &FileConfig{Paths: []string{dir}, Follow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := make(map[string]*source)
+	for _, path := range []string{kept, deleted} {
+		src, err := openSource(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.close()
+		sources[path] = src
+	}
+
+	// written (without a newline) since the last poll, then deleted
+	appendFile(t, deleted, `{"type": "metric", "key": "fqdn", "value": "host1", "metrics": ["server.host1.cpu"]}`)
+	deletedSource := sources[deleted]
+	err = os.Remove(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.dropDeleted(db, sources) {
+		t.Errorf("file test: dropDeleted said to stop, but the consumer isn't shutting down")
+	}
+	if _, ok := sources[deleted]; ok {
+		t.Errorf("file test: the deleted file's source wasn't dropped")
+	}
+	if _, ok := sources[kept]; !ok {
+		t.Errorf("file test: the source of a file which is still there was dropped")
+	}
+	if _, err := deletedSource.file.Stat(); err == nil {
+		t.Errorf("file test: the deleted file was left open")
+	}
+	if !hasMetric(db, "server.host1.cpu") {
+		t.Errorf("file test: what was written to the deleted file before it went wasn't applied")
+	}
+}
+
+func TestStopAfterFailedStart(t *testing.T) {
+	db := database.New(100, stats)
+	f, err := newConsumer("file", &FileConfig{Paths: []string{"/nonexistent/carbonsearch.ndjson"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	err = f.Start(wg, db)
+	if err == nil {
+		t.Fatalf("file test: expected an error starting with a path that isn't there")
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- f.Stop()
+	}()
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("file test: Stop never returned after Start failed")
+	}
+	wg.Wait()
+}
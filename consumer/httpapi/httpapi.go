@@ -1,13 +1,17 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/kanatohodets/carbonsearch/consumer"
 	m "github.com/kanatohodets/carbonsearch/consumer/message"
 	"github.com/kanatohodets/carbonsearch/database"
 	"github.com/kanatohodets/carbonsearch/util"
@@ -18,13 +22,23 @@ type HTTPConfig struct {
 	Endpoint string `yaml:"endpoint"`
 }
 
+// how long Stop waits for requests in flight to finish
+const shutdownTimeout = 10 * time.Second
+
 type HTTPConsumer struct {
+	name     string
 	port     int
 	endpoint string
-	wg       *sync.WaitGroup
+	server   *http.Server
+}
+
+func init() {
+	consumer.Register("httpapi", func(name string, configPath string) (consumer.Consumer, error) {
+		return New(name, configPath)
+	})
 }
 
-func New(configPath string) (*HTTPConsumer, error) {
+func New(name string, configPath string) (*HTTPConsumer, error) {
 	config := &HTTPConfig{}
 	err := util.ReadConfig(configPath, config)
 	if err != nil {
@@ -32,93 +46,101 @@ func New(configPath string) (*HTTPConsumer, error) {
 	}
 
 	return &HTTPConsumer{
+		name:     name,
 		port:     config.Port,
 		endpoint: config.Endpoint,
 	}, nil
 }
 
+// routes under the configured endpoint, and the type of message each one accepts
+var routes = map[string]string{
+	"/tag":           m.TagType,
+	"/metric":        m.MetricType,
+	"/custom":        m.CustomType,
+	"/tag/delete":    m.TagDeleteType,
+	"/metric/delete": m.MetricDeleteType,
+	"/custom/delete": m.CustomDeleteType,
+}
+
 func (h *HTTPConsumer) Start(wg *sync.WaitGroup, db *database.Database) error {
+	mux := http.NewServeMux()
+	for route, msgType := range routes {
+		mux.HandleFunc(h.endpoint+route, handler(h.name, db, h.endpoint+route, msgType))
+	}
+
+	portStr := fmt.Sprintf(":%d", h.port)
+	// listen here rather than in the goroutine, so a port that's in use is
+	// an error from Start
+	listener, err := net.Listen("tcp", portStr)
+	if err != nil {
+		return fmt.Errorf("httpapi: could not listen on %s: %s", portStr, err)
+	}
+
+	h.server = &http.Server{Handler: mux}
+	log.Printf("HTTP consumer Listening on %s\n", portStr)
+
 	wg.Add(1)
-	h.wg = wg
 	go func() {
-		http.HandleFunc(h.endpoint+"/tag", func(w http.ResponseWriter, req *http.Request) {
-			payload, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("problem reading body :( /consumer/tag %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-
-			var msg *m.KeyTag
-			if err := json.Unmarshal(payload, &msg); err != nil {
-				log.Printf("blorg problem unmarshaling /consumer/tag %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			err = db.InsertTags(msg)
-			if err != nil {
-				log.Printf("blorg problem writing data! /consumer/tag %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-		})
-
-		http.HandleFunc(h.endpoint+"/metric", func(w http.ResponseWriter, req *http.Request) {
-			payload, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("problem reading body :( /consumer/metric %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-
-			var msg *m.KeyMetric
-			if err := json.Unmarshal(payload, &msg); err != nil {
-				log.Printf("blorg problem unmarshaling /consumer/metric %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			err = db.InsertMetrics(msg)
-			if err != nil {
-				log.Printf("blorg problem writing data! /consumer/metric %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-		})
-
-		http.HandleFunc(h.endpoint+"/custom", func(w http.ResponseWriter, req *http.Request) {
-			payload, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("couldn't read the body! /consumer/custom %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-
-			var msg *m.TagMetric
-			if err := json.Unmarshal(payload, &msg); err != nil {
-				log.Printf("failure to decode! /consumer/custom %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			err = db.InsertCustom(msg)
-			if err != nil {
-				log.Printf("blorg problem writing data! /consumer/custom %s, %s", err, string(payload))
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-		})
-
-		portStr := fmt.Sprintf(":%d", h.port)
-		log.Printf("HTTP consumer Listening on %s\n", portStr)
-		log.Println(http.ListenAndServe(portStr, nil))
+		defer wg.Done()
+		err := h.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Printf("httpapi: stopped serving: %s", err)
+		}
 	}()
 	return nil
 }
 
+func handler(name string, db *database.Database, path string, msgType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Printf("problem reading body :( %s %s, %s", path, err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// catch malformed JSON before it gets anywhere near the write-ahead log
+		if !json.Valid(payload) {
+			err = fmt.Errorf("httpapi: body is not valid JSON")
+			log.Printf("blorg problem unmarshaling %s %s, %s", path, err, string(payload))
+			db.DeadLetter(name, msgType, payload, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = db.ApplyAndLog(name, msgType, payload)
+		if _, ok := err.(*database.LogError); ok {
+			log.Printf("could not persist message! %s %s, %s", path, err, string(payload))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			log.Printf("blorg problem writing data! %s %s, %s", path, err, string(payload))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// Stop stops accepting messages, and waits for the ones already being handled
+// to be applied (and logged).
 func (h *HTTPConsumer) Stop() error {
-	h.wg.Done()
-	return nil
+	if h.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return h.server.Shutdown(ctx)
+}
+
+// CaughtUp is always true: there's nothing to catch up on, since messages sent
+// before the consumer started were either refused or are in the write-ahead
+// log, which is replayed before any consumers start.
+func (h *HTTPConsumer) CaughtUp() bool {
+	return true
 }
 
 func (h *HTTPConsumer) Name() string {
-	return "httpapi"
+	return h.name
 }
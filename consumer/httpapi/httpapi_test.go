@@ -1,8 +1,67 @@
 package httpapi
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
 	c "github.com/kanatohodets/carbonsearch/consumer"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/util"
 )
 
 // make sure that it implements the Consumer interface
 var _ c.Consumer = &HTTPConsumer{}
+
+// freePort finds a port that nothing is listening on
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestStartStop(t *testing.T) {
+	db := database.New(10, util.InitStats())
+	h := &HTTPConsumer{name: "httpapi", port: freePort(t), endpoint: "/consumer"}
+
+	wg := &sync.WaitGroup{}
+	err := h.Start(wg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/consumer/metric", h.port)
+	msg := `{"key": "fqdn", "value": "hostname-1234", "metrics": ["server.hostname-1234.cpu"]}`
+	resp, err := http.Post(url, "application/json", strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("httpapi test: expected a 200 for a valid message, but got %d", resp.StatusCode)
+	}
+
+	_, err = db.TagsForMetric("server.hostname-1234.cpu")
+	if err != nil {
+		t.Errorf("httpapi test: the metric message wasn't applied: %s", err)
+	}
+
+	err = h.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+	// returns once the server has stopped
+	wg.Wait()
+
+	resp, err = http.Post(url, "application/json", strings.NewReader(msg))
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("httpapi test: messages were still accepted after Stop")
+	}
+}
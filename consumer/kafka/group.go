@@ -0,0 +1,213 @@
+package kafka
+
+/*
+
+consumer group support. the group is only used for storing offsets, so that a
+restart can pick up where the last snapshot left off instead of re-reading
+whole topics: every carbonsearch needs every message, so each one should have
+its own group id.
+
+offsets are never committed as messages arrive. instead, when the database
+takes a snapshot, the offsets of the messages applied so far are remembered,
+and once the snapshot is safely on disk they're committed. that way, loading
+the snapshot and resuming from the committed offsets never misses anything.
+if the database didn't start from a snapshot, committed offsets are ignored
+and the topics are read from the configured 'offset' instead.
+
+*/
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/util"
+
+	"github.com/Shopify/sarama"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type groupHandler struct {
+	name         string
+	db           *database.Database
+	topicMapping map[string]string
+	client       sarama.Client
+	// whether committed offsets can be trusted: only if the database was
+	// loaded from a snapshot
+	resume bool
+
+	mutex sync.Mutex
+	// the offset of the last message applied from each partition
+	applied map[topicPartition]int64
+	// the current session, or nil between sessions (during a rebalance)
+	session sarama.ConsumerGroupSession
+}
+
+func newGroupHandler(name string, db *database.Database, topicMapping map[string]string, client sarama.Client) *groupHandler {
+	return &groupHandler{
+		name:         name,
+		db:           db,
+		topicMapping: topicMapping,
+		client:       client,
+		resume:       db.LoadedSnapshot(),
+		applied:      make(map[topicPartition]int64),
+	}
+}
+
+// Setup is called at the start of each session, after a rebalance. It decides
+// where each newly claimed partition starts from.
+func (h *groupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			offset, ok := h.applied[topicPartition{topic, partition}]
+			switch {
+			case ok:
+				// claimed before by this process: carry on from where it got
+				// to, whatever was committed. only one of these has an effect
+				session.MarkOffset(topic, partition, offset+1, "")
+				session.ResetOffset(topic, partition, offset+1, "")
+			case !h.resume:
+				// a negative offset makes the claim start from the configured
+				// initial offset
+				session.ResetOffset(topic, partition, sarama.OffsetOldest, "")
+			}
+		}
+	}
+
+	log.Printf("kafka consumer: joined group generation %d with partitions %v", session.GenerationID(), session.Claims())
+	h.session = session
+	return nil
+}
+
+// Cleanup is called at the end of each session, when partitions are about to
+// be rebalanced.
+func (h *groupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	log.Printf("kafka consumer: leaving group generation %d", session.GenerationID())
+	h.session = nil
+	return nil
+}
+
+func (h *groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	msgType := h.topicMapping[claim.Topic()]
+	key := topicPartition{claim.Topic(), claim.Partition()}
+	stats := h.db.Stats().KafkaPartition(h.name, claim.Topic(), claim.Partition())
+
+	// a claim starting from the configured offset has sarama's OffsetOldest or
+	// OffsetNewest rather than a real one, which would never be caught up with
+	offset := claim.InitialOffset()
+	if offset < 0 {
+		resolved, err := h.client.GetOffset(claim.Topic(), claim.Partition(), offset)
+		if err != nil {
+			log.Printf("kafka consumer: could not find the starting offset of %s/%d: %s", claim.Topic(), claim.Partition(), err)
+		} else {
+			offset = resolved
+		}
+	}
+	startPartition(h.client, stats, offset)
+
+	for kafkaMsg := range claim.Messages() {
+		apply(h.name, h.db, msgType, kafkaMsg, stats, claim.HighWaterMarkOffset())
+
+		// only once the message is in the database
+		h.mutex.Lock()
+		h.applied[key] = kafkaMsg.Offset
+		h.mutex.Unlock()
+	}
+	return nil
+}
+
+// caughtUp reports whether every partition claimed in the current session has
+// caught up. Between sessions, nothing is.
+func (h *groupHandler) caughtUp() bool {
+	h.mutex.Lock()
+	session := h.session
+	h.mutex.Unlock()
+
+	if session == nil {
+		return false
+	}
+
+	stats := h.db.Stats()
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			if !stats.KafkaPartition(h.name, topic, partition).CaughtUp() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// snapshotTaken is a database.SnapshotHook: it remembers how far the snapshot
+// goes, and commits those offsets once it has been written.
+func (h *groupHandler) snapshotTaken() func() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.session == nil {
+		return nil
+	}
+
+	session := h.session
+	covered := make(map[topicPartition]int64, len(h.applied))
+	for key, offset := range h.applied {
+		covered[key] = offset
+	}
+
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		// after a rebalance, the partitions may belong to someone else
+		if h.session != session {
+			return
+		}
+
+		for topic, partitions := range session.Claims() {
+			for _, partition := range partitions {
+				offset, ok := covered[topicPartition{topic, partition}]
+				if !ok {
+					continue
+				}
+				session.MarkOffset(topic, partition, offset+1, "")
+				session.ResetOffset(topic, partition, offset+1, "")
+			}
+		}
+		session.Commit()
+	}
+}
+
+// consumeGroup runs group sessions until ctx is cancelled. Each call to
+// Consume lasts until the next rebalance.
+func consumeGroup(ctx context.Context, group sarama.ConsumerGroup, topics []string, handler *groupHandler, stats *util.Stats) {
+	go func() {
+		for err := range group.Errors() {
+			if consumerErr, ok := err.(*sarama.ConsumerError); ok {
+				stats.KafkaPartition(handler.name, consumerErr.Topic, consumerErr.Partition).ConsumeErrors.Add(1)
+			}
+			log.Printf("kafka consumer: group error: %s", err)
+		}
+	}()
+
+	for {
+		err := group.Consume(ctx, topics, handler)
+		if err != nil {
+			log.Printf("kafka consumer: error in group session: %s", err)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
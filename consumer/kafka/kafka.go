@@ -1,11 +1,12 @@
 package kafka
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"sync"
 
+	"github.com/kanatohodets/carbonsearch/consumer"
 	m "github.com/kanatohodets/carbonsearch/consumer/message"
 	"github.com/kanatohodets/carbonsearch/database"
 	"github.com/kanatohodets/carbonsearch/util"
@@ -13,27 +14,67 @@ import (
 	"github.com/Shopify/sarama"
 )
 
+// message types that a topic can be mapped to
+var knownTypes = map[string]bool{
+	m.MetricType:       true,
+	m.TagType:          true,
+	m.CustomType:       true,
+	m.MetricDeleteType: true,
+	m.TagDeleteType:    true,
+	m.CustomDeleteType: true,
+}
+
+// consumer groups need at least this version of the kafka protocol
+const defaultGroupVersion = "0.10.2.0"
+
 type KafkaConfig struct {
 	Offset       string            `yaml:"offset"`
 	BrokerList   []string          `yaml:"broker_list"`
 	TopicMapping map[string]string `yaml:"topic_mapping"`
+	// if set, join this consumer group and commit offsets to it. see group.go
+	GroupID string `yaml:"group_id"`
+	// the kafka version to speak, for consumer groups
+	Version string `yaml:"version"`
 }
 
 type KafkaConsumer struct {
+	name              string
 	initialOffset     int64
+	client            sarama.Client
 	consumer          sarama.Consumer
 	partitionsByTopic map[string][]int32
 	topicMapping      map[string]string
 	shutdown          chan bool
+	// the goroutines applying messages, which Stop waits for
+	running sync.WaitGroup
+
+	// stats for each partition consumed, once started
+	partitions []*util.PartitionStats
+
+	// only for consumer groups
+	group        sarama.ConsumerGroup
+	groupCancel  context.CancelFunc
+	groupHandler *groupHandler
+	// takes the group handler's snapshot hook back out of the database
+	removeHook func()
 }
 
-func New(configPath string) (*KafkaConsumer, error) {
+func init() {
+	consumer.Register("kafka", func(name string, configPath string) (consumer.Consumer, error) {
+		return New(name, configPath)
+	})
+}
+
+func New(name string, configPath string) (*KafkaConsumer, error) {
 	config := &KafkaConfig{}
 	err := util.ReadConfig(configPath, config)
 	if err != nil {
 		return nil, err
 	}
+	return newConsumer(name, config)
+}
 
+func newConsumer(name string, config *KafkaConfig) (*KafkaConsumer, error) {
 	var initialOffset int64
 	switch config.Offset {
 	case "oldest":
@@ -44,8 +85,27 @@ func New(configPath string) (*KafkaConsumer, error) {
 		return nil, fmt.Errorf("kafka consumer: offset should be `oldest` or `newest`")
 	}
 
-	c, err := sarama.NewConsumer(config.BrokerList, nil)
+	for topic, msgType := range config.TopicMapping {
+		if !knownTypes[msgType] {
+			return nil, fmt.Errorf("kafka consumer: topic %q is mapped to %q, which is not a known message type", topic, msgType)
+		}
+	}
+
+	if config.GroupID != "" {
+		return newGroupConsumer(name, config, initialOffset)
+	}
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Consumer.Return.Errors = true
+
+	client, err := sarama.NewClient(config.BrokerList, saramaConfig)
 	if err != nil {
+		return nil, fmt.Errorf("kafka consumer: Failed to create a client: %s", err)
+	}
+
+	c, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
 		return nil, fmt.Errorf("kafka consumer: Failed to create a consumer: %s", err)
 	}
 
@@ -54,13 +114,16 @@ func New(configPath string) (*KafkaConsumer, error) {
 		//NOTE(btyler) always fetching all partitions
 		partitionList, err := c.Partitions(topic)
 		if err != nil {
+			client.Close()
 			return nil, err
 		}
 		partitionsByTopic[topic] = partitionList
 	}
 
 	return &KafkaConsumer{
+		name:              name,
 		initialOffset:     initialOffset,
+		client:            client,
 		consumer:          c,
 		partitionsByTopic: partitionsByTopic,
 		topicMapping:      config.TopicMapping,
@@ -68,79 +131,195 @@ func New(configPath string) (*KafkaConsumer, error) {
 	}, nil
 }
 
+func newGroupConsumer(name string, config *KafkaConfig, initialOffset int64) (*KafkaConsumer, error) {
+	rawVersion := config.Version
+	if rawVersion == "" {
+		rawVersion = defaultGroupVersion
+	}
+	version, err := sarama.ParseKafkaVersion(rawVersion)
+	if err != nil {
+		return nil, fmt.Errorf("kafka consumer: %s", err)
+	}
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Version = version
+	saramaConfig.Consumer.Return.Errors = true
+	saramaConfig.Consumer.Offsets.Initial = initialOffset
+	// offsets are committed when a snapshot is written instead
+	saramaConfig.Consumer.Offsets.AutoCommit.Enable = false
+
+	// the group's client is also used to find high-water marks
+	client, err := sarama.NewClient(config.BrokerList, saramaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("kafka consumer: Failed to create a client: %s", err)
+	}
+
+	group, err := sarama.NewConsumerGroupFromClient(config.GroupID, client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("kafka consumer: Failed to join consumer group %q: %s", config.GroupID, err)
+	}
+
+	return &KafkaConsumer{
+		name:          name,
+		initialOffset: initialOffset,
+		client:        client,
+		topicMapping:  config.TopicMapping,
+		shutdown:      make(chan bool),
+		group:         group,
+	}, nil
+}
+
 func (k *KafkaConsumer) Start(wg *sync.WaitGroup, db *database.Database) error {
+	if k.group != nil {
+		return k.startGroup(wg, db)
+	}
+
 	for topic, partitionList := range k.partitionsByTopic {
 		for _, partition := range partitionList {
 			pc, err := k.consumer.ConsumePartition(topic, partition, k.initialOffset)
 			if err != nil {
-				close(k.shutdown)
+				// Stop shuts down the partitions started so far
 				return fmt.Errorf("kafka consumer: Failed to start consumer of topic %s for partition %d: %s", topic, partition, err)
 			}
 
-			wg.Add(1)
+			stats := db.Stats().KafkaPartition(k.name, topic, partition)
+			offset, err := k.client.GetOffset(topic, partition, k.initialOffset)
+			if err != nil {
+				log.Printf("kafka consumer: could not find the starting offset of %s/%d: %s", topic, partition, err)
+			}
+			startPartition(k.client, stats, offset)
+			k.partitions = append(k.partitions, stats)
+
 			go func(pc sarama.PartitionConsumer) {
-				defer wg.Done()
 				<-k.shutdown
-				//TODO(btyler) AsyncClose and wait on pc.Messages/pc.Errors?
-				pc.Close()
+				// stops fetching, and closes pc.Messages once everything
+				// already fetched has been consumed
+				pc.AsyncClose()
 			}(pc)
 
-			switch k.topicMapping[topic] {
-			case "metric":
-				go readMetric(pc, db)
-			case "tag":
-				go readTag(pc, db)
-			case "custom":
-				go readCustom(pc, db)
-			default:
-				panic(fmt.Sprintf("what are you even doing? there's no topic mapping for %s in the config file", topic))
-			}
+			wg.Add(1)
+			k.running.Add(1)
+			go func(pc sarama.PartitionConsumer, msgType string) {
+				defer wg.Done()
+				defer k.running.Done()
+				consume(k.name, pc, db, msgType, stats)
+			}(pc, k.topicMapping[topic])
+			go consumeErrors(pc, stats)
 		}
 	}
 	return nil
 }
 
+func (k *KafkaConsumer) startGroup(wg *sync.WaitGroup, db *database.Database) error {
+	topics := make([]string, 0, len(k.topicMapping))
+	for topic := range k.topicMapping {
+		topics = append(topics, topic)
+	}
+
+	handler := newGroupHandler(k.name, db, k.topicMapping, k.client)
+	k.removeHook = db.AddSnapshotHook(handler.snapshotTaken)
+	k.groupHandler = handler
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k.groupCancel = cancel
+
+	wg.Add(1)
+	k.running.Add(1)
+	go func() {
+		defer wg.Done()
+		defer k.running.Done()
+		consumeGroup(ctx, k.group, topics, handler, db.Stats())
+	}()
+	return nil
+}
+
+// Stop stops fetching messages, and waits for the ones already fetched to be
+// applied.
 func (k *KafkaConsumer) Stop() error {
+	if k.group != nil {
+		if k.removeHook != nil {
+			// a consumer started in its place adds its own
+			k.removeHook()
+		}
+		if k.groupCancel != nil {
+			// the session ends once every claim has finished its messages
+			k.groupCancel()
+			k.running.Wait()
+		}
+		if err := k.group.Close(); err != nil {
+			k.client.Close()
+			return err
+		}
+		return k.client.Close()
+	}
+
 	close(k.shutdown)
+	k.running.Wait()
 	if err := k.consumer.Close(); err != nil {
+		k.client.Close()
 		return err
 	}
-	return nil
+	return k.client.Close()
+}
+
+// CaughtUp reports whether every partition being consumed has caught up with
+// what was in it when consuming started.
+func (k *KafkaConsumer) CaughtUp() bool {
+	if k.groupHandler != nil {
+		return k.groupHandler.caughtUp()
+	}
+
+	if len(k.partitions) == 0 {
+		return false
+	}
+	for _, p := range k.partitions {
+		if !p.CaughtUp() {
+			return false
+		}
+	}
+	return true
 }
 
 func (k *KafkaConsumer) Name() string {
-	return "kafka"
+	return k.name
 }
 
-func readMetric(pc sarama.PartitionConsumer, db *database.Database) {
+func consume(name string, pc sarama.PartitionConsumer, db *database.Database, msgType string, stats *util.PartitionStats) {
 	for kafkaMsg := range pc.Messages() {
-		var msg *m.KeyMetric
-		if err := json.Unmarshal(kafkaMsg.Value, &msg); err != nil {
-			log.Println("ermg decoding problem :( ", err)
-			continue
-		}
-		db.InsertMetrics(msg)
+		apply(name, db, msgType, kafkaMsg, stats, pc.HighWaterMarkOffset())
 	}
 }
 
-func readTag(pc sarama.PartitionConsumer, db *database.Database) {
-	for kafkaMsg := range pc.Messages() {
-		var msg *m.KeyTag
-		if err := json.Unmarshal(kafkaMsg.Value, &msg); err != nil {
-			log.Println("ermg decoding problem :( ", err)
-			continue
-		}
-		db.InsertTags(msg)
+func consumeErrors(pc sarama.PartitionConsumer, stats *util.PartitionStats) {
+	for err := range pc.Errors() {
+		stats.ConsumeErrors.Add(1)
+		log.Printf("kafka consumer: error consuming %s/%d: %s", err.Topic, err.Partition, err.Err)
 	}
 }
 
-func readCustom(pc sarama.PartitionConsumer, db *database.Database) {
-	for kafkaMsg := range pc.Messages() {
-		var msg *m.TagMetric
-		if err := json.Unmarshal(kafkaMsg.Value, &msg); err != nil {
-			log.Println("ermg decoding problem :( ", err)
-			continue
+// apply inserts a message into the database, and records how that went
+func apply(name string, db *database.Database, msgType string, kafkaMsg *sarama.ConsumerMessage, stats *util.PartitionStats, highWaterMark int64) {
+	err := db.ApplyFrom(name, msgType, kafkaMsg.Value)
+	if err != nil {
+		if _, ok := err.(*database.DecodeError); ok {
+			stats.DecodeErrors.Add(1)
+		} else {
+			stats.InsertErrors.Add(1)
 		}
-		db.InsertCustom(msg)
+		log.Printf("ermg problem applying %s message from %s/%d at offset %d :( %s", msgType, kafkaMsg.Topic, kafkaMsg.Partition, kafkaMsg.Offset, err)
+	}
+	stats.Consumed(kafkaMsg.Offset, highWaterMark)
+}
+
+// startPartition records where consuming a partition starts from, and finds
+// its current high-water mark, which is where it's caught up
+func startPartition(client sarama.Client, stats *util.PartitionStats, offset int64) {
+	highWaterMark, err := client.GetOffset(stats.Topic, stats.Partition, sarama.OffsetNewest)
+	if err != nil {
+		// rather than never being caught up
+		log.Printf("kafka consumer: could not find the high-water mark of %s/%d, so it counts as caught up: %s", stats.Topic, stats.Partition, err)
+		highWaterMark = offset
 	}
+	stats.Start(offset, highWaterMark)
 }
@@ -1,8 +1,313 @@
 package kafka
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
 	c "github.com/kanatohodets/carbonsearch/consumer"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/util"
+
+	"github.com/Shopify/sarama"
 )
 
 // make sure that it implements the Consumer interface
 var _ c.Consumer = &KafkaConsumer{}
+
+const (
+	testTopic = "carbonsearch_metrics"
+	testGroup = "carbonsearch-test"
+	// a separate topic for consuming without a group, so the stats don't mix
+	partitionTopic = "carbonsearch_partitioned"
+)
+
+var stats = util.InitStats()
+
+// groupBroker is a mock broker which is the coordinator for testGroup and the
+// leader of the only partition of testTopic, with a metric message at each
+// offset up to messages. The group has already committed offset committed, or
+// nothing if it's -1.
+func groupBroker(t *testing.T, messages int64, committed int64) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+
+	fetch := sarama.NewMockFetchResponse(t, 1).SetVersion(3)
+	for offset := int64(0); offset < messages; offset++ {
+		msg := fmt.Sprintf(`{"key": "fqdn", "value": "hostname-%d", "metrics": ["server.hostname-%d.cpu"]}`, offset, offset)
+		fetch.SetMessage(testTopic, 0, offset, sarama.StringEncoder(msg))
+	}
+	fetch.SetHighWaterMark(testTopic, 0, messages)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(testTopic, 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, testGroup, broker),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGenerationId(1).
+			SetGroupProtocol(sarama.BalanceStrategyRange.Name()).
+			SetMemberId("member-1").
+			SetLeaderId("member-1").
+			SetMember("member-1", &sarama.ConsumerGroupMemberMetadata{Topics: []string{testTopic}}),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).
+			SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{
+				Topics: map[string][]int32{testTopic: {0}},
+			}),
+		"HeartbeatRequest": sarama.NewMockHeartbeatResponse(t),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset(testGroup, testTopic, 0, committed, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset(testTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(testTopic, 0, sarama.OffsetNewest, messages),
+		"FetchRequest":        fetch,
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+	})
+	return broker
+}
+
+// waitForMetric waits for a metric to show up in the database, and reports
+// whether it did
+func waitForMetric(db *database.Database, metric string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		result, err := db.TagsForMetric(metric)
+		if err == nil && len(result.Split["fqdn"]) > 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// committedOffset finds the last offset the broker was asked to commit, or -1
+func committedOffset(broker *sarama.MockBroker) int64 {
+	committed := int64(-1)
+	for _, rr := range broker.History() {
+		req, ok := rr.Request.(*sarama.OffsetCommitRequest)
+		if !ok {
+			continue
+		}
+		offset, _, err := req.Offset(testTopic, 0)
+		if err == nil {
+			committed = offset
+		}
+	}
+	return committed
+}
+
+func testConsumerGroup(t *testing.T, fromSnapshot bool) {
+	dir, err := ioutil.TempDir("", "carbonsearch-kafka-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := filepath.Join(dir, "snapshot")
+
+	db := database.New(100, stats)
+	if fromSnapshot {
+		err = db.WriteSnapshot(snapshotPath)
+		if err == nil {
+			err = db.LoadSnapshot(snapshotPath)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker := groupBroker(t, 3, 1)
+	defer broker.Close()
+
+	k, err := newConsumer("kafka", &KafkaConfig{
+		Offset:       "oldest",
+		BrokerList:   []string{broker.Addr()},
+		TopicMapping: map[string]string{testTopic: "metric"},
+		GroupID:      testGroup,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	err = k.Start(wg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitForMetric(db, "server.hostname-2.cpu") {
+		t.Fatalf("kafka test: the last message was never consumed")
+	}
+
+	// the committed offset only counts if the database has what came before it
+	_, err = db.TagsForMetric("server.hostname-0.cpu")
+	if fromSnapshot && err == nil {
+		t.Errorf("kafka test: the message before the committed offset should have been skipped")
+	}
+	if !fromSnapshot && err != nil {
+		t.Errorf("kafka test: without a snapshot, the topic should be read from the start: %s", err)
+	}
+
+	if !k.CaughtUp() {
+		t.Errorf("kafka test: not caught up after consuming up to the high-water mark")
+	}
+	partition := stats.KafkaPartition("kafka", testTopic, 0)
+	if partition.Lag() != 0 || partition.Offset.Value() != 3 {
+		t.Errorf("kafka test: expected offset 3 with no lag, but got offset %d with lag %d", partition.Offset.Value(), partition.Lag())
+	}
+
+	if committed := committedOffset(broker); committed != -1 {
+		t.Errorf("kafka test: nothing should be committed before a snapshot is written, but %d was", committed)
+	}
+
+	err = db.WriteSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if committed := committedOffset(broker); committed != 3 {
+		t.Errorf("kafka test: expected writing a snapshot to commit offset 3, but got %d", committed)
+	}
+
+	err = k.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+func TestConsumerGroup(t *testing.T) {
+	testConsumerGroup(t, true)
+}
+
+func TestConsumerGroupWithoutSnapshot(t *testing.T) {
+	testConsumerGroup(t, false)
+}
+
+// a group starting from the configured offset, with nothing to consume, is
+// caught up straight away
+func testGroupCaughtUp(t *testing.T, name string, offset string, messages int64) {
+	broker := groupBroker(t, messages, -1)
+	defer broker.Close()
+
+	db := database.New(100, stats)
+	k, err := newConsumer(name, &KafkaConfig{
+		Offset:       offset,
+		BrokerList:   []string{broker.Addr()},
+		TopicMapping: map[string]string{testTopic: "metric"},
+		GroupID:      testGroup,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	err = k.Start(wg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !k.CaughtUp() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !k.CaughtUp() {
+		t.Errorf("kafka test: %s: never caught up", name)
+	}
+
+	partition := stats.KafkaPartition(name, testTopic, 0)
+	if partition.Offset.Value() != messages {
+		t.Errorf("kafka test: %s: expected to start from offset %d, but got %d", name, messages, partition.Offset.Value())
+	}
+
+	err = k.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+func TestConsumerGroupEmptyPartition(t *testing.T) {
+	testGroupCaughtUp(t, "kafka-empty", "oldest", 0)
+}
+
+func TestConsumerGroupFromNewest(t *testing.T) {
+	testGroupCaughtUp(t, "kafka-newest", "newest", 3)
+}
+
+func TestConsumePartitions(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	fetch := sarama.NewMockFetchResponse(t, 1).SetVersion(4)
+	fetch.SetMessage(partitionTopic, 0, 0, sarama.StringEncoder(`{"key": "fqdn", "value": "hostname-1", "metrics": ["server.hostname-1.cpu"]}`))
+	fetch.SetMessage(partitionTopic, 0, 1, sarama.StringEncoder(`{"key": "fqdn", "value": `))
+	fetch.SetMessage(partitionTopic, 0, 2, sarama.StringEncoder(`{"key": "fqdn", "value": "hostname-2", "metrics": ["server.hostname-2.cpu"], "mode": "sideways"}`))
+	fetch.SetMessage(partitionTopic, 0, 3, sarama.StringEncoder(`{"key": "fqdn", "value": "hostname-3", "metrics": ["server.hostname-3.cpu"]}`))
+	fetch.SetHighWaterMark(partitionTopic, 0, 4)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(partitionTopic, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset(partitionTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(partitionTopic, 0, sarama.OffsetNewest, 4),
+		"FetchRequest": fetch,
+	})
+
+	k, err := newConsumer("kafka", &KafkaConfig{
+		Offset:       "oldest",
+		BrokerList:   []string{broker.Addr()},
+		TopicMapping: map[string]string{partitionTopic: "metric"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stats are shared by every run of the test
+	partition := stats.KafkaPartition("kafka", partitionTopic, 0)
+	messages := partition.Messages.Value()
+	decodeErrors := partition.DecodeErrors.Value()
+	insertErrors := partition.InsertErrors.Value()
+
+	db := database.New(100, stats)
+	wg := &sync.WaitGroup{}
+	err = k.Start(wg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitForMetric(db, "server.hostname-3.cpu") {
+		t.Fatalf("kafka test: the last message was never consumed")
+	}
+
+	if !k.CaughtUp() {
+		t.Errorf("kafka test: not caught up after consuming up to the high-water mark")
+	}
+
+	if n := partition.Messages.Value() - messages; n != 4 {
+		t.Errorf("kafka test: expected 4 messages, but got %d", n)
+	}
+	if n := partition.DecodeErrors.Value() - decodeErrors; n != 1 {
+		t.Errorf("kafka test: expected 1 decode error, but got %d", n)
+	}
+	if n := partition.InsertErrors.Value() - insertErrors; n != 1 {
+		t.Errorf("kafka test: expected 1 insert error, but got %d", n)
+	}
+	if partition.Lag() != 0 {
+		t.Errorf("kafka test: expected no lag, but got %d", partition.Lag())
+	}
+
+	err = k.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
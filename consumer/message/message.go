@@ -1,18 +1,65 @@
 package message
 
+// names for each type of message, as used in kafka topic mappings and the
+// write-ahead log
+const (
+	MetricType = "metric"
+	TagType    = "tag"
+	CustomType = "custom"
+
+	MetricDeleteType = "metric-delete"
+	TagDeleteType    = "tag-delete"
+	CustomDeleteType = "custom-delete"
+)
+
+// how a KeyMetric or KeyTag message is applied to the join key value
+const (
+	// AddMode adds the message's metrics/tags to the ones already there. An
+	// empty Mode means AddMode.
+	AddMode = "add"
+	// ReplaceMode makes the message's metrics/tags the complete set for the
+	// join key value: any which aren't in the message are removed.
+	ReplaceMode = "replace"
+)
+
 type KeyMetric struct {
 	Key     string
 	Value   string
 	Metrics []string
+	Mode    string `json:",omitempty"`
 }
 
 type KeyTag struct {
 	Key   string
 	Value string
 	Tags  []string
+	Mode  string `json:",omitempty"`
 }
 
 type TagMetric struct {
 	Tags    []string
 	Metrics []string
 }
+
+// DeleteKeyMetric undoes KeyMetric. If Metrics is empty, every metric
+// associated with the join key value is removed.
+type DeleteKeyMetric struct {
+	Key     string
+	Value   string
+	Metrics []string
+}
+
+// DeleteKeyTag undoes KeyTag. If Tags is empty, every tag associated with the
+// join key value is removed.
+type DeleteKeyTag struct {
+	Key   string
+	Value string
+	Tags  []string
+}
+
+// DeleteTagMetric undoes TagMetric. If Metrics is empty, the tags are removed
+// entirely.
+type DeleteTagMetric struct {
+	Tags    []string
+	Metrics []string
+}
@@ -0,0 +1,76 @@
+package consumer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+// A Factory creates a consumer called name from the config file at configPath.
+type Factory func(name string, configPath string) (Consumer, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]Factory)
+)
+
+// Register makes a type of consumer available to New. It's meant to be called
+// from the init function of the package implementing the consumer, and panics
+// if the type is registered twice.
+func Register(consumerType string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("consumer: Register factory is nil for type " + consumerType)
+	}
+	if _, dup := registry[consumerType]; dup {
+		panic("consumer: Register called twice for type " + consumerType)
+	}
+	registry[consumerType] = factory
+}
+
+// Types lists the registered types of consumer.
+func Types() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	types := make([]string, 0, len(registry))
+	for consumerType := range registry {
+		types = append(types, consumerType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New creates the consumer called name, from the config file at configPath.
+// The type of consumer is the 'type' field of the config file, or if there
+// isn't one, the name: so 'kafka: kafka.yaml' is a kafka consumer, and
+// several kafka consumers can run side by side as 'kafka-dc1' and
+// 'kafka-dc2' with 'type: kafka' in their config files.
+func New(name string, configPath string) (Consumer, error) {
+	config := &struct {
+		Type string `yaml:"type"`
+	}{}
+	err := util.ReadConfig(configPath, config)
+	if err != nil {
+		return nil, err
+	}
+
+	consumerType := config.Type
+	if consumerType == "" {
+		consumerType = name
+	}
+
+	registryMutex.RLock()
+	factory, ok := registry[consumerType]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("consumer: %q has type %q, but the known types are: %s. set 'type' in %q", name, consumerType, strings.Join(Types(), ", "), configPath)
+	}
+
+	return factory(name, configPath)
+}
@@ -0,0 +1,74 @@
+package consumer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kanatohodets/carbonsearch/database"
+)
+
+type testConsumer struct {
+	name string
+}
+
+func (c *testConsumer) Name() string                                    { return c.name }
+func (c *testConsumer) Start(*sync.WaitGroup, *database.Database) error { return nil }
+func (c *testConsumer) Stop() error                                     { return nil }
+func (c *testConsumer) CaughtUp() bool                                  { return true }
+
+func TestRegistry(t *testing.T) {
+	Register("test", func(name string, configPath string) (Consumer, error) {
+		return &testConsumer{name: name}, nil
+	})
+
+	dir, err := ioutil.TempDir("", "carbonsearch-consumer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(file string, contents string) string {
+		path := filepath.Join(dir, file)
+		err := ioutil.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	typed := write("typed.yaml", "type: test\n")
+	untyped := write("untyped.yaml", "port: 8100\n")
+
+	for _, name := range []string{"test-dc1", "test-dc2"} {
+		c, err := New(name, typed)
+		if err != nil {
+			t.Fatalf("registry test: could not create %s: %s", name, err)
+		}
+		if c.Name() != name {
+			t.Errorf("registry test: expected a consumer called %q, but got %q", name, c.Name())
+		}
+	}
+
+	// without a type, the name is the type
+	_, err = New("test", untyped)
+	if err != nil {
+		t.Errorf("registry test: the name should be used as the type when there isn't one: %s", err)
+	}
+
+	_, err = New("test-dc1", untyped)
+	if err == nil || !strings.Contains(err.Error(), `"test-dc1"`) {
+		t.Errorf("registry test: expected an error about the unknown type, but got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registry test: registering a type twice should panic")
+		}
+	}()
+	Register("test", func(name string, configPath string) (Consumer, error) {
+		return nil, nil
+	})
+}
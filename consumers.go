@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kanatohodets/carbonsearch/consumer"
+	// each consumer package registers its type with the consumer package
+	_ "github.com/kanatohodets/carbonsearch/consumer/carbon"
+	_ "github.com/kanatohodets/carbonsearch/consumer/file"
+	_ "github.com/kanatohodets/carbonsearch/consumer/httpapi"
+	_ "github.com/kanatohodets/carbonsearch/consumer/kafka"
+)
+
+type runningConsumer struct {
+	consumer consumer.Consumer
+	path     string
+	// the contents of the config file when the consumer was started, to
+	// tell whether it has changed since
+	config []byte
+}
+
+// consumerSet keeps track of the running consumers, so that they can be
+// started and stopped as the config changes.
+type consumerSet struct {
+	wg *sync.WaitGroup
+
+	mutex   sync.Mutex
+	running map[string]*runningConsumer
+	// set by StopAll, so that a reload during shutdown can't start anything
+	closed bool
+}
+
+func newConsumerSet(wg *sync.WaitGroup) *consumerSet {
+	return &consumerSet{
+		wg:      wg,
+		running: make(map[string]*runningConsumer),
+	}
+}
+
+// List returns the running consumers.
+func (s *consumerSet) List() []consumer.Consumer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	consumers := make([]consumer.Consumer, 0, len(s.running))
+	for _, r := range s.running {
+		consumers = append(consumers, r.consumer)
+	}
+	return consumers
+}
+
+// Sync starts or stops consumers so that the running ones match configured,
+// a map of consumer name to config file path. A consumer whose config file
+// path or contents have changed is restarted. The index is left alone: a
+// stopped consumer's messages stay in it. A consumer which fails to stop or
+// start doesn't hold up the others; the error says which ones are left
+// stopped.
+func (s *consumerSet) Sync(configured map[string]string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("the consumers have been stopped for shutdown")
+	}
+
+	failures := []string{}
+
+	// stop first, in case a new consumer needs something an old one has (like a port)
+	for _, name := range s.runningNames() {
+		r := s.running[name]
+		path, ok := configured[name]
+		if ok && path == r.path && !configChanged(r) {
+			continue
+		}
+
+		log.Printf("stopping %s consumer", name)
+		err := s.stop(name)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	names := make([]string, 0, len(configured))
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := s.running[name]; ok {
+			continue
+		}
+
+		log.Printf("starting %s consumer with %q", name, configured[name])
+		err := s.start(name, configured[name])
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	stopped := []string{}
+	for _, name := range names {
+		if _, ok := s.running[name]; !ok {
+			stopped = append(stopped, name)
+		}
+	}
+	return fmt.Errorf("%s; these consumers are left stopped: %s", strings.Join(failures, "; "), strings.Join(stopped, ", "))
+}
+
+// StopAll stops every consumer, logging any failures. From then on, Sync
+// doesn't start any.
+func (s *consumerSet) StopAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+
+	for _, name := range s.runningNames() {
+		err := s.stop(name)
+		if err != nil {
+			log.Printf("Failed to close consumer %s: %s", name, err)
+		}
+	}
+}
+
+func (s *consumerSet) start(name string, path string) error {
+	config, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config for %s consumer: %s", name, err)
+	}
+
+	c, err := consumer.New(name, path)
+	if err != nil {
+		return fmt.Errorf("could not create new %s consumer: %s", name, err)
+	}
+
+	err = c.Start(s.wg, db)
+	if err != nil {
+		stopErr := c.Stop()
+		if stopErr != nil {
+			log.Printf("could not stop %s consumer after it failed to start: %s", name, stopErr)
+		}
+		return fmt.Errorf("could not start %s consumer: %s", name, err)
+	}
+
+	s.running[name] = &runningConsumer{consumer: c, path: path, config: config}
+	return nil
+}
+
+func (s *consumerSet) stop(name string) error {
+	r := s.running[name]
+	// forgotten even if it fails, since it can't be trusted to be running
+	delete(s.running, name)
+
+	err := r.consumer.Stop()
+	if err != nil {
+		return fmt.Errorf("could not stop %s consumer: %s", name, err)
+	}
+	return nil
+}
+
+func configChanged(r *runningConsumer) bool {
+	config, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		// it'll fail to restart, which says why
+		return true
+	}
+	return !bytes.Equal(config, r.config)
+}
+
+// runningNames returns the names of the running consumers, sorted so they're
+// stopped in a predictable order
+func (s *consumerSet) runningNames() []string {
+	names := make([]string, 0, len(s.running))
+	for name := range s.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
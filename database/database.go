@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/database/deadletter"
+	"github.com/kanatohodets/carbonsearch/database/wal"
 	"github.com/kanatohodets/carbonsearch/index"
 	"github.com/kanatohodets/carbonsearch/index/full"
 	"github.com/kanatohodets/carbonsearch/index/split"
@@ -15,11 +19,19 @@ import (
 )
 
 type Database struct {
-	stats             *util.Stats
+	stats *util.Stats
+
+	// inserts hold this for reading, so they can run concurrently with each
+	// other. anything that needs a consistent view of all of the indexes at
+	// once (like taking a snapshot) holds it for writing.
+	writeMutex sync.RWMutex
+
 	serviceToIndex    map[string]index.Index
 	serviceIndexMutex sync.RWMutex
 
-	queryLimit int
+	// the most metrics a query can return. it can change at any time, so
+	// it's accessed atomically: see SetQueryLimit
+	queryLimit int64
 
 	splitIndexes map[string]*split.Index
 	splitMutex   sync.RWMutex
@@ -29,6 +41,21 @@ type Database struct {
 
 	FullIndex *full.Index
 	TextIndex *text.Index
+
+	wal *wal.Log
+	// held from applying a message until it has been logged, so that the
+	// write-ahead log has messages in the order they were applied, and from
+	// rotating the log until a snapshot has been taken
+	logMutex sync.Mutex
+
+	deadLetters *deadletter.Queue
+
+	// only one snapshot is written at a time, so they land in order
+	snapshotMutex sync.Mutex
+	// set once LoadSnapshot has succeeded
+	loadedSnapshot bool
+	snapshotHooks  []*SnapshotHook
+	hookMutex      sync.Mutex
 }
 
 func (db *Database) GetOrCreateSplitIndex(join string) (*split.Index, error) {
@@ -95,6 +122,28 @@ func (db *Database) GetSplitIndex(join string) *split.Index {
 */
 
 func (db *Database) Query(tagsByService map[string][]string) ([]string, error) {
+	metrics, err := db.queryMetrics(tagsByService)
+	if err != nil {
+		return nil, err
+	}
+	return db.results(metrics)
+}
+
+// queryMetrics is Query, minus mapping the result back to metric names
+func (db *Database) queryMetrics(tagsByService map[string][]string) ([]index.Metric, error) {
+	return db.runQuery(tagsByService, nil)
+}
+
+// runQuery does the work for queryMetrics. If ex isn't nil, each step is
+// recorded in it as the query runs.
+func (db *Database) runQuery(tagsByService map[string][]string, ex *Explanation) ([]index.Metric, error) {
+	// text filters don't select metrics from an index: they're applied to the
+	// result at the end
+	tagsByService, filters, err := takeFilters(tagsByService)
+	if err != nil {
+		return nil, err
+	}
+
 	queriesByIndex := map[index.Index]*index.Query{}
 
 	db.serviceIndexMutex.RLock()
@@ -103,6 +152,7 @@ func (db *Database) Query(tagsByService map[string][]string) ([]string, error) {
 		if !ok {
 			log.Printf("warning: there's no index for service %q. as a result, these tags will be ignored: %v", service, tags)
 			log.Println("this means that no tags have been added to the database with this service; the producer has not started yet")
+			ex.ignore(tags, fmt.Sprintf("there's no index for service %q: no tags have been added to the database with this service", service))
 			continue
 		}
 		q, ok := queriesByIndex[mappedIndex]
@@ -116,26 +166,63 @@ func (db *Database) Query(tagsByService map[string][]string) ([]string, error) {
 
 	// query indexes, take intersection of metrics
 	metricSets := [][]index.Metric{}
+	excluded := [][]index.Metric{}
 	for targetIndex, query := range queriesByIndex {
+		start := time.Now()
+		if len(query.Hashed) == 0 {
+			// only negated tags: this index has nothing to subtract them from,
+			// so subtract them from the intersection of the other indexes instead
+			for _, negated := range query.NegatedRaw {
+				metrics, err := targetIndex.Query(index.NewQuery([]string{negated}))
+				if err != nil {
+					return nil, fmt.Errorf("database: error while querying index %s: %s", targetIndex.Name(), err)
+				}
+				excluded = append(excluded, metrics)
+			}
+			ex.index(targetIndex, query, nil, time.Since(start))
+			continue
+		}
+
 		metrics, err := targetIndex.Query(query)
 		if err != nil {
 			return nil, fmt.Errorf("database: error while querying index %s: %s", targetIndex.Name(), err)
 		}
+		ex.index(targetIndex, query, metrics, time.Since(start))
 
 		metricSets = append(metricSets, metrics)
 	}
 
+	selected := len(metricSets) > 0
 	metrics := index.IntersectMetrics(metricSets)
+	ex.intersect()
+	if len(filters) > 0 {
+		metrics, err = db.filterMetrics(metrics, selected, filters)
+		if err != nil {
+			return nil, err
+		}
+		selected = true
+		ex.filter(filters, metrics)
+	}
 
-	stringMetrics, err := db.unmapMetrics(metrics)
-	// TODO(btyler): try to figure out how to annotate this error with better
-	// information, since just seeing a random int64 will not be very handy
-	if err != nil {
-		return nil, err
+	if !selected && len(excluded) > 0 {
+		return nil, fmt.Errorf("database: the query only has negated tags, so it would match everything else. add a tag to select metrics from")
 	}
 
-	if len(stringMetrics) > db.queryLimit {
-		return nil, fmt.Errorf("database: query selected %d metrics, which is over the limit of %d results in a single query", len(stringMetrics), db.queryLimit)
+	if len(excluded) > 0 {
+		metrics = index.DifferenceMetrics(metrics, unionMetrics(excluded))
+		ex.step("subtract the metrics selected by negated tags in indexes with no other tags", metrics)
+	}
+	return metrics, nil
+}
+
+// results maps the metrics matched by a query back to their names, enforcing
+// the query limit
+func (db *Database) results(metrics []index.Metric) ([]string, error) {
+	stringMetrics := db.unmapMetrics(metrics)
+
+	limit := db.loadQueryLimit()
+	if len(stringMetrics) > limit {
+		return nil, fmt.Errorf("database: query selected %d metrics, which is over the limit of %d results in a single query", len(stringMetrics), limit)
 	}
 
 	return stringMetrics, nil
@@ -143,6 +230,20 @@ func (db *Database) Query(tagsByService map[string][]string) ([]string, error) {
 
 //TODO(btyler) -- do we want to auto-create indexes?
 func (db *Database) InsertMetrics(msg *m.KeyMetric) error {
+	replace, err := replaceMode(msg.Mode)
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		// replacing can forget metric names, like a delete
+		db.writeMutex.Lock()
+		defer db.writeMutex.Unlock()
+	} else {
+		db.writeMutex.RLock()
+		defer db.writeMutex.RUnlock()
+	}
+
 	si, err := db.GetOrCreateSplitIndex(msg.Key)
 	if err != nil {
 		return fmt.Errorf("database: could not/get create index for %s: %s", msg.Key, err)
@@ -151,11 +252,21 @@ func (db *Database) InsertMetrics(msg *m.KeyMetric) error {
 	db.stats.MetricMessages.Add(1)
 
 	metricHashes := db.mapMetrics(msg.Metrics)
-	err = si.AddMetrics(msg.Value, metricHashes)
+	var orphans []index.Metric
+	if replace {
+		orphans, err = si.SetMetrics(msg.Value, metricHashes)
+	} else {
+		err = si.AddMetrics(msg.Value, metricHashes)
+	}
 	if err != nil {
 		return fmt.Errorf("database: could not add metrics to metric side of index %q: %s", msg.Key, err)
 	}
 
+	err = db.forgetMetrics(orphans)
+	if err != nil {
+		return err
+	}
+
 	err = db.TextIndex.AddMetrics(msg.Metrics, metricHashes)
 	if err != nil {
 		return fmt.Errorf("database: could not add metrics to text index: %s", err)
@@ -168,6 +279,14 @@ func (db *Database) InsertMetrics(msg *m.KeyMetric) error {
 }
 
 func (db *Database) InsertTags(msg *m.KeyTag) error {
+	replace, err := replaceMode(msg.Mode)
+	if err != nil {
+		return err
+	}
+
+	db.writeMutex.RLock()
+	defer db.writeMutex.RUnlock()
+
 	si, err := db.GetOrCreateSplitIndex(msg.Key)
 	if err != nil {
 		return fmt.Errorf("database: could not get/create index for %q: %s", msg.Key, err)
@@ -175,12 +294,18 @@ func (db *Database) InsertTags(msg *m.KeyTag) error {
 
 	db.stats.TagMessages.Add(1)
 
-	tags := index.HashTags(db.validateServiceIndexPairs(msg.Tags, si))
+	validTags := db.validateServiceIndexPairs(msg.Tags, si)
+	tags := index.HashTags(validTags)
 
-	err = si.AddTags(msg.Value, tags)
+	if replace {
+		err = si.SetTags(msg.Value, tags)
+	} else {
+		err = si.AddTags(msg.Value, tags)
+	}
 	if err != nil {
 		return fmt.Errorf("database: could not add tags to tag side of index %q: %s", msg.Key, err)
 	}
+	si.NameTags(validTags)
 
 	db.stats.TagsIndexed.Add(int64(len(tags)))
 	db.stats.SplitIndexes.Set(fmt.Sprintf("%s-tags", si.Name()), util.ExpInt(si.TagSize()))
@@ -188,8 +313,24 @@ func (db *Database) InsertTags(msg *m.KeyTag) error {
 	return nil
 }
 
+// replaceMode reports whether a message's mode asks for replace semantics
+func replaceMode(mode string) (bool, error) {
+	switch mode {
+	case "", m.AddMode:
+		return false, nil
+	case m.ReplaceMode:
+		return true, nil
+	default:
+		return false, fmt.Errorf("database: %q is not a known mode: known modes are %q and %q", mode, m.AddMode, m.ReplaceMode)
+	}
+}
+
 func (db *Database) InsertCustom(msg *m.TagMetric) error {
-	tags := index.HashTags(db.validateServiceIndexPairs(msg.Tags, db.FullIndex))
+	db.writeMutex.RLock()
+	defer db.writeMutex.RUnlock()
+
+	validTags := db.validateServiceIndexPairs(msg.Tags, db.FullIndex)
+	tags := index.HashTags(validTags)
 
 	db.stats.CustomMessages.Add(1)
 
@@ -198,6 +339,7 @@ func (db *Database) InsertCustom(msg *m.TagMetric) error {
 	if err != nil {
 		return fmt.Errorf("database: error while adding to custom index: %s", err)
 	}
+	db.FullIndex.NameTags(validTags)
 
 	err = db.TextIndex.AddMetrics(msg.Metrics, metricHashes)
 	if err != nil {
@@ -210,6 +352,151 @@ func (db *Database) InsertCustom(msg *m.TagMetric) error {
 	return nil
 }
 
+// DeleteMetrics removes metrics from a join key value. If the message has no
+// metrics, all of the join key value's metrics are removed. Deleting from a
+// join key that has no index is not an error: there's nothing to delete.
+func (db *Database) DeleteMetrics(msg *m.DeleteKeyMetric) error {
+	// deletes can forget metric names entirely, which must not race with an
+	// insert that is about to use them
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	db.stats.DeleteMessages.Add(1)
+
+	si := db.GetSplitIndex(msg.Key)
+	if si == nil {
+		return nil
+	}
+
+	var orphans []index.Metric
+	if len(msg.Metrics) == 0 {
+		orphans = si.RemoveAllMetrics(msg.Value)
+	} else {
+		var err error
+		orphans, err = si.RemoveMetrics(msg.Value, index.HashMetrics(msg.Metrics))
+		if err != nil {
+			return fmt.Errorf("database: could not remove metrics from metric side of index %q: %s", msg.Key, err)
+		}
+	}
+
+	db.stats.SplitIndexes.Set(fmt.Sprintf("%s-metrics", si.Name()), util.ExpInt(si.MetricSize()))
+
+	return db.forgetMetrics(orphans)
+}
+
+// DeleteTags removes tags from a join key value. If the message has no tags,
+// all of the join key value's tags are removed.
+func (db *Database) DeleteTags(msg *m.DeleteKeyTag) error {
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	db.stats.DeleteMessages.Add(1)
+
+	si := db.GetSplitIndex(msg.Key)
+	if si == nil {
+		return nil
+	}
+
+	if len(msg.Tags) == 0 {
+		si.RemoveAllTags(msg.Value)
+	} else {
+		err := si.RemoveTags(msg.Value, index.HashTags(msg.Tags))
+		if err != nil {
+			return fmt.Errorf("database: could not remove tags from tag side of index %q: %s", msg.Key, err)
+		}
+	}
+
+	db.stats.SplitIndexes.Set(fmt.Sprintf("%s-tags", si.Name()), util.ExpInt(si.TagSize()))
+
+	return nil
+}
+
+// DeleteCustom removes metrics from custom tags. If the message has no
+// metrics, the tags are removed entirely.
+func (db *Database) DeleteCustom(msg *m.DeleteTagMetric) error {
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	db.stats.DeleteMessages.Add(1)
+
+	tags := index.HashTags(msg.Tags)
+
+	var orphans []index.Metric
+	var err error
+	if len(msg.Metrics) == 0 {
+		orphans, err = db.FullIndex.RemoveTags(tags)
+	} else {
+		orphans, err = db.FullIndex.Remove(tags, index.HashMetrics(msg.Metrics))
+	}
+	if err != nil {
+		return fmt.Errorf("database: error while removing from custom index: %s", err)
+	}
+
+	db.stats.FullIndexTags.Set(int64(db.FullIndex.TagSize()))
+	db.stats.FullIndexMetrics.Set(int64(db.FullIndex.MetricSize()))
+
+	return db.forgetMetrics(orphans)
+}
+
+// forgetMetrics takes metrics which were just removed from one index, and
+// drops the ones which aren't in any other index from the text index and the
+// metric name map. The caller must hold the write lock.
+func (db *Database) forgetMetrics(candidates []index.Metric) error {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	db.splitMutex.RLock()
+	splitIndexes := make([]*split.Index, 0, len(db.splitIndexes))
+	for _, si := range db.splitIndexes {
+		splitIndexes = append(splitIndexes, si)
+	}
+	db.splitMutex.RUnlock()
+
+	db.metricsMutex.Lock()
+	defer db.metricsMutex.Unlock()
+
+	names := []string{}
+	hashes := []index.Metric{}
+	for _, metric := range candidates {
+		if db.FullIndex.HasMetric(metric) {
+			continue
+		}
+
+		inUse := false
+		for _, si := range splitIndexes {
+			if si.HasMetric(metric) {
+				inUse = true
+				break
+			}
+		}
+		if inUse {
+			continue
+		}
+
+		name, ok := db.metrics[metric]
+		if !ok {
+			continue
+		}
+
+		names = append(names, name)
+		hashes = append(hashes, metric)
+		delete(db.metrics, metric)
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	db.stats.MetricsForgotten.Add(int64(len(names)))
+
+	err := db.TextIndex.RemoveMetrics(names, hashes)
+	if err != nil {
+		return fmt.Errorf("database: could not remove metrics from text index: %s", err)
+	}
+	return nil
+}
+
 // ensure that tags are only added to one index -- the one that owns the tag's
 // service, where 'server-state:live' has a service 'server'.
 // NOTE(btyler): we're being permissive here and only skipping adding tags with
@@ -261,21 +548,34 @@ func (db *Database) mapMetrics(metrics []string) []index.Metric {
 	return hashed
 }
 
-func (db *Database) unmapMetrics(metrics []index.Metric) ([]string, error) {
+// metricName looks up the name of a single metric
+func (db *Database) metricName(metric index.Metric) (string, bool) {
 	db.metricsMutex.RLock()
 	defer db.metricsMutex.RUnlock()
 
-	stringMetrics := make([]string, len(metrics))
+	name, ok := db.metrics[metric]
+	return name, ok
+}
 
-	for i, metric := range metrics {
+// unmapMetrics looks up the names of the metrics a query found. Queries don't
+// hold the write lock, so a metric can be deleted (or replaced, or expired)
+// after the indexes return it but before its name is looked up: like the
+// text filters, it's left out, as if the delete had happened first.
+func (db *Database) unmapMetrics(metrics []index.Metric) []string {
+	db.metricsMutex.RLock()
+	defer db.metricsMutex.RUnlock()
+
+	stringMetrics := make([]string, 0, len(metrics))
+
+	for _, metric := range metrics {
 		str, ok := db.metrics[metric]
 		if !ok {
-			return nil, fmt.Errorf("database: the hashed metric '%d' has no mapping back to a string! this is awful!", metric)
+			continue
 		}
-		stringMetrics[i] = str
+		stringMetrics = append(stringMetrics, str)
 	}
 
-	return stringMetrics, nil
+	return stringMetrics
 }
 
 func New(queryLimit int, stats *util.Stats) *Database {
@@ -287,10 +587,10 @@ func New(queryLimit int, stats *util.Stats) *Database {
 	textIndex := text.NewIndex()
 	serviceToIndex["text"] = textIndex
 
-	return &Database{
+	db := &Database{
 		stats:          stats,
 		serviceToIndex: serviceToIndex,
-		queryLimit:     queryLimit,
+		queryLimit:     int64(queryLimit),
 
 		splitIndexes: make(map[string]*split.Index),
 
@@ -299,4 +599,24 @@ func New(queryLimit int, stats *util.Stats) *Database {
 		FullIndex: fullIndex,
 		TextIndex: textIndex,
 	}
+
+	textIndex.SetNameLookup(db.metricName)
+
+	return db
+}
+
+// SetQueryLimit changes the most metrics a query can return, for queries from
+// now on.
+func (db *Database) SetQueryLimit(queryLimit int) {
+	atomic.StoreInt64(&db.queryLimit, int64(queryLimit))
+}
+
+func (db *Database) loadQueryLimit() int {
+	return int(atomic.LoadInt64(&db.queryLimit))
+}
+
+// Stats returns the stats the database reports to, so that consumers can
+// report to them too.
+func (db *Database) Stats() *util.Stats {
+	return db.stats
 }
@@ -1,10 +1,21 @@
 package database
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/database/deadletter"
+	"github.com/kanatohodets/carbonsearch/database/wal"
+	"github.com/kanatohodets/carbonsearch/query"
 	"github.com/kanatohodets/carbonsearch/util"
 )
 
@@ -112,6 +123,532 @@ func TestQuery(t *testing.T) {
 	//TODO(btyler) regex filter, split index query, intersecting between split and full index, multiple split indexes
 }
 
+func TestQueryExpr(t *testing.T) {
+	db := New(10, stats)
+
+	hosts := map[string][]string{
+		"hostname-1": {"lb-pool:www", "server-state:live"},
+		"hostname-2": {"lb-pool:api", "server-state:live"},
+		"hostname-3": {"lb-pool:www", "server-state:maint"},
+		"hostname-4": {"lb-pool:db", "server-state:live"},
+	}
+
+	for host, tags := range hosts {
+		err := db.InsertMetrics(&m.KeyMetric{
+			Key:     "fqdn",
+			Value:   host,
+			Metrics: []string{"server." + host + ".cpu"},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = db.InsertTags(&m.KeyTag{
+			Key:   "fqdn",
+			Value: host,
+			Tags:  tags,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	cases := map[string][]string{
+		"lb-pool:www|lb-pool:api":                       {"server.hostname-1.cpu", "server.hostname-2.cpu", "server.hostname-3.cpu"},
+		"(lb-pool:www|lb-pool:api).!server-state:maint": {"server.hostname-1.cpu", "server.hostname-2.cpu"},
+		"server-state:live&!(lb-pool:www|lb-pool:api)":  {"server.hostname-4.cpu"},
+		"server-state:live.(lb-pool:db|!lb-pool:www)":   {"server.hostname-2.cpu", "server.hostname-4.cpu"},
+		"!!lb-pool:db":             {"server.hostname-4.cpu"},
+		"lb-pool:www.lb-pool:api":  {},
+		"lb-pool:www.nope-foo:bar": {},
+	}
+
+	for raw, expected := range cases {
+		expr, err := query.Parse(raw)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		result, err := db.QueryExpr(expr)
+		if err != nil {
+			t.Errorf("database test: error while querying %q: %s", raw, err)
+			continue
+		}
+
+		sort.Strings(result)
+		if strings.Join(result, ",") != strings.Join(expected, ",") {
+			t.Errorf("database test: expected %q to match %q, but got %q", raw, expected, result)
+		}
+	}
+
+	for _, raw := range []string{"!lb-pool:www", "!lb-pool:www|lb-pool:api"} {
+		expr, err := query.Parse(raw)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		result, err := db.QueryExpr(expr)
+		if err == nil {
+			t.Errorf("database test: %q only excludes metrics, so it should be an error, but it returned %q", raw, result)
+		}
+	}
+}
+
+func TestNegatedQuery(t *testing.T) {
+	db := New(10, stats)
+
+	for host, state := range map[string]string{"hostname-1": "live", "hostname-2": "maint"} {
+		db.InsertMetrics(&m.KeyMetric{
+			Key:     "fqdn",
+			Value:   host,
+			Metrics: []string{"server." + host + ".cpu"},
+		})
+		db.InsertTags(&m.KeyTag{
+			Key:   "fqdn",
+			Value: host,
+			Tags:  []string{"server-state:" + state},
+		})
+	}
+
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.hostname-1.cpu", "server.hostname-2.cpu"},
+	})
+
+	// the negated tag is the only one for its index
+	result, err := db.Query(map[string][]string{
+		"custom": {"custom-favorites:tester"},
+		"server": {"!server-state:maint"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 1 || result[0] != "server.hostname-1.cpu" {
+		t.Errorf("database test: expected only 'server.hostname-1.cpu', but got %q", result)
+	}
+
+	result, err = db.Query(map[string][]string{
+		"server": {"!server-state:maint"},
+	})
+	if err == nil {
+		t.Errorf("database test: a query with only negated tags should be an error, but it returned %q", result)
+	}
+}
+
+func TestTextRegex(t *testing.T) {
+	db := New(10, stats)
+
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.hostname-1234.cpu.i7z", "server.hostname-abcd.cpu.i7z", "monitors.was_the_site_up"},
+	})
+
+	query := map[string][]string{
+		"custom": {"custom-favorites:tester"},
+		"text":   {"text-regex:hostname-[0-9]+"},
+	}
+
+	result, err := db.Query(query)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 1 || result[0] != "server.hostname-1234.cpu.i7z" {
+		t.Errorf("database test: expected only 'server.hostname-1234.cpu.i7z', but got %q", result)
+	}
+
+	// the rebuilt text index has to be able to find metric names too
+	snap, _ := db.snapshot()
+	err = db.restore(snap)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err = db.Query(query)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 1 || result[0] != "server.hostname-1234.cpu.i7z" {
+		t.Errorf("database test: expected only 'server.hostname-1234.cpu.i7z' after restoring, but got %q", result)
+	}
+}
+
+func TestTextFilter(t *testing.T) {
+	db := New(10, stats)
+
+	db.InsertCustom(&m.TagMetric{
+		Tags: []string{"lb-pool:db"},
+		Metrics: []string{
+			"db.replication.DelayMax",
+			"db.replication.DelayAvg",
+			"db.replication.Throughput",
+			"db.queries.slow",
+		},
+	})
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"lb-pool:www"},
+		Metrics: []string{"www.replication.DelayMax"},
+	})
+
+	cases := map[string][]string{
+		"text-filter:Delay":           {"db.replication.DelayAvg", "db.replication.DelayMax"},
+		"text-filter:repl*":           {"db.replication.DelayAvg", "db.replication.DelayMax", "db.replication.Throughput"},
+		"text-filter:/Delay(Max)$/":   {"db.replication.DelayMax"},
+		"!text-filter:replication":    {"db.queries.slow"},
+		"text-filter:Dl":              {},
+		"text-filter:{slow,DelayAvg}": {"db.queries.slow", "db.replication.DelayAvg"},
+	}
+
+	for filter, expected := range cases {
+		result, err := db.Query(map[string][]string{
+			"lb":   {"lb-pool:db"},
+			"text": {filter},
+		})
+		if err != nil {
+			t.Errorf("database test: error while filtering with %q: %s", filter, err)
+			continue
+		}
+
+		sort.Strings(result)
+		if strings.Join(result, ",") != strings.Join(expected, ",") {
+			t.Errorf("database test: expected %q to leave %q, but got %q", filter, expected, result)
+		}
+	}
+
+	// with nothing else to filter, search the text index
+	result, err := db.Query(map[string][]string{"text": {"text-filter:DelayMax"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 2 {
+		t.Errorf("database test: expected a lone text filter to find 2 metrics, but got %q", result)
+	}
+
+	result, err = db.Query(map[string][]string{"text": {"text-filter:Delay*"}})
+	if err == nil {
+		t.Errorf("database test: a lone glob filter can't be searched for, so it should be an error, but got %q", result)
+	}
+
+	expr, err := query.Parse("text-filter:DelayMax&!lb-pool:www")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err = db.QueryExpr(expr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 1 || result[0] != "db.replication.DelayMax" {
+		t.Errorf("database test: expected a v2 text filter to find only 'db.replication.DelayMax', but got %q", result)
+	}
+}
+
+func TestTextFilterManyMetrics(t *testing.T) {
+	db := New(10, stats)
+
+	metrics := []string{}
+	for i := 0; i < filterScanLimit*2; i++ {
+		metrics = append(metrics, fmt.Sprintf("server.hostname-%d.cpu", i))
+	}
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: metrics,
+	})
+
+	result, err := db.Query(map[string][]string{
+		"custom": {"custom-favorites:tester"},
+		"text":   {"text-filter:hostname-123", "text-filter:/-1[0-9]{2}\\W/"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sort.Strings(result)
+	expected := []string{"server.hostname-123.cpu"}
+	if strings.Join(result, ",") != strings.Join(expected, ",") {
+		t.Errorf("database test: expected %q, but got %q", expected, result)
+	}
+}
+
+func TestTagCounts(t *testing.T) {
+	db := New(10, stats)
+
+	for _, host := range []string{"hostname-1", "hostname-2"} {
+		db.InsertMetrics(&m.KeyMetric{
+			Key:     "fqdn",
+			Value:   host,
+			Metrics: []string{"server." + host + ".cpu"},
+		})
+		db.InsertTags(&m.KeyTag{
+			Key:   "fqdn",
+			Value: host,
+			Tags:  []string{"server-dc:lhr", "server-state:" + host},
+		})
+	}
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.hostname-1.cpu", "server.hostname-2.cpu", "monitors.was_the_site_up"},
+	})
+
+	expected := map[string]int{
+		"server-dc:lhr":           2,
+		"server-state:hostname-1": 1,
+		"server-state:hostname-2": 1,
+		"custom-favorites:tester": 3,
+	}
+
+	counts := db.TagCounts()
+	if len(counts) != len(expected) {
+		t.Errorf("database test: expected tag counts %v, but got %v", expected, counts)
+		return
+	}
+	for tag, count := range expected {
+		if counts[tag] != count {
+			t.Errorf("database test: expected %q to have a count of %d, but it has %d", tag, count, counts[tag])
+		}
+	}
+}
+
+func TestTagsVersion(t *testing.T) {
+	db := New(10, stats)
+
+	db.InsertMetrics(&m.KeyMetric{
+		Key:     "fqdn",
+		Value:   "hostname-1",
+		Metrics: []string{"server.hostname-1.cpu"},
+	})
+	insertTags := func() {
+		db.InsertTags(&m.KeyTag{
+			Key:   "fqdn",
+			Value: "hostname-1",
+			Tags:  []string{"server-dc:lhr"},
+		})
+	}
+
+	steps := []struct {
+		desc    string
+		change  func()
+		changed bool
+	}{
+		{"adding a tag", insertTags, true},
+		{"sending the same tag again", insertTags, false},
+		{"adding a custom tag", func() {
+			db.InsertCustom(&m.TagMetric{
+				Tags:    []string{"custom-favorites:tester"},
+				Metrics: []string{"server.hostname-1.cpu"},
+			})
+		}, true},
+		{"deleting a tag", func() {
+			db.DeleteTags(&m.DeleteKeyTag{
+				Key:   "fqdn",
+				Value: "hostname-1",
+				Tags:  []string{"server-dc:lhr"},
+			})
+		}, true},
+	}
+
+	version := db.TagsVersion()
+	for _, step := range steps {
+		step.change()
+		next := db.TagsVersion()
+		if (next != version) != step.changed {
+			t.Errorf("database test: expected %s to change the tags version: %v, but it went from %d to %d", step.desc, step.changed, version, next)
+		}
+		version = next
+	}
+}
+
+func TestNextTags(t *testing.T) {
+	db := New(10, stats)
+
+	hosts := map[string][]string{
+		"hostname-1": {"lb-pool:www", "server-dc:lhr"},
+		"hostname-2": {"lb-pool:www", "server-dc:ams"},
+		"hostname-3": {"lb-pool:db", "server-dc:fra"},
+	}
+	for host, tags := range hosts {
+		db.InsertMetrics(&m.KeyMetric{
+			Key:     "fqdn",
+			Value:   host,
+			Metrics: []string{"server." + host + ".cpu"},
+		})
+		db.InsertTags(&m.KeyTag{
+			Key:   "fqdn",
+			Value: host,
+			Tags:  tags,
+		})
+	}
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.hostname-3.cpu"},
+	})
+
+	cases := []struct {
+		selected map[string][]string
+		pattern  string
+		expected []string
+	}{
+		{map[string][]string{}, "*", []string{"custom-favorites:tester", "lb-pool:db", "lb-pool:www", "server-dc:ams", "server-dc:fra", "server-dc:lhr"}},
+		{map[string][]string{}, "lb-*", []string{"lb-pool:db", "lb-pool:www"}},
+		{map[string][]string{"lb": {"lb-pool:www"}}, "server-dc:*", []string{"server-dc:ams", "server-dc:lhr"}},
+		{map[string][]string{"lb": {"lb-pool:www"}}, "*", []string{"server-dc:ams", "server-dc:lhr"}},
+		{map[string][]string{"lb": {"lb-pool:www"}, "server": {"!server-dc:ams"}}, "server-*", []string{"server-dc:lhr"}},
+		{map[string][]string{"lb": {"lb-pool:db"}}, "*", []string{"custom-favorites:tester", "server-dc:fra"}},
+		{map[string][]string{"custom": {"custom-favorites:tester"}}, "*", []string{"lb-pool:db", "server-dc:fra"}},
+		{map[string][]string{"lb": {"lb-pool:www"}, "server": {"server-dc:fra"}}, "*", []string{}},
+	}
+
+	for _, c := range cases {
+		next, err := db.NextTags(c.selected, c.pattern)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if strings.Join(next, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("database test: expected the next tags for %v matching %q to be %q, but got %q", c.selected, c.pattern, c.expected, next)
+		}
+	}
+}
+
+func TestTagsForMetric(t *testing.T) {
+	db := New(10, stats)
+
+	for _, host := range []string{"hostname-1", "hostname-2"} {
+		db.InsertMetrics(&m.KeyMetric{
+			Key:     "fqdn",
+			Value:   host,
+			Metrics: []string{"lb.www.requests"},
+		})
+	}
+	db.InsertTags(&m.KeyTag{
+		Key:   "fqdn",
+		Value: "hostname-1",
+		Tags:  []string{"lb-pool:www", "server-dc:lhr"},
+	})
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"lb.www.requests"},
+	})
+
+	result, err := db.TagsForMetric("lb.www.requests")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	joins := result.Split["fqdn"]
+	if len(joins) != 2 || joins[0].Join != "hostname-1" || joins[1].Join != "hostname-2" {
+		t.Errorf("database test: expected the metric to be joined through hostname-1 and hostname-2, but got %v", joins)
+	} else {
+		if strings.Join(joins[0].Tags, ",") != "lb-pool:www,server-dc:lhr" {
+			t.Errorf("database test: expected hostname-1 to have both tags, but got %v", joins[0].Tags)
+		}
+		if len(joins[1].Tags) != 0 {
+			t.Errorf("database test: expected hostname-2 to have no tags, but got %v", joins[1].Tags)
+		}
+	}
+
+	if strings.Join(result.Full, ",") != "custom-favorites:tester" {
+		t.Errorf("database test: expected the metric's custom tags to be custom-favorites:tester, but got %v", result.Full)
+	}
+
+	_, err = db.TagsForMetric("blorg.metric")
+	if err == nil {
+		t.Errorf("database test: looking up tags for a metric that isn't in the database should be an error")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	db := New(10, stats)
+
+	hosts := map[string][]string{
+		"hostname-1": {"lb-pool:www", "server-dc:lhr"},
+		"hostname-2": {"lb-pool:www", "server-dc:ams"},
+	}
+	for host, tags := range hosts {
+		db.InsertMetrics(&m.KeyMetric{
+			Key:     "fqdn",
+			Value:   host,
+			Metrics: []string{"server." + host + ".cpu"},
+		})
+		db.InsertTags(&m.KeyTag{
+			Key:   "fqdn",
+			Value: host,
+			Tags:  tags,
+		})
+	}
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.hostname-1.cpu", "server.hostname-2.cpu"},
+	})
+
+	ex := db.Explain(map[string][]string{
+		"lb":     {"lb-pool:www"},
+		"server": {"server-dc:lhr", "server-rack:nowhere"},
+		"custom": {"custom-favorites:tester"},
+		"blorg":  {"blorg-tag:foo"},
+	})
+
+	if ex.Error != "" {
+		t.Errorf("database test: expected the explained query to succeed, but got %q", ex.Error)
+	}
+
+	if ex.Metrics != 1 {
+		t.Errorf("database test: expected the explained query to select 1 metric, but it selected %d", ex.Metrics)
+	}
+
+	if len(ex.Indexes) != 2 {
+		t.Errorf("database test: expected the query to be routed to 2 indexes, but got %d", len(ex.Indexes))
+	}
+
+	for _, ie := range ex.Indexes {
+		if ie.Index != "fqdn" {
+			continue
+		}
+
+		for _, te := range ie.Tags {
+			if te.Joins == nil {
+				t.Errorf("database test: expected %q to have a join count, since it's in a split index", te.Tag)
+				continue
+			}
+
+			expected := map[string]int{"lb-pool:www": 2, "server-dc:lhr": 1, "server-rack:nowhere": 0}[te.Tag]
+			if *te.Joins != expected {
+				t.Errorf("database test: expected %q to match %d join values, but it matched %d", te.Tag, expected, *te.Joins)
+			}
+		}
+	}
+
+	ignored := []string{}
+	for _, tag := range ex.Ignored {
+		ignored = append(ignored, tag.Tag)
+	}
+	sort.Strings(ignored)
+	if strings.Join(ignored, ",") != "blorg-tag:foo,server-rack:nowhere" {
+		t.Errorf("database test: expected blorg-tag:foo and server-rack:nowhere to be ignored, but got %v", ex.Ignored)
+	}
+
+	if len(ex.Steps) != 2 || ex.Steps[1].Metrics != 1 {
+		t.Errorf("database test: expected 2 intersection steps ending with 1 metric, but got %v", ex.Steps)
+	}
+
+	ex = db.Explain(map[string][]string{"server": {"!server-dc:lhr"}})
+	if ex.Error == "" {
+		t.Errorf("database test: expected an error explaining a query with only negated tags")
+	}
+}
+
 func TestTooBigQuery(t *testing.T) {
 	queryLimit := 1
 	db := New(queryLimit, stats)
@@ -146,6 +683,707 @@ func TestTooBigQuery(t *testing.T) {
 		t.Errorf("database test: expected an error about metric result set size, got %q instead", err)
 		return
 	}
+
+	// raising the limit (say, on a config reload) lets the same query through
+	db.SetQueryLimit(2)
+	results, err = db.Query(query)
+	if err != nil || len(results) != 2 {
+		t.Errorf("database test: expected 2 results after raising the limit, but got %q (%v)", results, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := New(10, stats)
+
+	err := db.InsertMetrics(&m.KeyMetric{
+		Key:     "fqdn",
+		Value:   "hostname-1234",
+		Metrics: []string{"server.hostname-1234.cpu.i7z", "server.hostname-1234.mem.free"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = db.InsertTags(&m.KeyTag{
+		Key:   "fqdn",
+		Value: "hostname-1234",
+		Tags:  []string{"server-state:live", "server-dc:lhr"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"monitors.was_the_site_up", "server.hostname-1234.cpu.i7z"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "carbonsearch-snapshot")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot")
+	err = db.WriteSnapshot(path)
+	if err != nil {
+		t.Errorf("database test: could not write snapshot: %s", err)
+		return
+	}
+
+	restored := New(10, stats)
+	err = restored.LoadSnapshot(path)
+	if err != nil {
+		t.Errorf("database test: could not load snapshot: %s", err)
+		return
+	}
+
+	queries := []map[string][]string{
+		{"server": {"server-state:live"}},
+		{"custom": {"custom-favorites:tester"}},
+		{"server": {"server-dc:lhr"}, "custom": {"custom-favorites:tester"}},
+		{"text": {"text-match:mem"}},
+	}
+
+	for _, query := range queries {
+		expected, err := db.Query(query)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		got, err := restored.Query(query)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		sort.Strings(expected)
+		sort.Strings(got)
+		if len(expected) == 0 || len(expected) != len(got) {
+			t.Errorf("database test: query %v on the restored database returned %q, but the original returned %q", query, got, expected)
+			continue
+		}
+		for i := range expected {
+			if expected[i] != got[i] {
+				t.Errorf("database test: query %v on the restored database returned %q, but the original returned %q", query, got, expected)
+				break
+			}
+		}
+	}
+
+	// new writes still land in the right indexes after a restore
+	err = restored.InsertTags(&m.KeyTag{
+		Key:   "fqdn",
+		Value: "hostname-1234",
+		Tags:  []string{"server-hw:intel"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := restored.Query(map[string][]string{"server": {"server-hw:intel"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 2 {
+		t.Errorf("database test: expected 2 metrics for a tag added after restoring, but got %q", result)
+	}
+
+	err = restored.LoadSnapshot(filepath.Join(dir, "does-not-exist"))
+	if !os.IsNotExist(err) {
+		t.Errorf("database test: loading a missing snapshot should give a 'not exist' error, but got %v", err)
+	}
+}
+
+func TestSnapshotHooks(t *testing.T) {
+	db := New(10, stats)
+
+	dir, err := ioutil.TempDir("", "carbonsearch-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+
+	taken := map[string]int{}
+	written := map[string]int{}
+	hook := func(name string) SnapshotHook {
+		return func() func() {
+			taken[name]++
+			return func() {
+				written[name]++
+			}
+		}
+	}
+
+	removeFirst := db.AddSnapshotHook(hook("first"))
+	db.AddSnapshotHook(hook("second"))
+
+	err = db.WriteSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removeFirst()
+	err = db.WriteSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{"first": 1, "second": 2}
+	if !reflect.DeepEqual(taken, expected) {
+		t.Errorf("database test: expected the hooks to be called %v times, but they were called %v times", expected, taken)
+	}
+	if !reflect.DeepEqual(written, expected) {
+		t.Errorf("database test: expected the written functions to be called %v times, but they were called %v times", expected, written)
+	}
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonsearch-wal")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	walDir := filepath.Join(dir, "wal")
+	snapshotPath := filepath.Join(dir, "snapshot")
+
+	db := New(10, stats)
+	err = db.OpenLog(walDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	insertAndLog := func(msg *m.TagMetric) {
+		err := db.InsertCustom(msg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = db.Log(m.CustomType, msg)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	insertAndLog(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"monitors.was_the_site_up"},
+	})
+
+	err = db.WriteSnapshot(snapshotPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	insertAndLog(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.hostname-1234.cpu.loadavg"},
+	})
+	db.CloseLog()
+
+	// "restart": the first message comes from the snapshot, the second from the log
+	restarted := New(10, stats)
+	err = restarted.LoadSnapshot(snapshotPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = restarted.OpenLog(walDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer restarted.CloseLog()
+
+	result, err := restarted.Query(map[string][]string{"custom": {"custom-favorites:tester"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(result) != 2 {
+		t.Errorf("database test: expected 2 metrics after restoring the snapshot and replaying the log, but got %q", result)
+	}
+}
+
+// messages applied concurrently have to end up in the log in the order they
+// were applied, or replaying an add and a delete of the same association could
+// have a different result
+func TestApplyAndLogOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonsearch-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := New(10, stats)
+	err = db.OpenLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var appliedMutex sync.Mutex
+	applied := []string{}
+
+	wg := &sync.WaitGroup{}
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				msgType := m.CustomType
+				if i%2 == 1 {
+					msgType = m.CustomDeleteType
+				}
+				payload := []byte(fmt.Sprintf(`{"tags":["custom-favorites:tester"],"metrics":["monitors.worker%d.message%d"]}`, worker, i))
+
+				err := db.applyAndLog(msgType, payload, func() error {
+					appliedMutex.Lock()
+					applied = append(applied, string(payload))
+					appliedMutex.Unlock()
+					return db.Apply(msgType, payload)
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	db.CloseLog()
+
+	logged := []string{}
+	l, err := wal.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, err = l.Replay(func(entryType string, payload []byte) error {
+		logged = append(logged, string(payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(applied, logged) {
+		t.Errorf("database test: the write-ahead log has the messages in a different order than they were applied")
+	}
+}
+
+func TestApply(t *testing.T) {
+	db := New(10, stats)
+
+	err := db.Apply(m.MetricType, []byte(`{"key": "fqdn", "value": "hostname-1234", "metrics": ["server.hostname-1234.cpu"]}`))
+	if err != nil {
+		t.Errorf("database test: a valid metric message could not be applied: %s", err)
+	}
+
+	err = db.Apply(m.MetricType, []byte(`{"key": "fqdn", "value": `))
+	if _, ok := err.(*DecodeError); !ok {
+		t.Errorf("database test: expected a DecodeError for a truncated message, but got %v", err)
+	}
+
+	// decodes fine, but isn't a valid message
+	err = db.Apply(m.MetricType, []byte(`{"key": "fqdn", "value": "hostname-1234", "metrics": ["server.hostname-1234.cpu"], "mode": "sideways"}`))
+	if err == nil {
+		t.Errorf("database test: expected an error applying a metric message with an unknown mode")
+	}
+	if _, ok := err.(*DecodeError); ok {
+		t.Errorf("database test: a message that decodes fine shouldn't be a DecodeError: %s", err)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	db := New(10, stats)
+
+	_, err := db.ReplayDeadLetters()
+	if err == nil {
+		t.Errorf("database test: expected an error replaying without a dead letter queue")
+	}
+
+	queue, err := deadletter.NewQueue(nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetDeadLetters(queue)
+
+	err = db.ApplyFrom("kafka", m.MetricType, []byte(`{"key": "fqdn", "value": `))
+	if err == nil {
+		t.Errorf("database test: expected an error applying a truncated message")
+	}
+
+	letters := queue.Letters()
+	if len(letters) != 1 || letters[0].Source != "kafka" || letters[0].MsgType != m.MetricType {
+		t.Fatalf("database test: expected the truncated message to become a dead letter, but got %+v", letters)
+	}
+
+	// pretend a producer sent something that's since been fixed on our side
+	fixed, _ := queue.Add(time.Now(), "httpapi", m.CustomType, []byte(`{"tags": ["custom-favorites:tester"], "metrics": ["monitors.was_the_site_up"]}`), fmt.Errorf("was broken"))
+
+	result, err := db.ReplayDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Replayed) != 1 || result.Replayed[0] != fixed.ID {
+		t.Errorf("database test: expected letter %d to be replayed, but got %v", fixed.ID, result.Replayed)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].ID != letters[0].ID {
+		t.Errorf("database test: expected letter %d to fail again, but got %+v", letters[0].ID, result.Failed)
+	}
+
+	metrics, err := db.Query(map[string][]string{"custom": {"custom-favorites:tester"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 {
+		t.Errorf("database test: expected the replayed message to be in the database, but got %q", metrics)
+	}
+
+	remaining := queue.Letters()
+	if len(remaining) != 1 || remaining[0].ID != letters[0].ID {
+		t.Errorf("database test: expected only the failed letter to stay in the queue, but got %+v", remaining)
+	}
+}
+
+func TestConcurrentDeadLetterReplays(t *testing.T) {
+	db := New(1000, stats)
+	queue, err := deadletter.NewQueue(nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetDeadLetters(queue)
+
+	for i := 0; i < 100; i++ {
+		payload := fmt.Sprintf(`{"tags": ["custom-favorites:tester"], "metrics": ["monitors.check%d"]}`, i)
+		queue.Add(time.Now(), "httpapi", m.CustomType, []byte(payload), fmt.Errorf("was broken"))
+	}
+
+	results := make(chan *ReplayResult, 4)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := db.ReplayDeadLetters()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results <- result
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	replayed := map[uint64]int{}
+	for result := range results {
+		for _, id := range result.Replayed {
+			replayed[id]++
+		}
+	}
+	if len(replayed) != 100 {
+		t.Errorf("database test: expected all 100 letters to be replayed, but %d were", len(replayed))
+	}
+	for id, count := range replayed {
+		if count != 1 {
+			t.Errorf("database test: letter %d was replayed %d times", id, count)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := New(10, stats)
+
+	db.InsertMetrics(&m.KeyMetric{
+		Key:     "fqdn",
+		Value:   "hostname-1234",
+		Metrics: []string{"server.hostname-1234.cpu.i7z"},
+	})
+	db.InsertTags(&m.KeyTag{
+		Key:   "fqdn",
+		Value: "hostname-1234",
+		Tags:  []string{"server-state:live"},
+	})
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.hostname-1234.cpu.i7z", "monitors.was_the_site_up"},
+	})
+
+	expectCount := func(query map[string][]string, expected int) {
+		result, err := db.Query(query)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(result) != expected {
+			t.Errorf("database test: expected %d results for %v, but got %q", expected, query, result)
+		}
+	}
+
+	err := db.DeleteTags(&m.DeleteKeyTag{Key: "fqdn", Value: "hostname-1234"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectCount(map[string][]string{"server": {"server-state:live"}}, 0)
+
+	err = db.DeleteMetrics(&m.DeleteKeyMetric{Key: "fqdn", Value: "hostname-1234"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// still has a custom tag, so the name is still around
+	expectCount(map[string][]string{"text": {"text-match:i7z"}}, 1)
+
+	err = db.DeleteCustom(&m.DeleteTagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"server.hostname-1234.cpu.i7z"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectCount(map[string][]string{"custom": {"custom-favorites:tester"}}, 1)
+	expectCount(map[string][]string{"text": {"text-match:i7z"}}, 0)
+
+	err = db.DeleteCustom(&m.DeleteTagMetric{Tags: []string{"custom-favorites:tester"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectCount(map[string][]string{"custom": {"custom-favorites:tester"}}, 0)
+
+	db.metricsMutex.RLock()
+	remaining := len(db.metrics)
+	db.metricsMutex.RUnlock()
+	if remaining != 0 {
+		t.Errorf("database test: every association was deleted, but %d metric names are still mapped", remaining)
+	}
+
+	// nothing to delete from an index that doesn't exist
+	err = db.DeleteMetrics(&m.DeleteKeyMetric{Key: "blorg", Value: "hostname-1234"})
+	if err != nil {
+		t.Errorf("database test: deleting from a missing index should not be an error, but got %s", err)
+	}
+}
+
+// queries don't hold the write lock, so deletes can happen while they run
+func TestConcurrentQueryAndDelete(t *testing.T) {
+	db := New(10000, stats)
+
+	metrics := make([]string, 5000)
+	for i := range metrics {
+		metrics[i] = fmt.Sprintf("server.hostname-1234.cpu%d", i)
+	}
+	db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "hostname-1234", Tags: []string{"server-state:live"}})
+
+	stop := make(chan bool)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			db.InsertMetrics(&m.KeyMetric{Key: "fqdn", Value: "hostname-1234", Metrics: metrics})
+			db.DeleteMetrics(&m.DeleteKeyMetric{Key: "fqdn", Value: "hostname-1234"})
+		}
+	}()
+
+	failed := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				_, err := db.Query(map[string][]string{"server": {"server-state:live"}})
+				if err != nil {
+					failed <- err
+					return
+				}
+			}
+		}()
+	}
+
+	select {
+	case err := <-failed:
+		t.Errorf("database test: a query during a delete should not fail, but got %s", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReplaceMode(t *testing.T) {
+	db := New(10, stats)
+
+	tagMsg := &m.KeyTag{
+		Key:   "fqdn",
+		Value: "hostname-1234",
+		Tags:  []string{"server-state:live", "server-dc:lhr"},
+	}
+	db.InsertTags(tagMsg)
+	db.InsertMetrics(&m.KeyMetric{
+		Key:     "fqdn",
+		Value:   "hostname-1234",
+		Metrics: []string{"server.hostname-1234.cpu.i7z"},
+	})
+
+	tagMsg.Tags = []string{"server-state:maint", "server-dc:lhr"}
+	tagMsg.Mode = m.ReplaceMode
+	err := db.InsertTags(tagMsg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := db.Query(map[string][]string{"server": {"server-state:live"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 0 {
+		t.Errorf("database test: host moved to maint, but still matches server-state:live: %q", result)
+	}
+
+	err = db.InsertMetrics(&m.KeyMetric{
+		Key:     "fqdn",
+		Value:   "hostname-1234",
+		Metrics: []string{"server.hostname-1234.mem.free"},
+		Mode:    m.ReplaceMode,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err = db.Query(map[string][]string{"server": {"server-state:maint"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 1 || result[0] != "server.hostname-1234.mem.free" {
+		t.Errorf("database test: expected only the replacement metric, but got %q", result)
+	}
+
+	result, err = db.Query(map[string][]string{"text": {"text-match:i7z"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 0 {
+		t.Errorf("database test: replaced metric is still in the text index: %q", result)
+	}
+
+	err = db.InsertTags(&m.KeyTag{Key: "fqdn", Value: "hostname-1234", Tags: []string{"server-state:live"}, Mode: "blorg"})
+	if err == nil {
+		t.Errorf("database test: an unknown mode should be an error")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	db := New(10, stats)
+
+	db.InsertMetrics(&m.KeyMetric{
+		Key:     "fqdn",
+		Value:   "hostname-1234",
+		Metrics: []string{"server.hostname-1234.cpu.i7z"},
+	})
+	db.InsertTags(&m.KeyTag{
+		Key:   "fqdn",
+		Value: "hostname-1234",
+		Tags:  []string{"server-state:live"},
+	})
+	db.InsertCustom(&m.TagMetric{
+		Tags:    []string{"custom-favorites:tester"},
+		Metrics: []string{"monitors.was_the_site_up"},
+	})
+
+	ttls := TTLs{ByKey: map[string]time.Duration{"fqdn": time.Hour}}
+
+	// nothing is stale yet
+	err := db.Expire(time.Now(), ttls)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, _ := db.Query(map[string][]string{"server": {"server-state:live"}})
+	if len(result) != 1 {
+		t.Errorf("database test: nothing should have expired yet, but got %q", result)
+	}
+
+	err = db.Expire(time.Now().Add(2*time.Hour), ttls)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, _ = db.Query(map[string][]string{"server": {"server-state:live"}})
+	if len(result) != 0 {
+		t.Errorf("database test: fqdn associations should have expired, but got %q", result)
+	}
+
+	result, _ = db.Query(map[string][]string{"text": {"text-match:i7z"}})
+	if len(result) != 0 {
+		t.Errorf("database test: expired metric is still in the text index: %q", result)
+	}
+
+	// custom has no TTL (the default is 0), so it sticks around
+	result, _ = db.Query(map[string][]string{"custom": {"custom-favorites:tester"}})
+	if len(result) != 1 {
+		t.Errorf("database test: custom associations have no TTL, but got %q", result)
+	}
+}
+
+func TestStopSweep(t *testing.T) {
+	db := New(10, stats)
+
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		db.Sweep(time.Millisecond, TTLs{Default: time.Hour}, stop)
+		close(stopped)
+	}()
+
+	// let it sweep a few times first
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("database test: Sweep didn't return after being stopped")
+	}
 }
 
 func TestInsertMetrics(t *testing.T) {
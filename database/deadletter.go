@@ -0,0 +1,82 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/database/deadletter"
+)
+
+// SetDeadLetters arranges for messages from consumers which can't be applied
+// to be kept in q, rather than dropped. It should be called before any
+// consumers are started.
+func (db *Database) SetDeadLetters(q *deadletter.Queue) {
+	db.deadLetters = q
+}
+
+// DeadLetters returns the dead letter queue, or nil if there isn't one.
+func (db *Database) DeadLetters() *deadletter.Queue {
+	return db.deadLetters
+}
+
+// DeadLetter records a message from a consumer which couldn't be applied. If
+// there's no dead letter queue, this does nothing.
+func (db *Database) DeadLetter(consumer string, msgType string, payload []byte, cause error) {
+	if db.deadLetters == nil {
+		return
+	}
+
+	db.stats.DeadLetters.Add(1)
+	_, err := db.deadLetters.Add(time.Now(), consumer, msgType, payload, cause)
+	if err != nil {
+		log.Printf("database: %s", err)
+	}
+}
+
+type ReplayResult struct {
+	Replayed []uint64            `json:"replayed"`
+	Failed   []deadletter.Letter `json:"failed"`
+}
+
+// ReplayDeadLetters applies the dead letters with the given ids (or all of
+// them) again, presumably after fixing whatever was wrong. Letters which
+// apply cleanly are logged like any other message and forgotten; the rest
+// go back in the queue with their new error. Letters of deadletter.UnknownType
+// are left out, and stay in the queue as they are.
+func (db *Database) ReplayDeadLetters(ids ...uint64) (*ReplayResult, error) {
+	if db.deadLetters == nil {
+		return nil, fmt.Errorf("database: there's no dead letter queue to replay")
+	}
+
+	result := &ReplayResult{
+		Replayed: []uint64{},
+		Failed:   []deadletter.Letter{},
+	}
+	for _, letter := range db.deadLetters.Take(ids...) {
+		if letter.MsgType == deadletter.UnknownType {
+			db.deadLetters.Return(letter)
+			continue
+		}
+
+		payload := []byte(letter.Payload)
+		// wherever it came from, it can't be replayed from there any more
+		err := db.applyAndLog(letter.MsgType, payload, func() error {
+			return db.Apply(letter.MsgType, payload)
+		})
+		if _, ok := err.(*LogError); ok {
+			log.Printf("database: dead letter %d was replayed, but %s", letter.ID, err)
+			err = nil
+		}
+		if err == nil {
+			db.stats.DeadLettersReplayed.Add(1)
+			result.Replayed = append(result.Replayed, letter.ID)
+			continue
+		}
+
+		letter.Error = err.Error()
+		db.deadLetters.Return(letter)
+		result.Failed = append(result.Failed, letter)
+	}
+	return result, nil
+}
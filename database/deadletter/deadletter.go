@@ -0,0 +1,263 @@
+package deadletter
+
+/*
+
+this package keeps track of messages from consumers that couldn't be applied to
+the database: malformed JSON, or messages the database rejected. rather than
+being logged and dropped, each one becomes a dead letter holding the raw
+payload, where it came from, what went wrong, and when.
+
+every dead letter is written to a sink, so there's a durable record of it
+outside carbonsearch:
+
+	file: one JSON letter per line, appended to a local file
+	kafka: one JSON letter per message, produced to a topic
+
+the most recent ones are also kept in memory, so they can be inspected and
+replayed (once whatever produced them has been fixed) without a restart.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// UnknownType is the MsgType of a letter whose message type couldn't be
+// worked out, like a line of a file which isn't JSON. These are kept so they
+// can be looked at, but they're never replayed, since nothing could apply
+// them.
+const UnknownType = "unknown"
+
+type Letter struct {
+	// unique among the letters kept since startup
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	MsgType string    `json:"type"`
+	Payload string    `json:"payload"`
+	Error   string    `json:"error"`
+}
+
+// A Sink records dead letters somewhere outside carbonsearch.
+type Sink interface {
+	Write(letter *Letter) error
+	Close() error
+}
+
+// Queue holds the most recent dead letters, and passes every new one on to
+// the sink (if there is one).
+type Queue struct {
+	sink     Sink
+	capacity int
+
+	mutex  sync.Mutex
+	nextID uint64
+	// oldest first
+	letters []*Letter
+}
+
+// NewQueue makes a queue which remembers up to capacity letters. sink may be
+// nil, in which case letters are only kept in memory.
+func NewQueue(sink Sink, capacity int) (*Queue, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("deadletter: the number of letters to keep must be positive, but it is %d", capacity)
+	}
+
+	return &Queue{
+		sink:     sink,
+		capacity: capacity,
+		nextID:   1,
+	}, nil
+}
+
+// Add records a message that couldn't be applied. The letter is always kept;
+// the error is from writing it to the sink.
+func (q *Queue) Add(now time.Time, source string, msgType string, payload []byte, cause error) (*Letter, error) {
+	q.mutex.Lock()
+	letter := &Letter{
+		ID:      q.nextID,
+		Time:    now,
+		Source:  source,
+		MsgType: msgType,
+		Payload: string(payload),
+		Error:   cause.Error(),
+	}
+	q.nextID++
+
+	q.letters = append(q.letters, letter)
+	if len(q.letters) > q.capacity {
+		// don't hang on to the dropped ones through the backing array
+		q.letters = append([]*Letter(nil), q.letters[len(q.letters)-q.capacity:]...)
+	}
+	q.mutex.Unlock()
+
+	if q.sink == nil {
+		return letter, nil
+	}
+
+	// kept letters are never changed (a failed replay puts back a new one), so
+	// the sink can have the same one
+	err := q.sink.Write(letter)
+	if err != nil {
+		return letter, fmt.Errorf("deadletter: could not write letter %d to the sink: %s", letter.ID, err)
+	}
+	return letter, nil
+}
+
+// Letters returns copies of the letters with the given ids, or all of them if
+// there are no ids, oldest first.
+func (q *Queue) Letters(ids ...uint64) []Letter {
+	wanted := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	letters := []Letter{}
+	for _, letter := range q.letters {
+		if len(ids) == 0 || wanted[letter.ID] {
+			letters = append(letters, *letter)
+		}
+	}
+	return letters
+}
+
+// Take removes the letters with the given ids, or all of them if there are no
+// ids, and returns them oldest first. Taking them out before replaying them
+// means two replays at once can't both apply the same letter.
+func (q *Queue) Take(ids ...uint64) []Letter {
+	wanted := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	taken := []Letter{}
+	remaining := make([]*Letter, 0, len(q.letters))
+	for _, letter := range q.letters {
+		if len(ids) == 0 || wanted[letter.ID] {
+			taken = append(taken, *letter)
+		} else {
+			remaining = append(remaining, letter)
+		}
+	}
+	q.letters = remaining
+	return taken
+}
+
+// Return puts back a letter which was taken, but still couldn't be applied
+// when it was replayed. It goes back in its place by age, unless the queue has
+// filled up with newer letters since.
+func (q *Queue) Return(letter Letter) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i := sort.Search(len(q.letters), func(i int) bool {
+		return q.letters[i].ID > letter.ID
+	})
+	q.letters = append(q.letters, nil)
+	copy(q.letters[i+1:], q.letters[i:])
+	q.letters[i] = &letter
+	if len(q.letters) > q.capacity {
+		// the oldest is dropped, just like in Add
+		q.letters = append([]*Letter(nil), q.letters[len(q.letters)-q.capacity:]...)
+	}
+}
+
+// Close closes the sink.
+func (q *Queue) Close() error {
+	if q.sink == nil {
+		return nil
+	}
+	return q.sink.Close()
+}
+
+// FileSink appends each letter to a file, as a line of JSON.
+type FileSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("deadletter: could not open %q: %s", path, err)
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Write(letter *Letter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err = s.file.Write(line)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// KafkaSink produces each letter to a topic, as a JSON message keyed by the
+// source it came from.
+type KafkaSink struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func NewKafkaSink(brokerList []string, topic string) (*KafkaSink, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("deadletter: there's no kafka topic to send dead letters to")
+	}
+
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(brokerList, config)
+	if err != nil {
+		return nil, fmt.Errorf("deadletter: could not create a kafka producer: %s", err)
+	}
+	return newKafkaSink(producer, topic), nil
+}
+
+func newKafkaSink(producer sarama.SyncProducer, topic string) *KafkaSink {
+	return &KafkaSink{producer: producer, topic: topic}
+}
+
+func (s *KafkaSink) Write(letter *Letter) error {
+	value, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: s.topic,
+		Key:   sarama.StringEncoder(letter.Source),
+		Value: sarama.ByteEncoder(value),
+	})
+	return err
+}
+
+func (s *KafkaSink) Close() error {
+	return s.producer.Close()
+}
@@ -0,0 +1,164 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestQueue(t *testing.T) {
+	q, err := NewQueue(nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	for i := 0; i < 3; i++ {
+		_, err := q.Add(now, "kafka", "metric", []byte(fmt.Sprintf("garbage %d", i)), fmt.Errorf("bad message %d", i))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	letters := q.Letters()
+	if len(letters) != 2 || letters[0].ID != 2 || letters[1].ID != 3 {
+		t.Fatalf("deadletter test: expected to keep the 2 newest letters (2 and 3), but got %+v", letters)
+	}
+	if letters[0].Payload != "garbage 1" || letters[0].Error != "bad message 1" || letters[0].Source != "kafka" {
+		t.Errorf("deadletter test: letter 2 has the wrong contents: %+v", letters[0])
+	}
+
+	taken := q.Take(3)
+	if len(taken) != 1 || taken[0].ID != 3 {
+		t.Fatalf("deadletter test: expected to take letter 3, but got %+v", taken)
+	}
+	if again := q.Take(3); len(again) != 0 {
+		t.Errorf("deadletter test: letter 3 was taken twice: %+v", again)
+	}
+
+	taken[0].Error = "still bad"
+	q.Return(taken[0])
+	letters = q.Letters()
+	if len(letters) != 2 || letters[0].ID != 2 || letters[1].ID != 3 || letters[1].Error != "still bad" {
+		t.Errorf("deadletter test: expected letter 3 back in its place with its error updated, but got %+v", letters)
+	}
+
+	// letter 2 is older than the 2 kept once letter 4 arrives
+	taken = q.Take(2)
+	q.Add(now, "kafka", "metric", []byte("garbage 3"), fmt.Errorf("bad message 3"))
+	q.Return(taken[0])
+	letters = q.Letters()
+	if len(letters) != 2 || letters[0].ID != 3 || letters[1].ID != 4 {
+		t.Errorf("deadletter test: expected letter 2 to be dropped when returned to a full queue, but got %+v", letters)
+	}
+
+	taken = q.Take()
+	if len(taken) != 2 || len(q.Letters()) != 0 {
+		t.Errorf("deadletter test: expected to take every letter, but took %+v", taken)
+	}
+
+	_, err = NewQueue(nil, 0)
+	if err == nil {
+		t.Errorf("deadletter test: a queue which keeps nothing should be an error")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonsearch-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletters.ndjson")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewQueue(sink, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	q.Add(now, "httpapi", "tag", []byte(`{"key": `), fmt.Errorf("unexpected end of JSON input"))
+	q.Add(now, "kafka", "metric", []byte("not json at all\n"), fmt.Errorf("invalid character"))
+	err = q.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	letters := []Letter{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		letter := Letter{}
+		err := json.Unmarshal(scanner.Bytes(), &letter)
+		if err != nil {
+			t.Fatalf("deadletter test: line %q isn't a JSON letter: %s", scanner.Text(), err)
+		}
+		letters = append(letters, letter)
+	}
+
+	if len(letters) != 2 {
+		t.Fatalf("deadletter test: expected 2 lines in the file, but got %d", len(letters))
+	}
+	if letters[1].Payload != "not json at all\n" || letters[1].Source != "kafka" || !letters[1].Time.Equal(now) {
+		t.Errorf("deadletter test: the second letter didn't survive the round trip: %+v", letters[1])
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(value []byte) error {
+		letter := Letter{}
+		err := json.Unmarshal(value, &letter)
+		if err != nil {
+			return err
+		}
+		if letter.Payload != "garbage" || letter.MsgType != "custom" {
+			return fmt.Errorf("unexpected letter %+v", letter)
+		}
+		return nil
+	})
+	producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+
+	q, err := NewQueue(newKafkaSink(producer, "carbonsearch_deadletters"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	_, err = q.Add(now, "kafka", "custom", []byte("garbage"), fmt.Errorf("bad"))
+	if err != nil {
+		t.Errorf("deadletter test: %s", err)
+	}
+
+	// kept, even though the sink failed
+	letter, err := q.Add(now, "kafka", "custom", []byte("more garbage"), fmt.Errorf("bad"))
+	if err == nil {
+		t.Errorf("deadletter test: expected an error when the kafka sink fails")
+	}
+	if len(q.Letters(letter.ID)) != 1 {
+		t.Errorf("deadletter test: a letter the sink couldn't take should still be kept")
+	}
+
+	err = q.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
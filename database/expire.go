@@ -0,0 +1,94 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+// CustomTTLKey is the key in TTLs.ByKey for associations in the full index
+// (custom messages). Every other key is the join key of a split index.
+const CustomTTLKey = "custom"
+
+// TTLs says how long an association can go without being added again before
+// it expires. A TTL of zero means associations never expire.
+type TTLs struct {
+	Default time.Duration
+	ByKey   map[string]time.Duration
+}
+
+func (t TTLs) For(key string) time.Duration {
+	ttl, ok := t.ByKey[key]
+	if !ok {
+		return t.Default
+	}
+	return ttl
+}
+
+// Sweep runs Expire every interval, until stop is closed. It is meant to be run
+// in its own goroutine.
+func (db *Database) Sweep(interval time.Duration, ttls TTLs, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := db.Expire(time.Now(), ttls)
+		if err != nil {
+			log.Printf("database: error while expiring stale associations: %s", err)
+		}
+	}
+}
+
+// Expire removes every association which hasn't been added again within its
+// TTL, as of now. Metrics left without any associations are dropped from the
+// text index and the metric name map, just like a delete.
+func (db *Database) Expire(now time.Time, ttls TTLs) error {
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	db.splitMutex.RLock()
+	splitIndexes := make([]*split.Index, 0, len(db.splitIndexes))
+	for _, si := range db.splitIndexes {
+		splitIndexes = append(splitIndexes, si)
+	}
+	db.splitMutex.RUnlock()
+
+	orphans := []index.Metric{}
+	for _, si := range splitIndexes {
+		ttl := ttls.For(si.Name())
+		if ttl <= 0 {
+			continue
+		}
+
+		before := now.Add(-ttl).Unix()
+		tags := si.ExpireTags(before)
+		metrics, expired := si.ExpireMetrics(before)
+		orphans = append(orphans, expired...)
+
+		db.stats.ExpiredTags.Add(int64(tags))
+		db.stats.ExpiredMetrics.Add(int64(metrics))
+		db.stats.SplitIndexes.Set(fmt.Sprintf("%s-metrics", si.Name()), util.ExpInt(si.MetricSize()))
+		db.stats.SplitIndexes.Set(fmt.Sprintf("%s-tags", si.Name()), util.ExpInt(si.TagSize()))
+	}
+
+	ttl := ttls.For(CustomTTLKey)
+	if ttl > 0 {
+		count, expired := db.FullIndex.Expire(now.Add(-ttl).Unix())
+		orphans = append(orphans, expired...)
+
+		db.stats.ExpiredCustom.Add(int64(count))
+		db.stats.FullIndexTags.Set(int64(db.FullIndex.TagSize()))
+		db.stats.FullIndexMetrics.Set(int64(db.FullIndex.MetricSize()))
+	}
+
+	return db.forgetMetrics(orphans)
+}
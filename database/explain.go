@@ -0,0 +1,197 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/util/glob"
+)
+
+// Explanation breaks down how a query was answered, for working out why it
+// selects the metrics it does (or none at all).
+type Explanation struct {
+	Indexes []*IndexExplanation `json:"indexes"`
+	Ignored []IgnoredTag        `json:"ignored"`
+	// how many metrics were left after each step of combining the indexes
+	Steps []Step `json:"steps"`
+	// how many metrics the query selected in the end
+	Metrics int `json:"metrics"`
+	// why the query failed, if it did. everything up to the failure is
+	// still filled in
+	Error string `json:"error,omitempty"`
+	Took  string `json:"took"`
+}
+
+// IndexExplanation is the part of a query that was routed to one index.
+type IndexExplanation struct {
+	Index string            `json:"index"`
+	Tags  []*TagExplanation `json:"tags"`
+	// how many metrics the index selected for all of its tags together
+	Metrics int    `json:"metrics"`
+	Took    string `json:"took"`
+
+	selected    []index.Metric
+	negatedOnly bool
+}
+
+// TagExplanation is what a single tag selects from its index on its own. For
+// negated tags, that's what they exclude.
+type TagExplanation struct {
+	Tag     string `json:"tag"`
+	Negated bool   `json:"negated,omitempty"`
+	// join values with the tag, for split indexes only
+	Joins   *int   `json:"joins,omitempty"`
+	Metrics int    `json:"metrics"`
+	Error   string `json:"error,omitempty"`
+}
+
+// IgnoredTag is a tag which had no effect on the query.
+type IgnoredTag struct {
+	Tag    string `json:"tag"`
+	Reason string `json:"reason"`
+}
+
+type Step struct {
+	Step    string `json:"step"`
+	Metrics int    `json:"metrics"`
+}
+
+// Explain runs a query like Query does, recording what each index and each
+// tag contributed along the way.
+func (db *Database) Explain(tagsByService map[string][]string) *Explanation {
+	ex := &Explanation{
+		Indexes: []*IndexExplanation{},
+		Ignored: []IgnoredTag{},
+		Steps:   []Step{},
+	}
+
+	start := time.Now()
+	metrics, err := db.runQuery(tagsByService, ex)
+	ex.Took = time.Since(start).String()
+
+	if err != nil {
+		ex.Error = err.Error()
+		return ex
+	}
+
+	ex.Metrics = len(metrics)
+	limit := db.loadQueryLimit()
+	if len(metrics) > limit {
+		ex.Error = fmt.Sprintf("database: query selected %d metrics, which is over the limit of %d results in a single query", len(metrics), limit)
+	}
+	return ex
+}
+
+// the methods below do nothing on a nil explanation, so that runQuery can call
+// them unconditionally
+
+func (ex *Explanation) ignore(tags []string, reason string) {
+	if ex == nil {
+		return
+	}
+
+	for _, tag := range tags {
+		ex.Ignored = append(ex.Ignored, IgnoredTag{Tag: tag, Reason: reason})
+	}
+}
+
+// index records the query for one index, and what it selected. Each tag is
+// queried again on its own to see what it contributed.
+func (ex *Explanation) index(targetIndex index.Index, q *index.Query, selected []index.Metric, took time.Duration) {
+	if ex == nil {
+		return
+	}
+
+	ie := &IndexExplanation{
+		Index:    targetIndex.Name(),
+		Tags:     []*TagExplanation{},
+		Metrics:  len(selected),
+		Took:     took.String(),
+		selected: selected,
+
+		negatedOnly: len(q.Hashed) == 0,
+	}
+	ex.Indexes = append(ex.Indexes, ie)
+
+	for _, tag := range q.Raw {
+		ie.Tags = append(ie.Tags, ex.tag(targetIndex, tag, false))
+	}
+	for _, tag := range q.NegatedRaw {
+		ie.Tags = append(ie.Tags, ex.tag(targetIndex, tag, true))
+	}
+}
+
+func (ex *Explanation) tag(targetIndex index.Index, tag string, negated bool) *TagExplanation {
+	te := &TagExplanation{Tag: tag, Negated: negated}
+
+	si, ok := targetIndex.(*split.Index)
+	if ok {
+		joins, err := si.JoinsForTag(tag)
+		if err != nil {
+			te.Error = err.Error()
+			return te
+		}
+		te.Joins = &joins
+
+		// split indexes skip plain tags that no join value has, rather than
+		// selecting nothing for them
+		if joins == 0 && !negated && !glob.IsGlob(tag) {
+			ex.ignore([]string{tag}, fmt.Sprintf("no join values in index %s have this tag, so the index ignores it", si.Name()))
+		}
+	}
+
+	metrics, err := targetIndex.Query(index.NewQuery([]string{tag}))
+	if err != nil {
+		te.Error = err.Error()
+		return te
+	}
+	te.Metrics = len(metrics)
+	return te
+}
+
+// intersect records the size of the intersection as each index's result is
+// added to it
+func (ex *Explanation) intersect() {
+	if ex == nil {
+		return
+	}
+
+	var metrics []index.Metric
+	first := true
+	for _, ie := range ex.Indexes {
+		if ie.negatedOnly {
+			continue
+		}
+
+		if first {
+			metrics = ie.selected
+			first = false
+		} else {
+			metrics = index.IntersectMetrics([][]index.Metric{metrics, ie.selected})
+		}
+		ex.step(fmt.Sprintf("intersect with %s", ie.Index), metrics)
+	}
+}
+
+func (ex *Explanation) filter(filters []*nameFilter, metrics []index.Metric) {
+	if ex == nil {
+		return
+	}
+
+	tags := make([]string, len(filters))
+	for i, f := range filters {
+		tags[i] = f.tag
+	}
+	ex.step(fmt.Sprintf("filter by %s", strings.Join(tags, ", ")), metrics)
+}
+
+func (ex *Explanation) step(description string, metrics []index.Metric) {
+	if ex == nil {
+		return
+	}
+
+	ex.Steps = append(ex.Steps, Step{Step: description, Metrics: len(metrics)})
+}
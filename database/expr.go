@@ -0,0 +1,133 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/query"
+	"github.com/kanatohodets/carbonsearch/tag"
+)
+
+// QueryExpr evaluates a parsed v2 query. Like Query, it returns the matching
+// metric names, and errors if there are more than the query limit.
+func (db *Database) QueryExpr(expr query.Expr) ([]string, error) {
+	metrics, complement, err := db.evaluate(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if complement {
+		return nil, fmt.Errorf("database: %s only excludes metrics, so it would match everything else. add a tag to select metrics from", expr)
+	}
+
+	return db.results(metrics)
+}
+
+// evaluate returns the sorted set of metrics matched by expr. NOT can't be
+// evaluated directly (we'd need the set of every metric), so instead the
+// result may be flagged as a complement: the expression matches every metric
+// *except* the returned ones. the boolean operators then fold complements
+// back into differences:
+//
+//	a & !b   ->  a - b
+//	!a & !b  ->  !(a | b)
+//	a | !b   ->  !(b - a)
+//	!a | !b  ->  !(a & b)
+func (db *Database) evaluate(expr query.Expr) ([]index.Metric, bool, error) {
+	switch e := expr.(type) {
+	case *query.Tag:
+		metrics, err := db.queryTag(e.Raw)
+		return metrics, false, err
+
+	case *query.Not:
+		metrics, complement, err := db.evaluate(e.Child)
+		return metrics, !complement, err
+
+	case *query.And:
+		included, excluded, err := db.evaluateChildren(e.Children)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(included) == 0 {
+			return unionMetrics(excluded), true, nil
+		}
+		return index.DifferenceMetrics(index.IntersectMetrics(included), unionMetrics(excluded)), false, nil
+
+	case *query.Or:
+		included, excluded, err := db.evaluateChildren(e.Children)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(excluded) == 0 {
+			return unionMetrics(included), false, nil
+		}
+		return index.DifferenceMetrics(index.IntersectMetrics(excluded), unionMetrics(included)), true, nil
+	}
+
+	return nil, false, fmt.Errorf("database: don't know how to evaluate query expression %s", expr)
+}
+
+// evaluateChildren splits the results of children into the ones which include
+// metrics and the complements, which exclude them.
+func (db *Database) evaluateChildren(children []query.Expr) ([][]index.Metric, [][]index.Metric, error) {
+	included := [][]index.Metric{}
+	excluded := [][]index.Metric{}
+	for _, child := range children {
+		metrics, complement, err := db.evaluate(child)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if complement {
+			excluded = append(excluded, metrics)
+		} else {
+			included = append(included, metrics)
+		}
+	}
+	return included, excluded, nil
+}
+
+func (db *Database) queryTag(raw string) ([]index.Metric, error) {
+	if strings.HasPrefix(raw, textFilterPrefix) {
+		// there's no earlier result to filter, so this is a search
+		f, err := parseFilter(raw)
+		if err != nil {
+			return nil, err
+		}
+		return db.filterMetrics(nil, false, []*nameFilter{f})
+	}
+
+	service, _, err := tag.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	db.serviceIndexMutex.RLock()
+	mappedIndex, ok := db.serviceToIndex[service]
+	db.serviceIndexMutex.RUnlock()
+	if !ok {
+		log.Printf("warning: there's no index for service %q, so %q won't match anything", service, raw)
+		return []index.Metric{}, nil
+	}
+
+	metrics, err := mappedIndex.Query(index.NewQuery([]string{raw}))
+	if err != nil {
+		return nil, fmt.Errorf("database: error while querying index %s: %s", mappedIndex.Name(), err)
+	}
+	return metrics, nil
+}
+
+// unionMetrics is index.UnionMetrics, minus the empty sets (which it can't handle)
+func unionMetrics(metricSets [][]index.Metric) []index.Metric {
+	nonEmpty := make([][]index.Metric, 0, len(metricSets))
+	for _, metrics := range metricSets {
+		if len(metrics) > 0 {
+			nonEmpty = append(nonEmpty, metrics)
+		}
+	}
+	return index.UnionMetrics(nonEmpty)
+}
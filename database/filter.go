@@ -0,0 +1,173 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/text"
+	"github.com/kanatohodets/carbonsearch/util/glob"
+)
+
+const textFilterPrefix = "text-filter:"
+
+// with fewer candidates than this, checking each metric name is cheaper than
+// searching the text index
+const filterScanLimit = 1000
+
+// nameFilter is a 'text-filter:' tag: rather than selecting metrics from an
+// index, it narrows down the metrics selected by the rest of the query by
+// checking their names. the value is either a substring, a glob matched
+// against each dot-separated part of the name, or a regex between slashes:
+//
+//	text-filter:Delay
+//	text-filter:repl*Delay
+//	text-filter:/Delay(Max|Avg)$/
+type nameFilter struct {
+	tag     string
+	negated bool
+	match   func(name string) bool
+	// finds the metrics matching the filter with the text index. nil if the
+	// filter can't be searched for
+	search func(ti *text.Index) ([]index.Metric, error)
+}
+
+func parseFilter(tag string) (*nameFilter, error) {
+	f := &nameFilter{tag: tag}
+	value := strings.TrimPrefix(tag, index.NegationPrefix)
+	f.negated = value != tag
+	value = strings.TrimPrefix(value, textFilterPrefix)
+
+	switch {
+	case len(value) >= 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/"):
+		pattern := value[1 : len(value)-1]
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("database: could not compile regex in %q: %s", tag, err)
+		}
+		f.match = re.MatchString
+		f.search = func(ti *text.Index) ([]index.Metric, error) {
+			return ti.SearchRegex(pattern)
+		}
+
+	case glob.IsGlob(value):
+		re, err := glob.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("database: could not compile glob in %q: %s", tag, err)
+		}
+		f.match = func(name string) bool {
+			for _, node := range strings.Split(name, ".") {
+				if re.MatchString(node) {
+					return true
+				}
+			}
+			return false
+		}
+
+	case value == "":
+		return nil, fmt.Errorf("database: %q doesn't have anything to filter on", tag)
+
+	default:
+		f.match = func(name string) bool {
+			return strings.Contains(name, value)
+		}
+		if text.Indexable(value) {
+			f.search = func(ti *text.Index) ([]index.Metric, error) {
+				return ti.Search(value)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// takeFilters removes the 'text-filter:' tags from a query, returning them
+// separately
+func takeFilters(tagsByService map[string][]string) (map[string][]string, []*nameFilter, error) {
+	filters := []*nameFilter{}
+	remaining := make(map[string][]string, len(tagsByService))
+	for service, tags := range tagsByService {
+		kept := []string{}
+		for _, tag := range tags {
+			if !strings.HasPrefix(strings.TrimPrefix(tag, index.NegationPrefix), textFilterPrefix) {
+				kept = append(kept, tag)
+				continue
+			}
+
+			f, err := parseFilter(tag)
+			if err != nil {
+				return nil, nil, err
+			}
+			filters = append(filters, f)
+		}
+
+		if len(kept) > 0 {
+			remaining[service] = kept
+		}
+	}
+	return remaining, filters, nil
+}
+
+// filterMetrics applies name filters to the metrics selected by the rest of a
+// query. If the rest of the query didn't select anything (because there was
+// nothing else in it), the text index is searched for candidates instead.
+func (db *Database) filterMetrics(metrics []index.Metric, selected bool, filters []*nameFilter) ([]index.Metric, error) {
+	if !selected {
+		var searchable *nameFilter
+		for _, f := range filters {
+			if !f.negated && f.search != nil {
+				searchable = f
+				break
+			}
+		}
+
+		if searchable == nil {
+			return nil, fmt.Errorf("database: the query only has text filters that can't be searched for. add a tag to select metrics to filter")
+		}
+
+		var err error
+		metrics, err = searchable.search(db.TextIndex)
+		if err != nil {
+			return nil, fmt.Errorf("database: error while searching for %q: %s", searchable.tag, err)
+		}
+	}
+
+	if len(metrics) > filterScanLimit {
+		// too many names to check one by one: narrow it down with the text
+		// index first. every name still gets checked below.
+		for _, f := range filters {
+			if f.negated || f.search == nil {
+				continue
+			}
+
+			found, err := f.search(db.TextIndex)
+			if err != nil {
+				// not every regex can be searched for; the scan will do
+				continue
+			}
+			metrics = index.IntersectMetrics([][]index.Metric{metrics, found})
+		}
+	}
+
+	db.metricsMutex.RLock()
+	defer db.metricsMutex.RUnlock()
+
+	filtered := make([]index.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		name, ok := db.metrics[metric]
+		if ok && matchFilters(name, filters) {
+			filtered = append(filtered, metric)
+		}
+	}
+	return filtered, nil
+}
+
+func matchFilters(name string, filters []*nameFilter) bool {
+	for _, f := range filters {
+		if f.match(name) == f.negated {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,331 @@
+package database
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/full"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/index/text"
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+// bump this whenever the layout of snapshot (or the index snapshots it
+// contains) changes in a way that gob can't paper over
+const snapshotVersion = 1
+
+const (
+	fullIndexKind  = "full"
+	textIndexKind  = "text"
+	splitIndexKind = "split"
+)
+
+type indexRef struct {
+	Kind string
+	// only set for split indexes: the join key
+	Name string
+}
+
+type snapshot struct {
+	Version int
+
+	Metrics  map[index.Metric]string
+	Services map[string]indexRef
+
+	SplitIndexes []*split.Snapshot
+	FullIndex    *full.Snapshot
+}
+
+// A SnapshotHook is called while a snapshot is being taken, when everything
+// inserted into the database so far is in it and nothing else can be
+// inserted. The function it returns (if it isn't nil) is called once the
+// snapshot has been safely written to disk. Consumers use this to remember
+// how far into their sources the snapshot goes.
+type SnapshotHook func() (written func())
+
+// AddSnapshotHook arranges for hook to be called for every snapshot written
+// from now on, until the function it returns is called. A consumer which is
+// stopped should remove its hook, since a reload could start a new one.
+func (db *Database) AddSnapshotHook(hook SnapshotHook) (remove func()) {
+	db.hookMutex.Lock()
+	defer db.hookMutex.Unlock()
+
+	// functions can't be compared, but pointers to them can
+	added := &hook
+	db.snapshotHooks = append(db.snapshotHooks, added)
+
+	return func() {
+		db.hookMutex.Lock()
+		defer db.hookMutex.Unlock()
+
+		for i, existing := range db.snapshotHooks {
+			if existing == added {
+				db.snapshotHooks = append(db.snapshotHooks[:i], db.snapshotHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// LoadedSnapshot reports whether the database was loaded from a snapshot,
+// rather than starting out empty.
+func (db *Database) LoadedSnapshot() bool {
+	db.writeMutex.RLock()
+	defer db.writeMutex.RUnlock()
+	return db.loadedSnapshot
+}
+
+// WriteSnapshot serializes the whole database to path. The file is written
+// to a temporary file in the same directory and renamed over path, so a crash
+// mid-write leaves the previous snapshot intact. Once the snapshot is in
+// place, the parts of the write-ahead log that it covers are removed.
+func (db *Database) WriteSnapshot(path string) error {
+	db.snapshotMutex.Lock()
+	defer db.snapshotMutex.Unlock()
+
+	var checkpoint uint64
+	var snap *snapshot
+	var written []func()
+	if db.wal != nil {
+		// nothing can be applied or logged between rotating the log and
+		// taking the snapshot, so the segments before the checkpoint have
+		// exactly the messages in the snapshot, and the segments after it
+		// have none of them: replaying those after loading the snapshot
+		// doesn't apply anything twice
+		db.logMutex.Lock()
+		var err error
+		checkpoint, err = db.wal.Rotate()
+		if err != nil {
+			db.logMutex.Unlock()
+			return fmt.Errorf("database: could not rotate write-ahead log before snapshot: %s", err)
+		}
+		snap, written = db.snapshot()
+		db.logMutex.Unlock()
+	} else {
+		snap, written = db.snapshot()
+	}
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return fmt.Errorf("database: could not create temporary snapshot file in %q: %s", dir, err)
+	}
+	// no-op once the rename has happened
+	defer os.Remove(tmp.Name())
+
+	err = gob.NewEncoder(tmp).Encode(snap)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("database: could not encode snapshot: %s", err)
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("database: could not sync snapshot %q: %s", tmp.Name(), err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("database: could not close snapshot %q: %s", tmp.Name(), err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("database: could not move snapshot into place at %q: %s", path, err)
+	}
+
+	db.stats.SnapshotsWritten.Add(1)
+
+	for _, hook := range written {
+		hook()
+	}
+
+	if db.wal != nil {
+		err = db.wal.Compact(checkpoint)
+		if err != nil {
+			return fmt.Errorf("database: wrote snapshot, but could not compact write-ahead log: %s", err)
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot replaces the contents of the database with the snapshot stored
+// at path. It is meant to be called before any consumers are started.
+func (db *Database) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snap := &snapshot{}
+	err = gob.NewDecoder(f).Decode(snap)
+	if err != nil {
+		return fmt.Errorf("database: could not decode snapshot %q: %s", path, err)
+	}
+
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("database: snapshot %q has version %d, but this carbonsearch only understands version %d", path, snap.Version, snapshotVersion)
+	}
+
+	err = db.restore(snap)
+	if err != nil {
+		return err
+	}
+
+	db.writeMutex.Lock()
+	db.loadedSnapshot = true
+	db.writeMutex.Unlock()
+	return nil
+}
+
+// snapshot copies the database, and returns the functions to call once the
+// copy has been written to disk
+func (db *Database) snapshot() (*snapshot, []func()) {
+	// block writers so that the indexes and the metric names agree with each other
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	written := []func(){}
+	db.hookMutex.Lock()
+	for _, hook := range db.snapshotHooks {
+		if f := (*hook)(); f != nil {
+			written = append(written, f)
+		}
+	}
+	db.hookMutex.Unlock()
+
+	snap := &snapshot{
+		Version:  snapshotVersion,
+		Metrics:  make(map[index.Metric]string),
+		Services: make(map[string]indexRef),
+	}
+
+	db.metricsMutex.RLock()
+	for hash, metric := range db.metrics {
+		snap.Metrics[hash] = metric
+	}
+	db.metricsMutex.RUnlock()
+
+	db.serviceIndexMutex.RLock()
+	for service, mappedIndex := range db.serviceToIndex {
+		snap.Services[service] = db.indexRef(mappedIndex)
+	}
+	db.serviceIndexMutex.RUnlock()
+
+	db.splitMutex.RLock()
+	for _, si := range db.splitIndexes {
+		snap.SplitIndexes = append(snap.SplitIndexes, si.Snapshot())
+	}
+	db.splitMutex.RUnlock()
+
+	snap.FullIndex = db.FullIndex.Snapshot()
+
+	return snap, written
+}
+
+func (db *Database) indexRef(mappedIndex index.Index) indexRef {
+	switch mappedIndex {
+	case db.FullIndex:
+		return indexRef{Kind: fullIndexKind}
+	case db.TextIndex:
+		return indexRef{Kind: textIndexKind}
+	default:
+		return indexRef{Kind: splitIndexKind, Name: mappedIndex.Name()}
+	}
+}
+
+func (db *Database) restore(snap *snapshot) error {
+	splitIndexes := make(map[string]*split.Index)
+	for _, splitSnap := range snap.SplitIndexes {
+		splitIndexes[splitSnap.JoinKey] = split.Restore(splitSnap)
+	}
+
+	fullIndex := full.NewIndex()
+	if snap.FullIndex != nil {
+		fullIndex = full.Restore(snap.FullIndex)
+	}
+
+	// the text index is derived entirely from the metric names, so it isn't
+	// stored in the snapshot
+	textIndex := text.NewIndex()
+	textIndex.SetNameLookup(db.metricName)
+	names := make([]string, 0, len(snap.Metrics))
+	hashes := make([]index.Metric, 0, len(snap.Metrics))
+	for hash, metric := range snap.Metrics {
+		if !text.Indexable(metric) {
+			continue
+		}
+		names = append(names, metric)
+		hashes = append(hashes, hash)
+	}
+	if len(names) > 0 {
+		err := textIndex.AddMetrics(names, hashes)
+		if err != nil {
+			return fmt.Errorf("database: could not rebuild text index from snapshot: %s", err)
+		}
+	}
+
+	metrics := snap.Metrics
+	if metrics == nil {
+		metrics = make(map[index.Metric]string)
+	}
+
+	serviceToIndex := make(map[string]index.Index)
+	for service, ref := range snap.Services {
+		switch ref.Kind {
+		case fullIndexKind:
+			serviceToIndex[service] = fullIndex
+		case textIndexKind:
+			serviceToIndex[service] = textIndex
+		case splitIndexKind:
+			si, ok := splitIndexes[ref.Name]
+			if !ok {
+				return fmt.Errorf("database: snapshot maps service %q to split index %q, but there is no such index", service, ref.Name)
+			}
+			serviceToIndex[service] = si
+		default:
+			return fmt.Errorf("database: snapshot maps service %q to an unknown kind of index: %q", service, ref.Kind)
+		}
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	db.serviceIndexMutex.Lock()
+	db.splitMutex.Lock()
+	db.metricsMutex.Lock()
+
+	db.serviceToIndex = serviceToIndex
+	db.splitIndexes = splitIndexes
+	db.metrics = metrics
+	db.FullIndex = fullIndex
+	db.TextIndex = textIndex
+
+	db.metricsMutex.Unlock()
+	db.splitMutex.Unlock()
+	db.serviceIndexMutex.Unlock()
+
+	for service, mappedIndex := range serviceToIndex {
+		db.stats.ServicesByIndex.Set(service, util.ExpString(mappedIndex.Name()))
+	}
+
+	for _, si := range splitIndexes {
+		db.stats.SplitIndexes.Set(fmt.Sprintf("%s-metrics", si.Name()), util.ExpInt(si.MetricSize()))
+		db.stats.SplitIndexes.Set(fmt.Sprintf("%s-tags", si.Name()), util.ExpInt(si.TagSize()))
+	}
+
+	db.stats.FullIndexTags.Set(int64(fullIndex.TagSize()))
+	db.stats.FullIndexMetrics.Set(int64(fullIndex.MetricSize()))
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/index/split"
+	"github.com/kanatohodets/carbonsearch/util/glob"
+)
+
+// TagCounts returns every tag in the database, with the number of join values
+// (for tags in split indexes) or metrics (for custom tags) that have it.
+func (db *Database) TagCounts() map[string]int {
+	db.splitMutex.RLock()
+	splitIndexes := make([]*split.Index, 0, len(db.splitIndexes))
+	for _, si := range db.splitIndexes {
+		splitIndexes = append(splitIndexes, si)
+	}
+	db.splitMutex.RUnlock()
+
+	counts := db.FullIndex.TagCounts()
+	for _, si := range splitIndexes {
+		for tag, count := range si.TagCounts() {
+			counts[tag] += count
+		}
+	}
+	return counts
+}
+
+// TagsVersion changes whenever TagCounts would return something different, so
+// that callers can cache what they make of it.
+func (db *Database) TagsVersion() uint64 {
+	db.splitMutex.RLock()
+	splitIndexes := make([]*split.Index, 0, len(db.splitIndexes))
+	for _, si := range db.splitIndexes {
+		splitIndexes = append(splitIndexes, si)
+	}
+	db.splitMutex.RUnlock()
+
+	version := db.FullIndex.TagVersion()
+	for _, si := range splitIndexes {
+		if v := si.TagVersion(); v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+// NextTags returns the tags matching the glob pattern which would narrow down
+// the metrics selected by a query, without narrowing them down to nothing.
+// With an empty query, every tag matching pattern is returned. This is what
+// lets graphite clients browse the virtual namespace like a tree.
+func (db *Database) NextTags(tagsByService map[string][]string, pattern string) ([]string, error) {
+	re, err := glob.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]bool{}
+	for _, tags := range tagsByService {
+		for _, tag := range tags {
+			selected[tag] = true
+		}
+	}
+
+	// a tag narrows the query down to something exactly when it's on one of
+	// the metrics the query selects, so the candidates are the tags on those
+	var candidates map[string]bool
+	if len(selected) == 0 {
+		candidates = map[string]bool{}
+		for tag := range db.TagCounts() {
+			candidates[tag] = true
+		}
+	} else {
+		metrics, err := db.queryMetrics(tagsByService)
+		if err != nil {
+			return nil, err
+		}
+		candidates = db.reachingTags(metrics)
+	}
+
+	next := []string{}
+	for tag := range candidates {
+		if !selected[tag] && re.MatchString(tag) {
+			next = append(next, tag)
+		}
+	}
+	sort.Strings(next)
+	return next, nil
+}
+
+// reachingTags returns every tag which would select at least one of metrics
+func (db *Database) reachingTags(metrics []index.Metric) map[string]bool {
+	if len(metrics) == 0 {
+		return map[string]bool{}
+	}
+
+	db.splitMutex.RLock()
+	splitIndexes := make([]*split.Index, 0, len(db.splitIndexes))
+	for _, si := range db.splitIndexes {
+		splitIndexes = append(splitIndexes, si)
+	}
+	db.splitMutex.RUnlock()
+
+	tags := db.FullIndex.ReachingTags(metrics)
+	for _, si := range splitIndexes {
+		for tag := range si.ReachingTags(metrics) {
+			tags[tag] = true
+		}
+	}
+	return tags
+}
+
+// MetricTags is the reverse of a query: every tag which would select a metric.
+type MetricTags struct {
+	Metric string `json:"metric"`
+	// by join key, the join values the metric is associated with, and the
+	// tags on each of them
+	Split map[string][]split.JoinTags `json:"split"`
+	// custom tags on the metric itself
+	Full []string `json:"full"`
+}
+
+// TagsForMetric looks up every tag which would select the named metric, and
+// how each one reaches it. This answers "why is this metric in my query?".
+func (db *Database) TagsForMetric(name string) (*MetricTags, error) {
+	metric := index.HashMetric(name)
+	if _, ok := db.metricName(metric); !ok {
+		return nil, fmt.Errorf("database: %q isn't in the database", name)
+	}
+
+	db.splitMutex.RLock()
+	splitIndexes := make(map[string]*split.Index, len(db.splitIndexes))
+	for joinKey, si := range db.splitIndexes {
+		splitIndexes[joinKey] = si
+	}
+	db.splitMutex.RUnlock()
+
+	result := &MetricTags{
+		Metric: name,
+		Split:  map[string][]split.JoinTags{},
+		Full:   db.FullIndex.TagsForMetric(metric),
+	}
+	for joinKey, si := range splitIndexes {
+		joins := si.TagsForMetric(metric)
+		if len(joins) > 0 {
+			result.Split[joinKey] = joins
+		}
+	}
+	return result, nil
+}
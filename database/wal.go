@@ -0,0 +1,172 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/database/wal"
+)
+
+// OpenLog opens the write-ahead log in dir and replays everything in it into
+// the database. It should be called after LoadSnapshot and before any
+// consumers are started. From then on, messages passed to Log are persisted
+// there, and the log is compacted whenever a snapshot is written.
+func (db *Database) OpenLog(dir string) error {
+	l, err := wal.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	replayed, err := l.Replay(db.Apply)
+	if err != nil {
+		l.Close()
+		return fmt.Errorf("database: could not replay write-ahead log in %q: %s", dir, err)
+	}
+
+	log.Printf("database: replayed %d entries from the write-ahead log in %q", replayed, dir)
+	db.stats.LogEntriesReplayed.Add(int64(replayed))
+
+	db.wal = l
+	return nil
+}
+
+// Log durably records a message that has been inserted into the database, so
+// that it survives a restart. If no write-ahead log is open, this does
+// nothing. Messages applied concurrently could be logged in a different order
+// than they were applied, so consumers should use ApplyAndLog instead.
+func (db *Database) Log(msgType string, msg interface{}) error {
+	if db.wal == nil {
+		return nil
+	}
+
+	err := db.wal.Append(msgType, msg)
+	if err != nil {
+		return &LogError{MsgType: msgType, Err: err}
+	}
+
+	db.stats.LogEntriesWritten.Add(1)
+	return nil
+}
+
+// LogError is returned by ApplyAndLog when the message was applied, but
+// couldn't be written to the write-ahead log.
+type LogError struct {
+	MsgType string
+	Err     error
+}
+
+func (e *LogError) Error() string {
+	return fmt.Sprintf("database: could not write %s message to the write-ahead log: %s", e.MsgType, e.Err)
+}
+
+// ApplyAndLog is ApplyFrom followed by Log, as one step, for messages from
+// sources that can't replay them (unlike kafka). If two messages undo each
+// other (an add and a delete, say), replaying the log after a restart has the
+// same result as applying them did.
+func (db *Database) ApplyAndLog(consumer string, msgType string, payload []byte) error {
+	return db.applyAndLog(msgType, payload, func() error {
+		return db.ApplyFrom(consumer, msgType, payload)
+	})
+}
+
+func (db *Database) applyAndLog(msgType string, payload []byte, apply func() error) error {
+	if db.wal == nil {
+		return apply()
+	}
+
+	db.logMutex.Lock()
+	defer db.logMutex.Unlock()
+
+	err := apply()
+	if err != nil {
+		return err
+	}
+	return db.Log(msgType, json.RawMessage(payload))
+}
+
+// CloseLog closes the write-ahead log, if there is one.
+func (db *Database) CloseLog() error {
+	if db.wal == nil {
+		return nil
+	}
+	return db.wal.Close()
+}
+
+// ApplyFrom is Apply for messages from a consumer: the message, and any error
+// applying it, are counted against the consumer's name, and a message which
+// can't be applied becomes a dead letter.
+func (db *Database) ApplyFrom(consumer string, msgType string, payload []byte) error {
+	db.stats.ConsumerMessages.Add(consumer, 1)
+	err := db.Apply(msgType, payload)
+	if err != nil {
+		db.stats.ConsumerErrors.Add(consumer, 1)
+		db.DeadLetter(consumer, msgType, payload, err)
+	}
+	return err
+}
+
+// DecodeError is returned by Apply when the payload isn't a valid message of
+// its type, as opposed to a message the database wouldn't accept.
+type DecodeError struct {
+	MsgType string
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("database: could not decode %s message: %s", e.MsgType, e.Err)
+}
+
+func decode(msgType string, payload []byte, msg interface{}) error {
+	err := json.Unmarshal(payload, msg)
+	if err != nil {
+		return &DecodeError{MsgType: msgType, Err: err}
+	}
+	return nil
+}
+
+// Apply decodes a JSON message of the given type (one of the message.*Type
+// names) and applies it to the database.
+func (db *Database) Apply(msgType string, payload []byte) error {
+	switch msgType {
+	case m.MetricType:
+		msg := &m.KeyMetric{}
+		if err := decode(msgType, payload, msg); err != nil {
+			return err
+		}
+		return db.InsertMetrics(msg)
+	case m.TagType:
+		msg := &m.KeyTag{}
+		if err := decode(msgType, payload, msg); err != nil {
+			return err
+		}
+		return db.InsertTags(msg)
+	case m.CustomType:
+		msg := &m.TagMetric{}
+		if err := decode(msgType, payload, msg); err != nil {
+			return err
+		}
+		return db.InsertCustom(msg)
+	case m.MetricDeleteType:
+		msg := &m.DeleteKeyMetric{}
+		if err := decode(msgType, payload, msg); err != nil {
+			return err
+		}
+		return db.DeleteMetrics(msg)
+	case m.TagDeleteType:
+		msg := &m.DeleteKeyTag{}
+		if err := decode(msgType, payload, msg); err != nil {
+			return err
+		}
+		return db.DeleteTags(msg)
+	case m.CustomDeleteType:
+		msg := &m.DeleteTagMetric{}
+		if err := decode(msgType, payload, msg); err != nil {
+			return err
+		}
+		return db.DeleteCustom(msg)
+	default:
+		return fmt.Errorf("database: unknown message type %q", msgType)
+	}
+}
@@ -0,0 +1,288 @@
+package wal
+
+/*
+
+this package implements a simple write-ahead log for messages that can't be
+recovered from anywhere else (for example, custom tags sent by humans over the
+HTTP consumer: unlike kafka, there's nothing to replay them from).
+
+the log is a directory of numbered segments, each holding one JSON entry per
+line:
+
+	wal-00000000000000000001.log
+	wal-00000000000000000002.log
+
+only the newest segment is ever written to. every Append is fsync'd before
+returning. when a snapshot is taken, the log is rotated first: everything in
+the older segments is then covered by the snapshot, so once the snapshot is
+safely on disk those segments can be compacted away.
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+)
+
+type Entry struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+type Log struct {
+	dir string
+
+	mutex   sync.Mutex
+	file    *os.File
+	current uint64
+}
+
+// Open opens the log stored in dir, creating dir if needed. Writes always go
+// to a new segment, so a torn write at the end of an older segment (from a
+// crash) is never appended to.
+func Open(dir string) (*Log, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("wal: could not create log directory %q: %s", dir, err)
+	}
+
+	l := &Log{dir: dir}
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+
+	err = l.openSegment(next)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append writes one entry to the log and waits for it to reach the disk.
+func (l *Log) Append(entryType string, msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("wal: could not encode %s message: %s", entryType, err)
+	}
+
+	line, err := json.Marshal(&Entry{Type: entryType, Message: payload})
+	if err != nil {
+		return fmt.Errorf("wal: could not encode %s entry: %s", entryType, err)
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("wal: log in %q is closed", l.dir)
+	}
+
+	_, err = l.file.Write(line)
+	if err != nil {
+		return fmt.Errorf("wal: could not write to %q: %s", l.file.Name(), err)
+	}
+
+	err = l.file.Sync()
+	if err != nil {
+		return fmt.Errorf("wal: could not sync %q: %s", l.file.Name(), err)
+	}
+	return nil
+}
+
+// Replay calls apply for every entry in the log, oldest first. A partially
+// written entry at the end of a segment is skipped, since that is what a crash
+// in the middle of Append looks like.
+func (l *Log) Replay(apply func(entryType string, payload []byte) error) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	segments, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, segment := range segments {
+		if segment == l.current {
+			// nothing in the segment we're writing to yet
+			continue
+		}
+
+		count, err := l.replaySegment(segment, apply)
+		replayed += count
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// Rotate starts a new segment and returns its sequence number. Every entry
+// appended before Rotate returns lives in a segment older than that.
+func (l *Log) Rotate() (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.closeSegment()
+	if err != nil {
+		return 0, err
+	}
+
+	err = l.openSegment(l.current + 1)
+	if err != nil {
+		return 0, err
+	}
+	return l.current, nil
+}
+
+// Compact removes every segment older than the given sequence number, as
+// returned by Rotate.
+func (l *Log) Compact(before uint64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if segment >= before {
+			break
+		}
+
+		err := os.Remove(l.segmentPath(segment))
+		if err != nil {
+			return fmt.Errorf("wal: could not remove compacted segment: %s", err)
+		}
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.closeSegment()
+}
+
+func (l *Log) replaySegment(segment uint64, apply func(string, []byte) error) (int, error) {
+	path := l.segmentPath(segment)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("wal: could not read segment %q: %s", path, err)
+	}
+
+	replayed := 0
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(nil, len(raw)+1)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Bytes()
+		entry := &Entry{}
+		err := json.Unmarshal(line, entry)
+		if err != nil {
+			// a torn write can only happen at the very end of a segment
+			if !bytes.HasSuffix(raw, []byte{'\n'}) && bytes.HasSuffix(raw, line) {
+				log.Printf("wal: skipping partially written entry at the end of %q", path)
+				break
+			}
+			return replayed, fmt.Errorf("wal: corrupt entry at %s:%d: %s", path, lineNumber, err)
+		}
+
+		err = apply(entry.Type, entry.Message)
+		if err != nil {
+			log.Printf("wal: could not apply %s entry at %s:%d, skipping: %s", entry.Type, path, lineNumber, err)
+			continue
+		}
+		replayed++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return replayed, fmt.Errorf("wal: could not read segment %q: %s", path, err)
+	}
+	return replayed, nil
+}
+
+func (l *Log) openSegment(segment uint64) error {
+	path := l.segmentPath(segment)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("wal: could not create segment %q: %s", path, err)
+	}
+
+	l.file = f
+	l.current = segment
+	return nil
+}
+
+func (l *Log) closeSegment() error {
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return fmt.Errorf("wal: could not close segment: %s", err)
+	}
+	return nil
+}
+
+func (l *Log) segmentPath(segment uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, segment, segmentSuffix))
+}
+
+// segments returns the sequence numbers of all segments in the log directory,
+// sorted oldest first
+func (l *Log) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("wal: could not list log directory %q: %s", l.dir, err)
+	}
+
+	segments := []uint64{}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		seq := strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix)
+		segment, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+
+	sort.Sort(segmentSlice(segments))
+	return segments, nil
+}
+
+type segmentSlice []uint64
+
+func (a segmentSlice) Len() int           { return len(a) }
+func (a segmentSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a segmentSlice) Less(i, j int) bool { return a[i] < a[j] }
@@ -0,0 +1,168 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type testMessage struct {
+	Value string
+}
+
+func replayAll(t *testing.T, l *Log) []string {
+	values := []string{}
+	_, err := l.Replay(func(entryType string, payload []byte) error {
+		values = append(values, entryType+":"+string(payload))
+		return nil
+	})
+	if err != nil {
+		t.Errorf("wal test: replay returned an error: %s", err)
+	}
+	return values
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "carbonsearch-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, value := range []string{"foo", "bar"} {
+		err := l.Append("tag", &testMessage{value})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	l.Close()
+
+	l, err = Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer l.Close()
+
+	expected := []string{`tag:{"Value":"foo"}`, `tag:{"Value":"bar"}`}
+	got := replayAll(t, l)
+	if len(got) != len(expected) {
+		t.Errorf("wal test: expected to replay %q, but got %q", expected, got)
+		return
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("wal test: expected entry %d to be %q, but got %q", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestTornWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = l.Append("custom", &testMessage{"foo"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// simulate a crash halfway through writing an entry
+	l.file.Write([]byte(`{"type":"custom","mess`))
+	l.Close()
+
+	l, err = Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer l.Close()
+
+	got := replayAll(t, l)
+	if len(got) != 1 || got[0] != `custom:{"Value":"foo"}` {
+		t.Errorf("wal test: expected the torn entry to be skipped, but replay gave %q", got)
+	}
+}
+
+func TestCorruptEntry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	l.file.Write([]byte("blorg\n"))
+	l.Append("custom", &testMessage{"foo"})
+	l.Close()
+
+	l, err = Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer l.Close()
+
+	_, err = l.Replay(func(string, []byte) error { return nil })
+	if err == nil {
+		t.Error("wal test: a corrupt entry in the middle of a segment should be an error")
+	}
+}
+
+func TestRotateCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	l.Append("tag", &testMessage{"before"})
+	checkpoint, err := l.Rotate()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	l.Append("tag", &testMessage{"after"})
+
+	err = l.Compact(checkpoint)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	l.Close()
+
+	l, err = Open(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer l.Close()
+
+	got := replayAll(t, l)
+	if len(got) != 1 || got[0] != `tag:{"Value":"after"}` {
+		t.Errorf("wal test: expected only the entry after the checkpoint to survive compaction, but replay gave %q", got)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+// inspecting and replaying messages from consumers which couldn't be applied:
+//
+//	/admin/deadletters                  the most recent dead letters, oldest first
+//	/admin/deadletters?id=3&id=4        just those ones
+//	/admin/deadletters/replay           (POST) apply them all again
+//	/admin/deadletters/replay?id=3      (POST) apply just that one again
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kanatohodets/carbonsearch/database/deadletter"
+)
+
+// deadLetterSink picks where dead letters are sent, besides being kept in
+// memory: a file, a kafka topic, or nowhere
+func deadLetterSink(path string, brokerList []string, topic string) (deadletter.Sink, error) {
+	switch {
+	case path != "" && topic != "":
+		return nil, fmt.Errorf("dead letters can go to a file or a kafka topic, but not both")
+	case path != "":
+		sink, err := deadletter.NewFileSink(path)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	case topic != "":
+		sink, err := deadletter.NewKafkaSink(brokerList, topic)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	}
+	return nil, nil
+}
+
+// deadLetterIDs reads the 'id' url params
+func deadLetterIDs(req *http.Request) ([]uint64, error) {
+	ids := []uint64{}
+	for _, raw := range req.URL.Query()["id"] {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("req validation: 'id' should be a dead letter id, but it is %q", raw)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func deadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	queue := db.DeadLetters()
+	if queue == nil {
+		http.Error(w, "dead letters aren't enabled: see dead_letters in the config", http.StatusNotFound)
+		return
+	}
+
+	ids, err := deadLetterIDs(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(queue.Letters(ids...))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func replayDeadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "replaying dead letters needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ids, err := deadLetterIDs(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ReplayDeadLetters(ids...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
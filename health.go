@@ -0,0 +1,91 @@
+package main
+
+// health checks, for load balancers and orchestrators:
+//
+//	/health/live     200 as long as the process is serving HTTP
+//	/health/ready    200 once every consumer has caught up, 503 until then
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kanatohodets/carbonsearch/consumer"
+)
+
+// readiness tracks whether carbonsearch has caught up with its consumers, and
+// so whether query results are complete. Once it's ready it stays that way:
+// falling behind later (say, during a kafka rebalance) doesn't make results
+// that were good a moment ago worth refusing.
+type readiness struct {
+	// the consumers running right now
+	consumers func() []consumer.Consumer
+	ready     int32
+}
+
+func newReadiness(consumers func() []consumer.Consumer) *readiness {
+	return &readiness{consumers: consumers}
+}
+
+// Ready reports whether every consumer has caught up, and the names of any
+// which haven't.
+func (r *readiness) Ready() (bool, []string) {
+	if atomic.LoadInt32(&r.ready) == 1 {
+		return true, nil
+	}
+
+	waiting := []string{}
+	for _, c := range r.consumers() {
+		if !c.CaughtUp() {
+			waiting = append(waiting, c.Name())
+		}
+	}
+	if len(waiting) > 0 {
+		return false, waiting
+	}
+
+	if atomic.CompareAndSwapInt32(&r.ready, 0, 1) {
+		log.Println("every consumer has caught up: carbonsearch is ready")
+	}
+	return true, nil
+}
+
+// unready answers with a 503 if carbonsearch isn't ready yet, and reports
+// whether it did
+func (r *readiness) unready(w http.ResponseWriter) bool {
+	ready, waiting := r.Ready()
+	if ready {
+		return false
+	}
+
+	err := fmt.Errorf("not ready: still catching up with consumers: %s", strings.Join(waiting, ", "))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// gate wraps a handler which answers from the index, so that if required is
+// set, it answers with a 503 until carbonsearch is ready
+func (r *readiness) gate(required bool, handler http.HandlerFunc) http.HandlerFunc {
+	if !required {
+		return handler
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.unready(w) {
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func liveHandler(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (r *readiness) readyHandler(w http.ResponseWriter, req *http.Request) {
+	if r.unready(w) {
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
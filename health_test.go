@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kanatohodets/carbonsearch/consumer"
+)
+
+// catchingUp is a consumer which has caught up once caughtUp is set
+type catchingUp struct {
+	reloadConsumer
+	caughtUp bool
+}
+
+func (c *catchingUp) CaughtUp() bool { return c.caughtUp }
+
+func TestGate(t *testing.T) {
+	c := &catchingUp{reloadConsumer: reloadConsumer{name: "test"}}
+	ready := newReadiness(func() []consumer.Consumer {
+		return []consumer.Consumer{c}
+	})
+
+	ok := func(w http.ResponseWriter, req *http.Request) {}
+	status := func(handler http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/tags", nil))
+		return w.Code
+	}
+
+	if code := status(ready.gate(false, ok)); code != http.StatusOK {
+		t.Errorf("main test: expected a 200 while catching up without require_ready, but got %d", code)
+	}
+	if code := status(ready.gate(true, ok)); code != http.StatusServiceUnavailable {
+		t.Errorf("main test: expected a 503 while catching up with require_ready, but got %d", code)
+	}
+
+	c.caughtUp = true
+	if code := status(ready.gate(true, ok)); code != http.StatusOK {
+		t.Errorf("main test: expected a 200 once caught up with require_ready, but got %d", code)
+	}
+}
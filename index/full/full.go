@@ -2,24 +2,52 @@ package full
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/util/glob"
 )
 
+type tagMetric struct {
+	tag    index.Tag
+	metric index.Metric
+}
+
 type Index struct {
-	index      map[index.Tag][]index.Metric
+	index map[index.Tag][]index.Metric
+	// the reverse of index. a metric leaves the index when it has no tags left
+	metricToTag map[index.Metric][]index.Tag
+	// unix time each tag -> metric association was last added, for expiry
+	seen map[tagMetric]int64
+	// tag strings for every tag in the index, so they can be matched by glob
+	tagNames map[index.Tag]string
+	// from index.NextVersion, whenever the tags or their metric counts change
+	tagVersion uint64
 	mutex      sync.RWMutex
 	tagSize    int
 	metricSize int
+
+	now func() int64
 }
 
 func NewIndex() *Index {
 	return &Index{
-		index: make(map[index.Tag][]index.Metric),
+		index:       make(map[index.Tag][]index.Metric),
+		metricToTag: make(map[index.Metric][]index.Tag),
+		seen:        make(map[tagMetric]int64),
+		tagNames:    make(map[index.Tag]string),
+		tagVersion:  index.NextVersion(),
+
+		now: unixNow,
 	}
 }
 
+func unixNow() int64 {
+	return time.Now().Unix()
+}
+
 func (fi *Index) Add(tags []index.Tag, metrics []index.Metric) error {
 	fi.mutex.Lock()
 	defer fi.mutex.Unlock()
@@ -32,6 +60,7 @@ func (fi *Index) Add(tags []index.Tag, metrics []index.Metric) error {
 		return fmt.Errorf("full index: can't associate metrics with 0 tags")
 	}
 
+	now := fi.now()
 	for _, tag := range tags {
 		associatedMetrics, ok := fi.index[tag]
 		if !ok {
@@ -46,9 +75,14 @@ func (fi *Index) Add(tags []index.Tag, metrics []index.Metric) error {
 		}
 
 		for _, metric := range metrics {
+			fi.seen[tagMetric{tag, metric}] = now
+
 			_, ok := existingMember[metric]
 			if !ok {
+				existingMember[metric] = true
 				fi.metricSize++
+				fi.tagVersion = index.NextVersion()
+				fi.addTagToMetric(metric, tag)
 				associatedMetrics = append(associatedMetrics, metric)
 			}
 		}
@@ -58,22 +92,376 @@ func (fi *Index) Add(tags []index.Tag, metrics []index.Metric) error {
 	return nil
 }
 
+// Remove disassociates metrics from tags. It returns the metrics which no
+// longer have any tags in this index.
+func (fi *Index) Remove(tags []index.Tag, metrics []index.Metric) ([]index.Metric, error) {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("full index: can't remove 0 metrics from tags")
+	}
+
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("full index: can't remove metrics from 0 tags")
+	}
+
+	removed := make(map[index.Metric]bool)
+	for _, metric := range metrics {
+		removed[metric] = true
+	}
+
+	orphans := []index.Metric{}
+	for _, tag := range tags {
+		associatedMetrics, ok := fi.index[tag]
+		if !ok {
+			continue
+		}
+
+		remaining := make([]index.Metric, 0, len(associatedMetrics))
+		for _, metric := range associatedMetrics {
+			if !removed[metric] {
+				remaining = append(remaining, metric)
+				continue
+			}
+
+			if fi.releaseMetric(tag, metric) {
+				orphans = append(orphans, metric)
+			}
+		}
+		fi.setTag(tag, remaining)
+	}
+	return orphans, nil
+}
+
+// RemoveTags drops tags from the index entirely. It returns the metrics which
+// no longer have any tags in this index.
+func (fi *Index) RemoveTags(tags []index.Tag) ([]index.Metric, error) {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("full index: can't remove 0 tags")
+	}
+
+	orphans := []index.Metric{}
+	for _, tag := range tags {
+		for _, metric := range fi.index[tag] {
+			if fi.releaseMetric(tag, metric) {
+				orphans = append(orphans, metric)
+			}
+		}
+		fi.setTag(tag, nil)
+	}
+	return orphans, nil
+}
+
+// the caller must hold the lock
+func (fi *Index) setTag(tag index.Tag, metrics []index.Metric) {
+	_, ok := fi.index[tag]
+	if len(metrics) == 0 {
+		if ok {
+			fi.tagSize--
+			delete(fi.index, tag)
+			delete(fi.tagNames, tag)
+		}
+		return
+	}
+
+	if !ok {
+		fi.tagSize++
+	}
+	fi.index[tag] = metrics
+}
+
+// the caller must hold the lock
+func (fi *Index) addTagToMetric(metric index.Metric, tag index.Tag) {
+	tagList := append(fi.metricToTag[metric], tag)
+	index.SortTags(tagList)
+	fi.metricToTag[metric] = tagList
+}
+
+// releaseMetric drops one tag's reference to a metric, and reports whether
+// that was the last one. The caller must hold the lock.
+func (fi *Index) releaseMetric(tag index.Tag, metric index.Metric) bool {
+	delete(fi.seen, tagMetric{tag, metric})
+	fi.metricSize--
+	fi.tagVersion = index.NextVersion()
+
+	tagList := fi.metricToTag[metric]
+	remaining := make([]index.Tag, 0, len(tagList))
+	for _, existingTag := range tagList {
+		if existingTag != tag {
+			remaining = append(remaining, existingTag)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(fi.metricToTag, metric)
+		return true
+	}
+	fi.metricToTag[metric] = remaining
+	return false
+}
+
+// Expire removes every association which was last added before the given
+// unix time. It returns how many associations were removed, and the metrics
+// which no longer have any tags in this index.
+func (fi *Index) Expire(before int64) (int, []index.Metric) {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	expiredByTag := map[index.Tag]map[index.Metric]bool{}
+	for association, seen := range fi.seen {
+		if seen >= before {
+			continue
+		}
+
+		expired, ok := expiredByTag[association.tag]
+		if !ok {
+			expired = map[index.Metric]bool{}
+			expiredByTag[association.tag] = expired
+		}
+		expired[association.metric] = true
+	}
+
+	count := 0
+	orphans := []index.Metric{}
+	for tag, expired := range expiredByTag {
+		associatedMetrics := fi.index[tag]
+		remaining := make([]index.Metric, 0, len(associatedMetrics))
+		for _, metric := range associatedMetrics {
+			if !expired[metric] {
+				remaining = append(remaining, metric)
+				continue
+			}
+
+			count++
+			if fi.releaseMetric(tag, metric) {
+				orphans = append(orphans, metric)
+			}
+		}
+		fi.setTag(tag, remaining)
+	}
+	return count, orphans
+}
+
+// HasMetric reports whether a metric has any tags in the index.
+func (fi *Index) HasMetric(metric index.Metric) bool {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+	return len(fi.metricToTag[metric]) > 0
+}
+
+// TagsForMetric returns the sorted tags that the metric has. It's the reverse
+// of a query: any of these tags would select the metric.
+func (fi *Index) TagsForMetric(metric index.Metric) []string {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+
+	tags := []string{}
+	for _, tag := range fi.metricToTag[metric] {
+		// tags are only missing a name if they came from an old snapshot
+		name, ok := fi.tagNames[tag]
+		if ok {
+			tags = append(tags, name)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// ReachingTags returns the names of every tag which would select at least
+// one of metrics, by way of the reverse map.
+func (fi *Index) ReachingTags(metrics []index.Metric) map[string]bool {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+
+	tags := map[string]bool{}
+	for _, metric := range metrics {
+		for _, tag := range fi.metricToTag[metric] {
+			name, ok := fi.tagNames[tag]
+			if ok {
+				tags[name] = true
+			}
+		}
+	}
+	return tags
+}
+
+// NameTags records the strings for tags which are in the index, so that
+// queries can match them with globs like 'custom-favorites:*'.
+func (fi *Index) NameTags(tags []string) {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+
+	for _, tag := range tags {
+		hash := index.HashTag(tag)
+		if _, ok := fi.index[hash]; ok && fi.tagNames[hash] != tag {
+			fi.tagNames[hash] = tag
+			fi.tagVersion = index.NextVersion()
+		}
+	}
+}
+
+// TagVersion changes whenever TagCounts would return something different.
+func (fi *Index) TagVersion() uint64 {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+	return fi.tagVersion
+}
+
+// TagCounts returns every tag in the index, with the number of metrics that
+// have it.
+func (fi *Index) TagCounts() map[string]int {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+
+	counts := make(map[string]int, len(fi.tagNames))
+	for tag, name := range fi.tagNames {
+		counts[name] = len(fi.index[tag])
+	}
+	return counts
+}
+
 func (fi *Index) Query(q *index.Query) ([]index.Metric, error) {
 	fi.mutex.RLock()
 	defer fi.mutex.RUnlock()
 
+	if len(q.Hashed) == 0 && len(q.NegatedHashed) > 0 {
+		return nil, fmt.Errorf("full index: a query needs at least one tag that isn't negated")
+	}
+
 	metricSets := make([][]index.Metric, len(q.Hashed))
 	for pos, tag := range q.Hashed {
+		if glob.IsGlob(q.Raw[pos]) {
+			list, err := fi.globMetrics(q.Raw[pos])
+			if err != nil {
+				return nil, err
+			}
+			metricSets[pos] = list
+			continue
+		}
 		metricSets[pos] = fi.index[tag]
 	}
 
-	return index.IntersectMetrics(metricSets), nil
+	metrics := index.IntersectMetrics(metricSets)
+	if len(q.NegatedHashed) == 0 {
+		return metrics, nil
+	}
+
+	excluded := [][]index.Metric{}
+	for pos, tag := range q.NegatedHashed {
+		list := fi.index[tag]
+		if glob.IsGlob(q.NegatedRaw[pos]) {
+			var err error
+			list, err = fi.globMetrics(q.NegatedRaw[pos])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(list) > 0 {
+			excluded = append(excluded, list)
+		}
+	}
+
+	return index.DifferenceMetrics(metrics, index.UnionMetrics(excluded)), nil
+}
+
+// globMetrics returns the union of the metrics for every tag matching
+// pattern. The caller must hold the lock.
+func (fi *Index) globMetrics(pattern string) ([]index.Metric, error) {
+	tags, err := index.MatchTags(pattern, fi.tagNames)
+	if err != nil {
+		return nil, fmt.Errorf("full index: %s", err)
+	}
+
+	metricSets := make([][]index.Metric, 0, len(tags))
+	for _, tag := range tags {
+		list := fi.index[tag]
+		if len(list) > 0 {
+			metricSets = append(metricSets, list)
+		}
+	}
+	return index.UnionMetrics(metricSets), nil
 }
 
 func (fi *Index) Name() string {
 	return "full index"
 }
 
+// Snapshot is a point-in-time copy of a full index, suitable for serializing
+// to disk.
+type Snapshot struct {
+	Index map[index.Tag][]index.Metric
+	// when each association was last added, in the same order as the Index lists
+	Seen map[index.Tag][]int64
+
+	TagNames map[index.Tag]string
+}
+
+// Snapshot copies the index. The metric lists are copied so that writes after
+// this returns don't touch the snapshot.
+func (fi *Index) Snapshot() *Snapshot {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+
+	snap := &Snapshot{
+		Index: make(map[index.Tag][]index.Metric, len(fi.index)),
+		Seen:  make(map[index.Tag][]int64, len(fi.index)),
+
+		TagNames: make(map[index.Tag]string, len(fi.tagNames)),
+	}
+	for tag, name := range fi.tagNames {
+		snap.TagNames[tag] = name
+	}
+	for tag, metrics := range fi.index {
+		snap.Index[tag] = append([]index.Metric(nil), metrics...)
+		seen := make([]int64, len(metrics))
+		for i, metric := range metrics {
+			seen[i] = fi.seen[tagMetric{tag, metric}]
+		}
+		snap.Seen[tag] = seen
+	}
+	return snap
+}
+
+// Restore builds a new index from a snapshot. The snapshot must not be used
+// afterwards, since the index takes ownership of its map.
+func Restore(snap *Snapshot) *Index {
+	fi := NewIndex()
+	// snapshots without timestamps get a fresh lease on life
+	now := fi.now()
+
+	for tag, metrics := range snap.Index {
+		seen := snap.Seen[tag]
+		for i, metric := range metrics {
+			fi.metricToTag[metric] = append(fi.metricToTag[metric], tag)
+			if i < len(seen) {
+				fi.seen[tagMetric{tag, metric}] = seen[i]
+			} else {
+				fi.seen[tagMetric{tag, metric}] = now
+			}
+		}
+
+		index.SortMetrics(metrics)
+		fi.index[tag] = metrics
+		fi.tagSize++
+		fi.metricSize += len(metrics)
+
+		name, ok := snap.TagNames[tag]
+		if ok {
+			fi.tagNames[tag] = name
+		}
+	}
+
+	for _, tags := range fi.metricToTag {
+		index.SortTags(tags)
+	}
+	return fi
+}
+
 func (fi *Index) TagSize() int {
 	// or convert fi.size to an atomic
 	fi.mutex.RLock()
@@ -36,3 +36,175 @@ func TestQuery(t *testing.T) {
 		t.Errorf("full index text: found some results on a bogus query: %v", emptyResult)
 	}
 }
+
+func TestNegatedQuery(t *testing.T) {
+	metrics := index.HashMetrics([]string{"server.hostname-1234", "server.hostname-1235"})
+	in := NewIndex()
+
+	in.Add(index.HashTags([]string{"custom-favorites:tester"}), metrics)
+	in.Add(index.HashTags([]string{"custom-broken:true"}), metrics[:1])
+
+	result, err := in.Query(index.NewQuery([]string{"custom-favorites:tester", "!custom-broken:true"}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 1 || result[0] != metrics[1] {
+		t.Errorf("full index test: expected only %v, but got %v", metrics[1], result)
+	}
+
+	result, _ = in.Query(index.NewQuery([]string{"custom-favorites:tester", "!blorgtag"}))
+	if len(result) != 2 {
+		t.Errorf("full index test: negating an unknown tag should exclude nothing, but got %v", result)
+	}
+}
+
+func TestGlobQuery(t *testing.T) {
+	metrics := index.HashMetrics([]string{"server.hostname-1234", "server.hostname-1235", "server.hostname-1236"})
+	in := NewIndex()
+
+	byTag := map[string][]index.Metric{
+		"custom-favorites:alice": metrics[:1],
+		"custom-favorites:bob":   metrics[1:2],
+		"custom-broken:true":     metrics[2:],
+	}
+	for tag, tagMetrics := range byTag {
+		in.Add(index.HashTags([]string{tag}), tagMetrics)
+		in.NameTags([]string{tag})
+	}
+
+	result, err := in.Query(index.NewQuery([]string{"custom-favorites:*"}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result) != 2 {
+		t.Errorf("full index test: expected 'custom-favorites:*' to match 2 metrics, but got %v", result)
+	}
+
+	result, _ = in.Query(index.NewQuery([]string{"custom-favorites:{alice,carol}"}))
+	if len(result) != 1 || result[0] != metrics[0] {
+		t.Errorf("full index test: expected only %v, but got %v", metrics[0], result)
+	}
+
+	result, _ = in.Query(index.NewQuery([]string{"custom-favorites:nobody*"}))
+	if len(result) != 0 {
+		t.Errorf("full index test: a glob matching no tags should match no metrics, but got %v", result)
+	}
+
+	_, err = in.Query(index.NewQuery([]string{"custom-favorites:{alice"}))
+	if err == nil {
+		t.Errorf("full index test: an invalid glob should be an error")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	metrics := index.HashMetrics([]string{"server.hostname-1234", "server.hostname-1235"})
+	tags := index.HashTags([]string{"custom-favorites:tester", "custom-foo:bar"})
+	in := NewIndex()
+
+	in.Add(tags, metrics)
+
+	orphans, err := in.Remove(tags[:1], metrics[:1])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(orphans) != 0 {
+		t.Errorf("full index test: metric still has a tag, but was orphaned: %v", orphans)
+	}
+
+	result, _ := in.Query(index.NewQuery([]string{"custom-favorites:tester"}))
+	if len(result) != 1 || result[0] != metrics[1] {
+		t.Errorf("full index test: expected only %v after removal, but got %v", metrics[1], result)
+	}
+
+	orphans, err = in.RemoveTags(tags[1:])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(orphans) != 1 || orphans[0] != metrics[0] {
+		t.Errorf("full index test: expected %v to be orphaned, but got %v", metrics[0], orphans)
+	}
+	if in.HasMetric(metrics[0]) || !in.HasMetric(metrics[1]) {
+		t.Errorf("full index test: HasMetric is wrong after removing tags")
+	}
+	if in.TagSize() != 1 || in.MetricSize() != 1 {
+		t.Errorf("full index test: expected 1 tag and 1 metric, but the index has %d and %d", in.TagSize(), in.MetricSize())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	metrics := index.HashMetrics([]string{"server.hostname-1234", "server.hostname-1235"})
+	tags := index.HashTags([]string{"custom-favorites:tester"})
+	in := NewIndex()
+	clock := int64(100)
+	in.now = func() int64 { return clock }
+
+	in.Add(tags, metrics)
+	clock = 200
+	in.Add(tags, metrics[1:])
+
+	count, orphans := in.Expire(150)
+	if count != 1 || len(orphans) != 1 || orphans[0] != metrics[0] {
+		t.Errorf("full index test: expected only %v to expire, but %d did, orphaning %v", metrics[0], count, orphans)
+	}
+
+	count, _ = in.Expire(250)
+	if count != 1 || in.TagSize() != 0 || in.MetricSize() != 0 {
+		t.Errorf("full index test: expected everything to expire, but %d expired, leaving %d tags and %d metrics", count, in.TagSize(), in.MetricSize())
+	}
+}
+
+func TestTagsForMetric(t *testing.T) {
+	metrics := index.HashMetrics([]string{"server.hostname-1234", "server.hostname-1235"})
+	in := NewIndex()
+
+	tags := []string{"custom-favorites:tester", "custom-broken:true"}
+	in.Add(index.HashTags(tags[:1]), metrics)
+	in.Add(index.HashTags(tags[1:]), metrics[:1])
+	in.NameTags(tags)
+
+	check := func(in *Index, desc string) {
+		result := in.TagsForMetric(metrics[0])
+		if len(result) != 2 || result[0] != "custom-broken:true" || result[1] != "custom-favorites:tester" {
+			t.Errorf("full index test: %s: expected both tags, but got %v", desc, result)
+		}
+	}
+
+	check(in, "fresh index")
+	check(Restore(in.Snapshot()), "restored index")
+
+	in.Remove(index.HashTags(tags[1:]), metrics[:1])
+	result := in.TagsForMetric(metrics[0])
+	if len(result) != 1 || result[0] != "custom-favorites:tester" {
+		t.Errorf("full index test: expected only custom-favorites:tester after removing custom-broken:true, but got %v", result)
+	}
+
+	in.RemoveTags(index.HashTags(tags[:1]))
+	if result := in.TagsForMetric(metrics[0]); len(result) != 0 {
+		t.Errorf("full index test: expected no tags after removing them all, but got %v", result)
+	}
+}
+
+func TestReachingTags(t *testing.T) {
+	metrics := index.HashMetrics([]string{"server.hostname-1234", "server.hostname-1235", "server.hostname-1236"})
+	in := NewIndex()
+
+	tags := []string{"custom-favorites:tester", "custom-broken:true", "custom-favorites:other"}
+	in.Add(index.HashTags(tags[:1]), metrics[:2])
+	in.Add(index.HashTags(tags[1:2]), metrics[:1])
+	in.Add(index.HashTags(tags[2:]), metrics[2:])
+	in.NameTags(tags)
+
+	result := in.ReachingTags(metrics[1:2])
+	if len(result) != 1 || !result["custom-favorites:tester"] {
+		t.Errorf("full index test: expected only custom-favorites:tester to reach the second metric, but got %v", result)
+	}
+
+	result = in.ReachingTags(metrics)
+	if len(result) != 3 {
+		t.Errorf("full index test: expected every tag to reach all of the metrics, but got %v", result)
+	}
+}
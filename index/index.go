@@ -3,8 +3,11 @@ package index
 import (
 	"container/heap"
 	"sort"
+	"strings"
+	"sync/atomic"
 
 	"github.com/kanatohodets/carbonsearch/util"
+	"github.com/kanatohodets/carbonsearch/util/glob"
 )
 
 type Metric uint64
@@ -21,24 +24,53 @@ func (a TagSlice) Len() int           { return len(a) }
 func (a TagSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a TagSlice) Less(i, j int) bool { return a[i] < a[j] }
 
+// NegationPrefix marks a query tag as excluding metrics, rather than
+// selecting them: "!server-state:maint".
+const NegationPrefix = "!"
+
 type Query struct {
 	Raw    []string
 	Hashed []Tag
+
+	// tags the results must not have, without the NegationPrefix
+	NegatedRaw    []string
+	NegatedHashed []Tag
 }
 
 func NewQuery(raw []string) *Query {
-	hashed := HashTags(raw)
-	return &Query{
-		Raw:    raw,
-		Hashed: hashed,
+	q := &Query{
+		Raw:           []string{},
+		Hashed:        []Tag{},
+		NegatedRaw:    []string{},
+		NegatedHashed: []Tag{},
 	}
+	q.AddTags(raw)
+	return q
 }
 
 //TODO(btyler) -- think about whether this should dedupe
 func (q *Query) AddTags(raw []string) {
-	hashed := HashTags(raw)
-	q.Raw = append(q.Raw, raw...)
-	q.Hashed = append(q.Hashed, hashed...)
+	for _, tag := range raw {
+		if strings.HasPrefix(tag, NegationPrefix) {
+			tag = strings.TrimPrefix(tag, NegationPrefix)
+			q.NegatedRaw = append(q.NegatedRaw, tag)
+			q.NegatedHashed = append(q.NegatedHashed, HashTag(tag))
+		} else {
+			q.Raw = append(q.Raw, tag)
+			q.Hashed = append(q.Hashed, HashTag(tag))
+		}
+	}
+}
+
+// the last version handed out by NextVersion
+var lastVersion uint64
+
+// NextVersion returns a number bigger than any it has returned before. An
+// index takes a new one whenever its tags change, so the largest version of
+// any index changes whenever any of their tags do, even if an index is
+// replaced by one restored from a snapshot.
+func NextVersion() uint64 {
+	return atomic.AddUint64(&lastVersion, 1)
 }
 
 type Index interface {
@@ -46,6 +78,25 @@ type Index interface {
 	Name() string
 }
 
+// MatchTags returns the tags in names (a dictionary of hashed tags back to the
+// tag strings) which match the glob pattern.
+func MatchTags(pattern string, names map[Tag]string) ([]Tag, error) {
+	re, err := glob.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// cheap check first: most tags won't even share the service and key
+	literal := glob.Literal(pattern)
+	matches := []Tag{}
+	for tag, name := range names {
+		if strings.HasPrefix(name, literal) && re.MatchString(name) {
+			matches = append(matches, tag)
+		}
+	}
+	return matches, nil
+}
+
 func HashTag(tag string) Tag {
 	return Tag(util.HashStr64(tag))
 }
@@ -159,6 +210,26 @@ func IntersectMetrics(metricSets [][]Metric) []Metric {
 	}
 }
 
+// DifferenceMetrics returns the metrics in the sorted set 'from' which aren't in
+// the sorted set 'remove'.
+func DifferenceMetrics(from, remove []Metric) []Metric {
+	set := []Metric{}
+	i, j := 0, 0
+	for i < len(from) {
+		if j == len(remove) || from[i] < remove[j] {
+			if len(set) == 0 || set[len(set)-1] != from[i] {
+				set = append(set, from[i])
+			}
+			i++
+		} else if from[i] > remove[j] {
+			j++
+		} else {
+			i++
+		}
+	}
+	return set
+}
+
 func SortTags(tags []Tag) {
 	sort.Sort(TagSlice(tags))
 }
@@ -222,6 +222,35 @@ func intersectMetricTest(t *testing.T, testName string, rawSets [][]string, expe
 	metricSetFuncTest(t, testName, IntersectMetrics, rawSets, expectedResults)
 }
 
+func TestDifferenceMetrics(t *testing.T) {
+	differenceMetricTest(t, "basic difference", [][]string{
+		{"foo", "bar", "baz"},
+		{"qux", "bar"},
+	}, []string{"foo", "baz"})
+
+	differenceMetricTest(t, "remove nothing", [][]string{
+		{"foo", "bar"},
+		{},
+	}, []string{"foo", "bar"})
+
+	differenceMetricTest(t, "remove everything", [][]string{
+		{"foo", "bar"},
+		{"bar", "foo", "baz"},
+	}, []string{})
+
+	differenceMetricTest(t, "empty universe", [][]string{
+		{},
+		{"foo"},
+	}, []string{})
+}
+
+func differenceMetricTest(t *testing.T, testName string, rawSets [][]string, expectedResults []string) {
+	difference := func(metricSets [][]Metric) []Metric {
+		return DifferenceMetrics(metricSets[0], metricSets[1])
+	}
+	metricSetFuncTest(t, testName, difference, rawSets, expectedResults)
+}
+
 // TODO(btyler): check that the testFunc returns things in correctly sorted order
 func metricSetFuncTest(t *testing.T, testName string, testFunc func([][]Metric) []Metric, rawSets [][]string, expectedResults []string) {
 	mapping := map[Metric]string{}
@@ -35,9 +35,11 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/kanatohodets/carbonsearch/index"
 	"github.com/kanatohodets/carbonsearch/util"
+	"github.com/kanatohodets/carbonsearch/util/glob"
 )
 
 type Join uint64
@@ -47,16 +49,44 @@ func (a JoinSlice) Len() int           { return len(a) }
 func (a JoinSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a JoinSlice) Less(i, j int) bool { return a[i] < a[j] }
 
+type tagJoin struct {
+	tag  index.Tag
+	join Join
+}
+
+type joinMetric struct {
+	join   Join
+	metric index.Metric
+}
+
 type Index struct {
 	joinKey string
 
 	tagToJoin map[index.Tag][]Join
-	tagMutex  sync.RWMutex
-	tagCount  int
+	// the reverse of tagToJoin, so a join's tags can be found without a full scan
+	joinToTag map[Join][]index.Tag
+	// unix time each tag -> join association was last added, for expiry
+	tagSeen map[tagJoin]int64
+	// tag strings for every tag in tagToJoin, so they can be matched by glob
+	tagNames map[index.Tag]string
+	// from index.NextVersion, whenever the tags or their join counts change
+	tagVersion uint64
+	tagMutex   sync.RWMutex
+	tagCount   int
 
 	joinToMetric map[Join][]index.Metric
-	metricMutex  sync.RWMutex
-	metricCount  int
+	// the reverse of joinToMetric. a metric leaves the index when it has no
+	// joins left
+	metricToJoin map[index.Metric][]Join
+	// join strings for every join in joinToMetric, so that reverse lookups can
+	// say which join value a metric came from
+	joinNames map[Join]string
+	// unix time each join -> metric association was last added, for expiry
+	metricSeen  map[joinMetric]int64
+	metricMutex sync.RWMutex
+	metricCount int
+
+	now func() int64
 }
 
 func NewIndex(joinKey string) *Index {
@@ -64,11 +94,25 @@ func NewIndex(joinKey string) *Index {
 		joinKey: joinKey,
 
 		tagToJoin: make(map[index.Tag][]Join),
+		joinToTag: make(map[Join][]index.Tag),
+		tagSeen:   make(map[tagJoin]int64),
+		tagNames:  make(map[index.Tag]string),
+
+		tagVersion: index.NextVersion(),
 
 		joinToMetric: make(map[Join][]index.Metric),
+		metricToJoin: make(map[index.Metric][]Join),
+		joinNames:    make(map[Join]string),
+		metricSeen:   make(map[joinMetric]int64),
+
+		now: unixNow,
 	}
 }
 
+func unixNow() int64 {
+	return time.Now().Unix()
+}
+
 func (si *Index) AddMetrics(rawJoin string, metrics []index.Metric) error {
 	if len(metrics) == 0 {
 		return fmt.Errorf("split index: cannot add 0 metrics to join %q", rawJoin)
@@ -84,6 +128,7 @@ func (si *Index) AddMetrics(rawJoin string, metrics []index.Metric) error {
 		metricList = []index.Metric{}
 		si.joinToMetric[join] = metricList
 	}
+	si.joinNames[join] = rawJoin
 
 	existingMember := make(map[index.Metric]bool)
 
@@ -91,10 +136,15 @@ func (si *Index) AddMetrics(rawJoin string, metrics []index.Metric) error {
 		existingMember[metric] = true
 	}
 
+	now := si.now()
 	for _, metric := range metrics {
+		si.metricSeen[joinMetric{join, metric}] = now
+
 		_, ok := existingMember[metric]
 		if !ok {
+			existingMember[metric] = true
 			si.metricCount++
+			si.addMetricToJoin(metric, join)
 			metricList = append(metricList, metric)
 		}
 	}
@@ -115,66 +165,717 @@ func (si *Index) AddTags(rawJoin string, tags []index.Tag) error {
 	si.tagMutex.Lock()
 	defer si.tagMutex.Unlock()
 
+	now := si.now()
+	for _, tag := range tags {
+		si.addJoinToTag(tag, join, now)
+	}
+
+	return nil
+}
+
+// SetTags replaces the complete set of tags associated with a join: tags which
+// aren't in the new set are removed.
+func (si *Index) SetTags(rawJoin string, tags []index.Tag) error {
+	if len(tags) == 0 {
+		return fmt.Errorf("split index: cannot set 0 tags on join %q", rawJoin)
+	}
+
+	join := HashJoin(rawJoin)
+
+	si.tagMutex.Lock()
+	defer si.tagMutex.Unlock()
+
+	keep := make(map[index.Tag]bool)
+	for _, tag := range tags {
+		keep[tag] = true
+	}
+
+	// copy, since removeJoinFromTag rewrites joinToTag
+	existing := append([]index.Tag(nil), si.joinToTag[join]...)
+	for _, tag := range existing {
+		if !keep[tag] {
+			si.removeJoinFromTag(tag, join)
+		}
+	}
+
+	now := si.now()
+	for _, tag := range tags {
+		si.addJoinToTag(tag, join, now)
+	}
+
+	return nil
+}
+
+// the caller must hold the tag lock
+func (si *Index) addJoinToTag(tag index.Tag, join Join, now int64) {
+	si.tagSeen[tagJoin{tag, join}] = now
+
+	joinList, ok := si.tagToJoin[tag]
+	if !ok {
+		si.tagCount++
+		joinList = []Join{}
+		si.tagToJoin[tag] = joinList
+	}
+
+	found := false
+	for _, existingJoin := range joinList {
+		if existingJoin == join {
+			found = true
+		}
+	}
+
+	if found {
+		return
+	}
+	si.tagVersion = index.NextVersion()
+
+	joinList = append(joinList, join)
+	SortJoins(joinList)
+	si.tagToJoin[tag] = joinList
+
+	tagList := append(si.joinToTag[join], tag)
+	index.SortTags(tagList)
+	si.joinToTag[join] = tagList
+}
+
+// RemoveMetrics disassociates metrics from a join. It returns the metrics
+// which are no longer associated with any join in this index.
+func (si *Index) RemoveMetrics(rawJoin string, metrics []index.Metric) ([]index.Metric, error) {
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("split index: cannot remove 0 metrics from join %q", rawJoin)
+	}
+
+	join := HashJoin(rawJoin)
+
+	si.metricMutex.Lock()
+	defer si.metricMutex.Unlock()
+
+	metricList, ok := si.joinToMetric[join]
+	if !ok {
+		return []index.Metric{}, nil
+	}
+
+	removed := make(map[index.Metric]bool)
+	for _, metric := range metrics {
+		removed[metric] = true
+	}
+
+	remaining := make([]index.Metric, 0, len(metricList))
+	orphans := []index.Metric{}
+	for _, metric := range metricList {
+		if !removed[metric] {
+			remaining = append(remaining, metric)
+			continue
+		}
+
+		if si.releaseMetric(join, metric) {
+			orphans = append(orphans, metric)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(si.joinToMetric, join)
+		delete(si.joinNames, join)
+	} else {
+		si.joinToMetric[join] = remaining
+	}
+
+	return orphans, nil
+}
+
+// RemoveAllMetrics disassociates every metric from a join. It returns the
+// metrics which are no longer associated with any join in this index.
+func (si *Index) RemoveAllMetrics(rawJoin string) []index.Metric {
+	join := HashJoin(rawJoin)
+
+	si.metricMutex.Lock()
+	defer si.metricMutex.Unlock()
+
+	orphans := []index.Metric{}
+	for _, metric := range si.joinToMetric[join] {
+		if si.releaseMetric(join, metric) {
+			orphans = append(orphans, metric)
+		}
+	}
+	delete(si.joinToMetric, join)
+	delete(si.joinNames, join)
+
+	return orphans
+}
+
+// SetMetrics replaces the complete set of metrics associated with a join:
+// metrics which aren't in the new set are removed. It returns the metrics
+// which are no longer associated with any join in this index.
+func (si *Index) SetMetrics(rawJoin string, metrics []index.Metric) ([]index.Metric, error) {
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("split index: cannot set 0 metrics on join %q", rawJoin)
+	}
+
+	join := HashJoin(rawJoin)
+
+	si.metricMutex.Lock()
+	defer si.metricMutex.Unlock()
+
+	keep := make(map[index.Metric]bool)
+	for _, metric := range metrics {
+		keep[metric] = true
+	}
+	si.joinNames[join] = rawJoin
+
+	existingMember := make(map[index.Metric]bool)
+	for _, metric := range si.joinToMetric[join] {
+		existingMember[metric] = true
+	}
+
+	metricList := make([]index.Metric, 0, len(keep))
+	orphans := []index.Metric{}
+	for metric := range existingMember {
+		if keep[metric] {
+			metricList = append(metricList, metric)
+			continue
+		}
+
+		if si.releaseMetric(join, metric) {
+			orphans = append(orphans, metric)
+		}
+	}
+
+	now := si.now()
+	for metric := range keep {
+		si.metricSeen[joinMetric{join, metric}] = now
+
+		if !existingMember[metric] {
+			si.metricCount++
+			si.addMetricToJoin(metric, join)
+			metricList = append(metricList, metric)
+		}
+	}
+
+	index.SortMetrics(metricList)
+	si.joinToMetric[join] = metricList
+
+	return orphans, nil
+}
+
+// the caller must hold the metric lock
+func (si *Index) addMetricToJoin(metric index.Metric, join Join) {
+	joinList := append(si.metricToJoin[metric], join)
+	SortJoins(joinList)
+	si.metricToJoin[metric] = joinList
+}
+
+// releaseMetric drops one join's reference to a metric, and reports whether
+// that was the last one. The caller must hold the metric lock.
+func (si *Index) releaseMetric(join Join, metric index.Metric) bool {
+	delete(si.metricSeen, joinMetric{join, metric})
+	si.metricCount--
+
+	joinList := si.metricToJoin[metric]
+	remaining := make([]Join, 0, len(joinList))
+	for _, existingJoin := range joinList {
+		if existingJoin != join {
+			remaining = append(remaining, existingJoin)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(si.metricToJoin, metric)
+		return true
+	}
+	si.metricToJoin[metric] = remaining
+	return false
+}
+
+// RemoveTags disassociates tags from a join.
+func (si *Index) RemoveTags(rawJoin string, tags []index.Tag) error {
+	if len(tags) == 0 {
+		return fmt.Errorf("split index: cannot remove 0 tags from join %q", rawJoin)
+	}
+
+	join := HashJoin(rawJoin)
+
+	si.tagMutex.Lock()
+	defer si.tagMutex.Unlock()
+
+	for _, tag := range tags {
+		si.removeJoinFromTag(tag, join)
+	}
+
+	return nil
+}
+
+// RemoveAllTags disassociates every tag from a join.
+func (si *Index) RemoveAllTags(rawJoin string) {
+	join := HashJoin(rawJoin)
+
+	si.tagMutex.Lock()
+	defer si.tagMutex.Unlock()
+
+	// copy, since removeJoinFromTag rewrites joinToTag
+	tags := append([]index.Tag(nil), si.joinToTag[join]...)
 	for _, tag := range tags {
-		joinList, ok := si.tagToJoin[tag]
+		si.removeJoinFromTag(tag, join)
+	}
+}
+
+// the caller must hold the tag lock
+func (si *Index) removeJoinFromTag(tag index.Tag, join Join) {
+	joinList, ok := si.tagToJoin[tag]
+	if !ok {
+		return
+	}
+
+	remaining := make([]Join, 0, len(joinList))
+	for _, existingJoin := range joinList {
+		if existingJoin != join {
+			remaining = append(remaining, existingJoin)
+		}
+	}
+
+	if len(remaining) == len(joinList) {
+		return
+	}
+	si.tagVersion = index.NextVersion()
+
+	delete(si.tagSeen, tagJoin{tag, join})
+
+	if len(remaining) == 0 {
+		si.tagCount--
+		delete(si.tagToJoin, tag)
+		delete(si.tagNames, tag)
+	} else {
+		si.tagToJoin[tag] = remaining
+	}
+
+	tagList := si.joinToTag[join]
+	remainingTags := make([]index.Tag, 0, len(tagList))
+	for _, existingTag := range tagList {
+		if existingTag != tag {
+			remainingTags = append(remainingTags, existingTag)
+		}
+	}
+
+	if len(remainingTags) == 0 {
+		delete(si.joinToTag, join)
+	} else {
+		si.joinToTag[join] = remainingTags
+	}
+}
+
+// ExpireTags removes every tag association which was last added before the
+// given unix time. It returns how many associations were removed.
+func (si *Index) ExpireTags(before int64) int {
+	si.tagMutex.Lock()
+	defer si.tagMutex.Unlock()
+
+	expired := []tagJoin{}
+	for association, seen := range si.tagSeen {
+		if seen < before {
+			expired = append(expired, association)
+		}
+	}
+
+	for _, association := range expired {
+		si.removeJoinFromTag(association.tag, association.join)
+	}
+	return len(expired)
+}
+
+// ExpireMetrics removes every metric association which was last added before
+// the given unix time. It returns how many associations were removed, and the
+// metrics which are no longer associated with any join in this index.
+func (si *Index) ExpireMetrics(before int64) (int, []index.Metric) {
+	si.metricMutex.Lock()
+	defer si.metricMutex.Unlock()
+
+	expiredByJoin := map[Join]map[index.Metric]bool{}
+	for association, seen := range si.metricSeen {
+		if seen >= before {
+			continue
+		}
+
+		expired, ok := expiredByJoin[association.join]
 		if !ok {
-			si.tagCount++
-			joinList = []Join{}
-			si.tagToJoin[tag] = joinList
+			expired = map[index.Metric]bool{}
+			expiredByJoin[association.join] = expired
 		}
+		expired[association.metric] = true
+	}
+
+	count := 0
+	orphans := []index.Metric{}
+	for join, expired := range expiredByJoin {
+		metricList := si.joinToMetric[join]
+		remaining := make([]index.Metric, 0, len(metricList))
+		for _, metric := range metricList {
+			if !expired[metric] {
+				remaining = append(remaining, metric)
+				continue
+			}
 
-		found := false
-		for _, existingJoin := range joinList {
-			if existingJoin == join {
-				found = true
+			count++
+			if si.releaseMetric(join, metric) {
+				orphans = append(orphans, metric)
 			}
 		}
 
-		if !found {
-			joinList = append(joinList, join)
+		if len(remaining) == 0 {
+			delete(si.joinToMetric, join)
+			delete(si.joinNames, join)
+		} else {
+			si.joinToMetric[join] = remaining
 		}
-		SortJoins(joinList)
-		si.tagToJoin[tag] = joinList
 	}
+	return count, orphans
+}
 
-	return nil
+// HasMetric reports whether a metric is associated with any join in the index.
+func (si *Index) HasMetric(metric index.Metric) bool {
+	si.metricMutex.RLock()
+	defer si.metricMutex.RUnlock()
+	return len(si.metricToJoin[metric]) > 0
+}
+
+// JoinTags is one join value that a metric is associated with, and the tags
+// associated with that join value.
+type JoinTags struct {
+	Join string   `json:"join"`
+	Tags []string `json:"tags"`
+}
+
+// TagsForMetric returns every join value the metric is associated with, and
+// the tags that reach the metric through each of them. It's the reverse of a
+// query: any of these tags would select the metric.
+func (si *Index) TagsForMetric(metric index.Metric) []JoinTags {
+	si.metricMutex.RLock()
+	joins := append([]Join(nil), si.metricToJoin[metric]...)
+	joinNames := make([]string, len(joins))
+	for i, join := range joins {
+		joinNames[i] = si.joinNames[join]
+	}
+	si.metricMutex.RUnlock()
+
+	si.tagMutex.RLock()
+	defer si.tagMutex.RUnlock()
+
+	result := make([]JoinTags, 0, len(joins))
+	for i, join := range joins {
+		tags := []string{}
+		for _, tag := range si.joinToTag[join] {
+			// tags are only missing a name if they came from an old snapshot
+			name, ok := si.tagNames[tag]
+			if ok {
+				tags = append(tags, name)
+			}
+		}
+		sort.Strings(tags)
+		result = append(result, JoinTags{Join: joinNames[i], Tags: tags})
+	}
+
+	sort.Sort(joinTagsByJoin(result))
+	return result
+}
+
+// ReachingTags returns the names of every tag which would select at least
+// one of metrics, by way of the reverse maps.
+func (si *Index) ReachingTags(metrics []index.Metric) map[string]bool {
+	joins := map[Join]bool{}
+	si.metricMutex.RLock()
+	for _, metric := range metrics {
+		for _, join := range si.metricToJoin[metric] {
+			joins[join] = true
+		}
+	}
+	si.metricMutex.RUnlock()
+
+	si.tagMutex.RLock()
+	defer si.tagMutex.RUnlock()
+
+	tags := map[string]bool{}
+	for join := range joins {
+		for _, tag := range si.joinToTag[join] {
+			name, ok := si.tagNames[tag]
+			if ok {
+				tags[name] = true
+			}
+		}
+	}
+	return tags
+}
+
+type joinTagsByJoin []JoinTags
+
+func (a joinTagsByJoin) Len() int           { return len(a) }
+func (a joinTagsByJoin) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a joinTagsByJoin) Less(i, j int) bool { return a[i].Join < a[j].Join }
+
+// NameTags records the strings for tags which are in the index, so that
+// queries can match them with globs like 'server-dc:us-*'.
+func (si *Index) NameTags(tags []string) {
+	si.tagMutex.Lock()
+	defer si.tagMutex.Unlock()
+
+	for _, tag := range tags {
+		hash := index.HashTag(tag)
+		if _, ok := si.tagToJoin[hash]; ok && si.tagNames[hash] != tag {
+			si.tagNames[hash] = tag
+			si.tagVersion = index.NextVersion()
+		}
+	}
+}
+
+// TagVersion changes whenever TagCounts would return something different.
+func (si *Index) TagVersion() uint64 {
+	si.tagMutex.RLock()
+	defer si.tagMutex.RUnlock()
+	return si.tagVersion
+}
+
+// TagCounts returns every tag in the index, with the number of join values
+// that have it.
+func (si *Index) TagCounts() map[string]int {
+	si.tagMutex.RLock()
+	defer si.tagMutex.RUnlock()
+
+	counts := make(map[string]int, len(si.tagNames))
+	for tag, name := range si.tagNames {
+		counts[name] = len(si.tagToJoin[tag])
+	}
+	return counts
 }
 
 func (si *Index) Query(q *index.Query) ([]index.Metric, error) {
+	if len(q.Hashed) == 0 && len(q.NegatedHashed) > 0 {
+		return nil, fmt.Errorf("split index %s: a query needs at least one tag that isn't negated", si.joinKey)
+	}
+
+	si.tagMutex.RLock()
 	// get a slice of all the join keys (for example, hostnames) associated with these tags
 	joinLists := [][]Join{}
-	si.tagMutex.RLock()
-	for _, tag := range q.Hashed {
+	for i, tag := range q.Hashed {
+		if glob.IsGlob(q.Raw[i]) {
+			// unlike a plain tag, a glob that matches nothing still
+			// narrows the result (to nothing)
+			list, err := si.globJoins(q.Raw[i])
+			if err != nil {
+				si.tagMutex.RUnlock()
+				return nil, err
+			}
+			joinLists = append(joinLists, list)
+			continue
+		}
+
 		list, ok := si.tagToJoin[tag]
 		if ok {
 			joinLists = append(joinLists, list)
 		}
 	}
+
+	excludedJoinLists := [][]Join{}
+	for i, tag := range q.NegatedHashed {
+		list := si.tagToJoin[tag]
+		if glob.IsGlob(q.NegatedRaw[i]) {
+			var err error
+			list, err = si.globJoins(q.NegatedRaw[i])
+			if err != nil {
+				si.tagMutex.RUnlock()
+				return nil, err
+			}
+		}
+
+		if len(list) > 0 {
+			excludedJoinLists = append(excludedJoinLists, list)
+		}
+	}
 	si.tagMutex.RUnlock()
 
 	// intersect join keys
 	joinSet := IntersectJoins(joinLists)
 
+	metrics := si.metricsForJoins(joinSet)
+	if len(excludedJoinLists) == 0 {
+		return metrics, nil
+	}
+
+	// a metric is excluded if any of its join keys has a negated tag, so
+	// this subtracts metrics rather than join keys
+	excluded := si.metricsForJoins(UnionJoins(excludedJoinLists))
+	return index.DifferenceMetrics(metrics, excluded), nil
+}
+
+// JoinsForTag returns how many join values have a tag, or any tag matching
+// it if it's a glob.
+func (si *Index) JoinsForTag(tag string) (int, error) {
+	si.tagMutex.RLock()
+	defer si.tagMutex.RUnlock()
+
+	if glob.IsGlob(tag) {
+		joins, err := si.globJoins(tag)
+		return len(joins), err
+	}
+	return len(si.tagToJoin[index.HashTag(tag)]), nil
+}
+
+// globJoins returns the union of the joins for every tag matching pattern.
+// the caller must hold the tag lock
+func (si *Index) globJoins(pattern string) ([]Join, error) {
+	tags, err := index.MatchTags(pattern, si.tagNames)
+	if err != nil {
+		return nil, fmt.Errorf("split index %s: %s", si.joinKey, err)
+	}
+
+	joinLists := make([][]Join, 0, len(tags))
+	for _, tag := range tags {
+		list := si.tagToJoin[tag]
+		if len(list) > 0 {
+			joinLists = append(joinLists, list)
+		}
+	}
+	return UnionJoins(joinLists), nil
+}
+
+// metricsForJoins returns the deduplicated union of all of the metrics
+// associated with the given join keys
+func (si *Index) metricsForJoins(joins []Join) []index.Metric {
 	si.metricMutex.RLock()
-	// deduplicated union all of the metrics associated with those join keys
 	metricSets := [][]index.Metric{}
-	for _, join := range joinSet {
-		list, ok := si.joinToMetric[join]
-		if ok {
+	for _, join := range joins {
+		list := si.joinToMetric[join]
+		if len(list) > 0 {
 			metricSets = append(metricSets, list)
 		}
 	}
 	si.metricMutex.RUnlock()
 
 	// map keys -> slice. except these need to be sorted, blorg!
-	metrics := index.UnionMetrics(metricSets)
-	return metrics, nil
+	return index.UnionMetrics(metricSets)
 }
 
 func (si *Index) Name() string {
 	return si.joinKey
 }
 
+// Snapshot is a point-in-time copy of a split index, suitable for
+// serializing to disk.
+type Snapshot struct {
+	JoinKey      string
+	TagToJoin    map[index.Tag][]Join
+	JoinToMetric map[Join][]index.Metric
+
+	// when each association was last added, in the same order as the
+	// TagToJoin and JoinToMetric lists
+	TagToJoinSeen    map[index.Tag][]int64
+	JoinToMetricSeen map[Join][]int64
+
+	TagNames  map[index.Tag]string
+	JoinNames map[Join]string
+}
+
+// Snapshot copies both sides of the index. The lists are copied so that
+// writes after this returns don't touch the snapshot.
+func (si *Index) Snapshot() *Snapshot {
+	snap := &Snapshot{
+		JoinKey:      si.joinKey,
+		TagToJoin:    make(map[index.Tag][]Join),
+		JoinToMetric: make(map[Join][]index.Metric),
+
+		TagToJoinSeen:    make(map[index.Tag][]int64),
+		JoinToMetricSeen: make(map[Join][]int64),
+
+		TagNames:  make(map[index.Tag]string),
+		JoinNames: make(map[Join]string),
+	}
+
+	si.tagMutex.RLock()
+	for tag, joins := range si.tagToJoin {
+		snap.TagToJoin[tag] = append([]Join(nil), joins...)
+		seen := make([]int64, len(joins))
+		for i, join := range joins {
+			seen[i] = si.tagSeen[tagJoin{tag, join}]
+		}
+		snap.TagToJoinSeen[tag] = seen
+	}
+	for tag, name := range si.tagNames {
+		snap.TagNames[tag] = name
+	}
+	si.tagMutex.RUnlock()
+
+	si.metricMutex.RLock()
+	for join, metrics := range si.joinToMetric {
+		snap.JoinToMetric[join] = append([]index.Metric(nil), metrics...)
+		seen := make([]int64, len(metrics))
+		for i, metric := range metrics {
+			seen[i] = si.metricSeen[joinMetric{join, metric}]
+		}
+		snap.JoinToMetricSeen[join] = seen
+	}
+	for join, name := range si.joinNames {
+		snap.JoinNames[join] = name
+	}
+	si.metricMutex.RUnlock()
+
+	return snap
+}
+
+// Restore builds a new index from a snapshot. The snapshot must not be used
+// afterwards, since the index takes ownership of its maps.
+func Restore(snap *Snapshot) *Index {
+	si := NewIndex(snap.JoinKey)
+	// snapshots without timestamps get a fresh lease on life
+	now := si.now()
+
+	for tag, joins := range snap.TagToJoin {
+		seen := snap.TagToJoinSeen[tag]
+		for i, join := range joins {
+			si.joinToTag[join] = append(si.joinToTag[join], tag)
+			if i < len(seen) {
+				si.tagSeen[tagJoin{tag, join}] = seen[i]
+			} else {
+				si.tagSeen[tagJoin{tag, join}] = now
+			}
+		}
+
+		SortJoins(joins)
+		si.tagToJoin[tag] = joins
+		si.tagCount++
+
+		name, ok := snap.TagNames[tag]
+		if ok {
+			si.tagNames[tag] = name
+		}
+	}
+
+	for _, tags := range si.joinToTag {
+		index.SortTags(tags)
+	}
+
+	for join, metrics := range snap.JoinToMetric {
+		seen := snap.JoinToMetricSeen[join]
+		for i, metric := range metrics {
+			si.metricToJoin[metric] = append(si.metricToJoin[metric], join)
+			if i < len(seen) {
+				si.metricSeen[joinMetric{join, metric}] = seen[i]
+			} else {
+				si.metricSeen[joinMetric{join, metric}] = now
+			}
+		}
+
+		index.SortMetrics(metrics)
+		si.joinToMetric[join] = metrics
+		si.metricCount += len(metrics)
+
+		name, ok := snap.JoinNames[join]
+		if ok {
+			si.joinNames[join] = name
+		}
+	}
+
+	for _, joins := range si.metricToJoin {
+		SortJoins(joins)
+	}
+	return si
+}
+
 func (si *Index) TagSize() int {
 	// or convert the sizes to atomics
 	si.tagMutex.RLock()
@@ -223,6 +924,26 @@ func (h *JoinSetsHeap) Pop() interface{} {
 	return x
 }
 
+func UnionJoins(joinSets [][]Join) []Join {
+	h := JoinSetsHeap(joinSets)
+	heap.Init(&h)
+	set := []Join{}
+	for h.Len() > 0 {
+		cur := h[0]
+		join := cur[0]
+		if len(set) == 0 || set[len(set)-1] != join {
+			set = append(set, join)
+		}
+		if len(cur) == 1 {
+			heap.Pop(&h)
+		} else {
+			h[0] = cur[1:]
+			heap.Fix(&h, 0)
+		}
+	}
+	return set
+}
+
 func IntersectJoins(joinSets [][]Join) []Join {
 	if len(joinSets) == 0 {
 		return []Join{}
@@ -74,6 +74,311 @@ func TestQuery(t *testing.T) {
 	}
 }
 
+func TestNegatedQuery(t *testing.T) {
+	in := NewIndex("host")
+	shared := index.HashMetrics([]string{"lb.www.requests"})
+	in.AddMetrics("hostname-1234", shared)
+	in.AddMetrics("hostname-1235", shared)
+	in.AddMetrics("hostname-1236", index.HashMetrics([]string{"server.hostname-1236.cpu"}))
+
+	in.AddTags("hostname-1234", index.HashTags([]string{"lb-pool:www", "server-state:live"}))
+	in.AddTags("hostname-1235", index.HashTags([]string{"lb-pool:www", "server-state:maint"}))
+	in.AddTags("hostname-1236", index.HashTags([]string{"lb-pool:www", "server-state:live"}))
+
+	result, err := in.Query(index.NewQuery([]string{"lb-pool:www", "!server-state:maint"}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the shared metric belongs to a host in maintenance, so it's excluded
+	// even though the other host it belongs to isn't
+	expected := index.HashMetric("server.hostname-1236.cpu")
+	if len(result) != 1 || result[0] != expected {
+		t.Errorf("split index test: expected only %v, but got %v", expected, result)
+	}
+
+	_, err = in.Query(index.NewQuery([]string{"!server-state:maint"}))
+	if err == nil {
+		t.Errorf("split index test: a query with only negated tags should be an error")
+	}
+}
+
+func TestGlobQuery(t *testing.T) {
+	in := NewIndex("host")
+	hosts := map[string][]string{
+		"hostname-1234": {"server-dc:us-east", "server-hw:dell"},
+		"hostname-1235": {"server-dc:us-west", "server-hw:hp"},
+		"hostname-1236": {"server-dc:eu-west", "server-hw:dell"},
+	}
+	for host, tags := range hosts {
+		in.AddMetrics(host, index.HashMetrics([]string{"server." + host + ".cpu"}))
+		in.AddTags(host, index.HashTags(tags))
+		in.NameTags(tags)
+	}
+
+	cases := map[string][]string{
+		"server-dc:us-*":      {"hostname-1234", "hostname-1235"},
+		"server-hw:{dell,hp}": {"hostname-1234", "hostname-1235", "hostname-1236"},
+		"server-dc:*-west":    {"hostname-1235", "hostname-1236"},
+		"server-dc:ap-*":      {},
+	}
+	for pattern, expectedHosts := range cases {
+		result, err := in.Query(index.NewQuery([]string{pattern}))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		expected := []string{}
+		for _, host := range expectedHosts {
+			expected = append(expected, "server."+host+".cpu")
+		}
+		expectedHashes := index.HashMetrics(expected)
+		index.SortMetrics(expectedHashes)
+		if len(result) != len(expectedHashes) {
+			t.Errorf("split index test: expected %q to match %v, but got %v", pattern, expectedHashes, result)
+			continue
+		}
+		for i := range result {
+			if result[i] != expectedHashes[i] {
+				t.Errorf("split index test: expected %q to match %v, but got %v", pattern, expectedHashes, result)
+				break
+			}
+		}
+	}
+
+	result, _ := in.Query(index.NewQuery([]string{"server-hw:dell", "!server-dc:us-*"}))
+	expected := index.HashMetric("server.hostname-1236.cpu")
+	if len(result) != 1 || result[0] != expected {
+		t.Errorf("split index test: expected a negated glob to leave only %v, but got %v", expected, result)
+	}
+
+	// names go away with the tag
+	in.RemoveAllTags("hostname-1236")
+	result, _ = in.Query(index.NewQuery([]string{"server-dc:eu-*"}))
+	if len(result) != 0 {
+		t.Errorf("split index test: removed tag still matched a glob: %v", result)
+	}
+
+	// and survive a snapshot
+	restored := Restore(in.Snapshot())
+	result, _ = restored.Query(index.NewQuery([]string{"server-dc:us-*"}))
+	if len(result) != 2 {
+		t.Errorf("split index test: expected the restored index to match 2 metrics with a glob, but got %v", result)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	in := NewIndex("host")
+	live := index.HashTags([]string{"server-state:live"})
+	metrics := index.HashMetrics([]string{"server.hostname-1234.cpu", "server.hostname-1234.mem"})
+
+	in.AddMetrics("hostname-1234", metrics)
+	in.AddMetrics("hostname-1235", metrics[:1])
+	in.AddTags("hostname-1234", live)
+	in.AddTags("hostname-1235", live)
+
+	orphans, err := in.RemoveMetrics("hostname-1234", metrics)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the cpu metric is still associated with hostname-1235
+	if len(orphans) != 1 || orphans[0] != metrics[1] {
+		t.Errorf("split index test: expected only the mem metric to be orphaned, but got %v", orphans)
+	}
+	if !in.HasMetric(metrics[0]) || in.HasMetric(metrics[1]) {
+		t.Errorf("split index test: HasMetric is wrong after removing metrics")
+	}
+
+	result, _ := in.Query(index.NewQuery([]string{"server-state:live"}))
+	if len(result) != 1 || result[0] != metrics[0] {
+		t.Errorf("split index test: expected only the cpu metric after removal, but got %v", result)
+	}
+
+	err = in.RemoveTags("hostname-1235", live)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	in.RemoveAllTags("hostname-1234")
+
+	result, _ = in.Query(index.NewQuery([]string{"server-state:live"}))
+	if len(result) != 0 {
+		t.Errorf("split index test: expected no results after removing all tags, but got %v", result)
+	}
+	if in.TagSize() != 0 {
+		t.Errorf("split index test: expected tag size to be 0 after removing all tags, but it is %d", in.TagSize())
+	}
+
+	orphans = in.RemoveAllMetrics("hostname-1235")
+	if len(orphans) != 1 || orphans[0] != metrics[0] {
+		t.Errorf("split index test: expected the cpu metric to be orphaned, but got %v", orphans)
+	}
+	if in.MetricSize() != 0 {
+		t.Errorf("split index test: expected metric size to be 0 after removing all metrics, but it is %d", in.MetricSize())
+	}
+}
+
+func TestSet(t *testing.T) {
+	in := NewIndex("host")
+	metrics := index.HashMetrics([]string{"server.hostname-1234.cpu", "server.hostname-1234.mem"})
+
+	in.AddMetrics("hostname-1234", metrics)
+	in.AddTags("hostname-1234", index.HashTags([]string{"server-state:live", "server-dc:lhr"}))
+
+	err := in.SetTags("hostname-1234", index.HashTags([]string{"server-state:maint", "server-dc:lhr"}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := map[string]int{
+		"server-state:live":  0,
+		"server-state:maint": 2,
+		"server-dc:lhr":      2,
+	}
+	for tag, count := range expected {
+		result, _ := in.Query(index.NewQuery([]string{tag}))
+		if len(result) != count {
+			t.Errorf("split index test: expected %d results for %q after SetTags, but got %d", count, tag, len(result))
+		}
+	}
+	if in.TagSize() != 2 {
+		t.Errorf("split index test: expected tag size 2 after SetTags, but it is %d", in.TagSize())
+	}
+
+	orphans, err := in.SetMetrics("hostname-1234", metrics[1:])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(orphans) != 1 || orphans[0] != metrics[0] {
+		t.Errorf("split index test: expected the cpu metric to be orphaned by SetMetrics, but got %v", orphans)
+	}
+
+	result, _ := in.Query(index.NewQuery([]string{"server-dc:lhr"}))
+	if len(result) != 1 || result[0] != metrics[1] {
+		t.Errorf("split index test: expected only the mem metric after SetMetrics, but got %v", result)
+	}
+	if in.MetricSize() != 1 {
+		t.Errorf("split index test: expected metric size 1 after SetMetrics, but it is %d", in.MetricSize())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	in := NewIndex("host")
+	clock := int64(100)
+	in.now = func() int64 { return clock }
+
+	metrics := index.HashMetrics([]string{"server.hostname-1234.cpu", "server.hostname-1234.mem"})
+	in.AddMetrics("hostname-1234", metrics)
+	in.AddTags("hostname-1234", index.HashTags([]string{"server-state:live", "server-dc:lhr"}))
+
+	clock = 200
+	// refresh one of each
+	in.AddMetrics("hostname-1234", metrics[1:])
+	in.AddTags("hostname-1234", index.HashTags([]string{"server-dc:lhr"}))
+
+	expiredTags := in.ExpireTags(150)
+	if expiredTags != 1 {
+		t.Errorf("split index test: expected 1 tag association to expire, but %d did", expiredTags)
+	}
+
+	expiredMetrics, orphans := in.ExpireMetrics(150)
+	if expiredMetrics != 1 || len(orphans) != 1 || orphans[0] != metrics[0] {
+		t.Errorf("split index test: expected only the cpu metric to expire, but %d did, orphaning %v", expiredMetrics, orphans)
+	}
+
+	result, _ := in.Query(index.NewQuery([]string{"server-state:live"}))
+	if len(result) != 0 {
+		t.Errorf("split index test: expired tag still matches: %v", result)
+	}
+
+	result, _ = in.Query(index.NewQuery([]string{"server-dc:lhr"}))
+	if len(result) != 1 || result[0] != metrics[1] {
+		t.Errorf("split index test: expected only the refreshed metric to remain, but got %v", result)
+	}
+
+	// snapshots keep the timestamps
+	restored := Restore(in.Snapshot())
+	if expired := restored.ExpireTags(150); expired != 0 {
+		t.Errorf("split index test: restored index expired %d fresh tag associations", expired)
+	}
+	if expired := restored.ExpireTags(250); expired != 1 {
+		t.Errorf("split index test: restored index should have expired 1 tag association, but expired %d", expired)
+	}
+}
+
+func TestTagsForMetric(t *testing.T) {
+	in := NewIndex("host")
+	shared := index.HashMetric("lb.www.requests")
+	in.AddMetrics("hostname-1234", []index.Metric{shared})
+	in.AddMetrics("hostname-1235", []index.Metric{shared})
+
+	tags := []string{"lb-pool:www", "server-dc:lhr"}
+	in.AddTags("hostname-1234", index.HashTags(tags))
+	in.AddTags("hostname-1235", index.HashTags(tags[:1]))
+	in.NameTags(tags)
+
+	check := func(in *Index, desc string) {
+		result := in.TagsForMetric(shared)
+		if len(result) != 2 {
+			t.Errorf("split index test: %s: expected 2 joins for the metric, but got %v", desc, result)
+			return
+		}
+
+		if result[0].Join != "hostname-1234" || len(result[0].Tags) != 2 || result[0].Tags[1] != "server-dc:lhr" {
+			t.Errorf("split index test: %s: expected hostname-1234 to have both tags, but got %v", desc, result[0])
+		}
+
+		if result[1].Join != "hostname-1235" || len(result[1].Tags) != 1 || result[1].Tags[0] != "lb-pool:www" {
+			t.Errorf("split index test: %s: expected hostname-1235 to have only lb-pool:www, but got %v", desc, result[1])
+		}
+	}
+
+	check(in, "fresh index")
+	check(Restore(in.Snapshot()), "restored index")
+
+	in.RemoveAllMetrics("hostname-1234")
+	result := in.TagsForMetric(shared)
+	if len(result) != 1 || result[0].Join != "hostname-1235" {
+		t.Errorf("split index test: expected only hostname-1235 after removing hostname-1234's metrics, but got %v", result)
+	}
+
+	in.RemoveAllMetrics("hostname-1235")
+	result = in.TagsForMetric(shared)
+	if len(result) != 0 {
+		t.Errorf("split index test: expected no joins for a metric that was removed, but got %v", result)
+	}
+}
+
+func TestReachingTags(t *testing.T) {
+	in := NewIndex("host")
+	metrics := index.HashMetrics([]string{"server.hostname-1234.cpu", "server.hostname-1235.cpu", "server.hostname-1236.cpu"})
+	in.AddMetrics("hostname-1234", metrics[:1])
+	in.AddMetrics("hostname-1235", metrics[1:2])
+	in.AddMetrics("hostname-1236", metrics[2:])
+
+	tags := []string{"lb-pool:www", "server-dc:lhr", "server-dc:ams"}
+	in.AddTags("hostname-1234", index.HashTags(tags[:2]))
+	in.AddTags("hostname-1235", index.HashTags(tags[:1]))
+	in.AddTags("hostname-1236", index.HashTags(tags[2:]))
+	in.NameTags(tags)
+
+	result := in.ReachingTags(metrics[:2])
+	if len(result) != 2 || !result["lb-pool:www"] || !result["server-dc:lhr"] {
+		t.Errorf("split index test: expected lb-pool:www and server-dc:lhr to reach the first two metrics, but got %v", result)
+	}
+
+	result = in.ReachingTags(index.HashMetrics([]string{"server.hostname-9999.cpu"}))
+	if len(result) != 0 {
+		t.Errorf("split index test: expected no tags to reach a metric that isn't in the index, but got %v", result)
+	}
+}
+
 func BenchmarkSmallsetQuery(b *testing.B) {
 	metricName := "server.hostname-1234"
 	host := "hostname-1234"
@@ -0,0 +1,231 @@
+package text
+
+/*
+
+regex search. running a regex over every metric name would be far too slow, so
+first the regex is turned into a boolean query over trigrams (like google code
+search): every metric that matches the regex must contain the trigrams the
+query asks for. for example, /server\d+cpu|lb_pool/ becomes
+
+	(ser AND erv AND rve AND ver AND cpu) OR (lb_ AND b_p AND _po AND poo AND ool)
+
+the trigram query is answered from the postings lists, and only the metrics it
+finds are checked against the real regex. parts of the regex that can't be
+turned into trigrams (character classes, repetition, short literals) match
+anything, which makes the query less selective but never wrong.
+
+*/
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+
+	"github.com/kanatohodets/carbonsearch/index"
+)
+
+type trigramQuery struct {
+	// true if the query doesn't narrow anything down: every metric might match
+	all bool
+	// whether every trigram and sub-query must match, or just one of them
+	and      bool
+	trigrams []trigram
+	subs     []*trigramQuery
+}
+
+var matchAll = &trigramQuery{all: true}
+
+func andQuery(queries ...*trigramQuery) *trigramQuery {
+	q := &trigramQuery{and: true}
+	for _, sub := range queries {
+		if !sub.all {
+			q.subs = append(q.subs, sub)
+		}
+	}
+
+	if len(q.subs) == 0 {
+		return matchAll
+	}
+	if len(q.subs) == 1 {
+		return q.subs[0]
+	}
+	return q
+}
+
+func orQuery(queries ...*trigramQuery) *trigramQuery {
+	q := &trigramQuery{}
+	for _, sub := range queries {
+		// one branch that could match anything means the whole thing could
+		if sub.all {
+			return matchAll
+		}
+		q.subs = append(q.subs, sub)
+	}
+
+	if len(q.subs) == 1 {
+		return q.subs[0]
+	}
+	return q
+}
+
+// literalQuery needs every trigram in a literal string
+func literalQuery(literal string) *trigramQuery {
+	if len(literal) < n {
+		return matchAll
+	}
+
+	q := &trigramQuery{and: true}
+	for i := 0; i <= len(literal)-n; i++ {
+		q.trigrams = append(q.trigrams, trigramize([3]byte{literal[i], literal[i+1], literal[i+2]}))
+	}
+	return q
+}
+
+// regexQuery builds the trigram query for a parsed regex
+func regexQuery(re *syntax.Regexp) *trigramQuery {
+	switch re.Op {
+	case syntax.OpLiteral, syntax.OpConcat:
+		return concatQuery(re)
+
+	case syntax.OpAlternate:
+		subs := make([]*trigramQuery, len(re.Sub))
+		for i, sub := range re.Sub {
+			subs[i] = regexQuery(sub)
+		}
+		return orQuery(subs...)
+
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexQuery(re.Sub[0])
+
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return regexQuery(re.Sub[0])
+		}
+	}
+
+	// stars, character classes, anchors on their own, etc.
+	return matchAll
+}
+
+// concatQuery joins runs of adjacent literals, so that trigrams spanning them
+// can be used. a leading '^' or trailing '$' turns into the start and end
+// markers that the index adds to every metric name.
+func concatQuery(re *syntax.Regexp) *trigramQuery {
+	subs := re.Sub
+	if re.Op == syntax.OpLiteral {
+		subs = []*syntax.Regexp{re}
+	}
+
+	queries := []*trigramQuery{}
+	literal := []byte{}
+	flush := func() {
+		queries = append(queries, literalQuery(string(literal)))
+		literal = literal[:0]
+	}
+
+	for i, sub := range subs {
+		switch {
+		case sub.Op == syntax.OpLiteral:
+			if sub.Flags&syntax.FoldCase != 0 {
+				// case insensitive: could be any of several trigrams
+				flush()
+				continue
+			}
+			literal = append(literal, string(sub.Rune)...)
+		case (sub.Op == syntax.OpBeginText || sub.Op == syntax.OpBeginLine) && i == 0:
+			literal = append(literal, '^')
+		case (sub.Op == syntax.OpEndText || sub.Op == syntax.OpEndLine) && i == len(subs)-1:
+			literal = append(literal, '$')
+		default:
+			flush()
+			queries = append(queries, regexQuery(sub))
+		}
+	}
+	flush()
+
+	return andQuery(queries...)
+}
+
+// SetNameLookup tells the index how to find the name of a metric, which is
+// needed to check regex matches. The index only stores hashes.
+func (ti *Index) SetNameLookup(lookup func(index.Metric) (string, bool)) {
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+	ti.lookup = lookup
+}
+
+// SearchRegex finds the metrics whose names match the regex pattern somewhere.
+func (ti *Index) SearchRegex(pattern string) ([]index.Metric, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("text.SearchRegex: could not compile %q: %v", pattern, err)
+	}
+
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("text.SearchRegex: could not parse %q: %v", pattern, err)
+	}
+
+	q := regexQuery(parsed.Simplify())
+	if q.all {
+		return nil, fmt.Errorf("text.SearchRegex: %q doesn't require any run of at least %d literal characters, so it can't be searched for efficiently", pattern, n)
+	}
+
+	ti.mutex.RLock()
+	candidates := ti.trigramSearch(q)
+	lookup := ti.lookup
+	ti.mutex.RUnlock()
+
+	if lookup == nil {
+		return nil, fmt.Errorf("text.SearchRegex: the index has no way to look up metric names")
+	}
+
+	// the names are looked up without holding the index lock, so that the
+	// lookup is free to take its own locks
+	matches := make([]index.Metric, 0, len(candidates))
+	for _, metric := range candidates {
+		name, ok := lookup(metric)
+		if ok && re.MatchString(name) {
+			matches = append(matches, metric)
+		}
+	}
+	return matches, nil
+}
+
+// trigramSearch returns the sorted set of metrics satisfying a trigram query.
+// the caller must hold the lock
+func (ti *Index) trigramSearch(q *trigramQuery) []index.Metric {
+	metricSets := [][]index.Metric{}
+	for _, tri := range q.trigrams {
+		metricSets = append(metricSets, ti.trigramMetrics(tri))
+	}
+	for _, sub := range q.subs {
+		metricSets = append(metricSets, ti.trigramSearch(sub))
+	}
+
+	if q.and {
+		return index.IntersectMetrics(metricSets)
+	}
+
+	nonEmpty := make([][]index.Metric, 0, len(metricSets))
+	for _, metrics := range metricSets {
+		if len(metrics) > 0 {
+			nonEmpty = append(nonEmpty, metrics)
+		}
+	}
+	return index.UnionMetrics(nonEmpty)
+}
+
+// trigramMetrics returns the sorted set of metrics containing a trigram. the
+// caller must hold the lock
+func (ti *Index) trigramMetrics(tri trigram) []index.Metric {
+	docs := ti.postings[tri]
+	metrics := make([]index.Metric, 0, len(docs))
+	for _, doc := range docs {
+		// documents are sorted by metric, then position
+		if len(metrics) == 0 || metrics[len(metrics)-1] != doc.metric {
+			metrics = append(metrics, doc.metric)
+		}
+	}
+	return metrics
+}
@@ -16,6 +16,9 @@ type Index struct {
 	postings map[trigram][]document
 	mutex    sync.RWMutex
 	count    int
+
+	// finds the name of a metric, for checking regex matches
+	lookup func(index.Metric) (string, bool)
 }
 
 func NewIndex() *Index {
@@ -25,22 +28,59 @@ func NewIndex() *Index {
 }
 
 func (ti *Index) Query(q *index.Query) ([]index.Metric, error) {
-	searches := []string{}
-	for _, tag := range q.Raw {
-		if strings.HasPrefix(tag, "text-match:") {
-			search := strings.TrimPrefix(tag, "text-match:")
-			searches = append(searches, search)
+	metricSets, err := ti.searchTags(q.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded, err := ti.searchTags(q.NegatedRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metricSets) == 0 && len(excluded) > 0 {
+		return nil, fmt.Errorf("text index query: a query needs at least one text-match or text-regex that isn't negated")
+	}
+	metrics := index.IntersectMetrics(metricSets)
+
+	nonEmpty := [][]index.Metric{}
+	for _, results := range excluded {
+		if len(results) > 0 {
+			nonEmpty = append(nonEmpty, results)
 		}
 	}
-	metricSets := make([][]index.Metric, len(searches))
-	for i, search := range searches {
-		results, err := ti.Search(search)
-		if err != nil {
-			return nil, fmt.Errorf("text index query: error while searching string %v: %v", search, err)
+
+	if len(nonEmpty) == 0 {
+		return metrics, nil
+	}
+	return index.DifferenceMetrics(metrics, index.UnionMetrics(nonEmpty)), nil
+}
+
+// searchTags runs the search for each text-match and text-regex tag
+func (ti *Index) searchTags(tags []string) ([][]index.Metric, error) {
+	metricSets := [][]index.Metric{}
+	for _, tag := range tags {
+		var results []index.Metric
+		var err error
+		switch {
+		case strings.HasPrefix(tag, "text-match:"):
+			search := strings.TrimPrefix(tag, "text-match:")
+			results, err = ti.Search(search)
+			if err != nil {
+				return nil, fmt.Errorf("text index query: error while searching string %v: %v", search, err)
+			}
+		case strings.HasPrefix(tag, "text-regex:"):
+			pattern := strings.TrimPrefix(tag, "text-regex:")
+			results, err = ti.SearchRegex(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("text index query: error while searching regex %v: %v", pattern, err)
+			}
+		default:
+			continue
 		}
-		metricSets[i] = results
+		metricSets = append(metricSets, results)
 	}
-	return index.IntersectMetrics(metricSets), nil
+	return metricSets, nil
 }
 
 func (i *Index) Name() string {
@@ -101,6 +141,11 @@ func (ti *Index) Search(query string) ([]index.Metric, error) {
 	return res, nil
 }
 
+// Indexable reports whether a metric name is long enough to be tokenized.
+func Indexable(metric string) bool {
+	return len(metric) >= n
+}
+
 func (ti *Index) AddMetrics(metrics []string, hashes []index.Metric) error {
 	if len(metrics) == 0 {
 		return fmt.Errorf("text index: cannot add 0 metrics to text index")
@@ -141,3 +186,52 @@ func (ti *Index) AddMetrics(metrics []string, hashes []index.Metric) error {
 	}
 	return nil
 }
+
+// RemoveMetrics drops metrics from the index. The metric names are needed to
+// find which postings lists the metrics are in.
+func (ti *Index) RemoveMetrics(metrics []string, hashes []index.Metric) error {
+	if len(metrics) == 0 {
+		return fmt.Errorf("text index: cannot remove 0 metrics from text index")
+	}
+
+	removedByTrigram := map[trigram]map[index.Metric]bool{}
+	for i, metricName := range metrics {
+		if !Indexable(metricName) {
+			// never made it into the index
+			continue
+		}
+
+		tokens, err := tokenizeWithMarkers(metricName)
+		if err != nil {
+			return fmt.Errorf("text index: could not tokenize %v: %v", metricName, err)
+		}
+
+		for _, token := range tokens {
+			removed, ok := removedByTrigram[token.tri]
+			if !ok {
+				removed = map[index.Metric]bool{}
+				removedByTrigram[token.tri] = removed
+			}
+			removed[hashes[i]] = true
+		}
+	}
+
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+	for trigram, removed := range removedByTrigram {
+		docs := ti.postings[trigram]
+		remaining := make([]document, 0, len(docs))
+		for _, doc := range docs {
+			if !removed[doc.metric] {
+				remaining = append(remaining, doc)
+			}
+		}
+
+		if len(remaining) == 0 {
+			delete(ti.postings, trigram)
+		} else {
+			ti.postings[trigram] = remaining
+		}
+	}
+	return nil
+}
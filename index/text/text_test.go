@@ -130,6 +130,123 @@ func TestSearch(t *testing.T) {
 	searchTest(t, "start/end pinned", emptyIndex, "^foo$", []string{})
 }
 
+func TestRemoveMetrics(t *testing.T) {
+	in := NewIndex()
+	metrics := []string{"foo", "blorgfoo", "mug_foo_ugh"}
+	hashes := index.HashMetrics(metrics)
+	err := in.AddMetrics(metrics, hashes)
+	if err != nil {
+		t.Errorf("addmetrics returned an error: %v", err)
+		return
+	}
+
+	err = in.RemoveMetrics(metrics[:2], hashes[:2])
+	if err != nil {
+		t.Errorf("removemetrics returned an error: %v", err)
+		return
+	}
+
+	searchTest(t, "after removal", in, "foo", []string{"mug_foo_ugh"})
+	searchTest(t, "removed pinned", in, "^foo$", []string{})
+
+	count, _ := tokenCount(in, strigram("^fo"))
+	if count != 0 {
+		t.Errorf("remove metrics test: expected the '^fo' postings list to be gone, but it has %v documents", count)
+	}
+}
+
+func TestNegatedQuery(t *testing.T) {
+	in := NewIndex()
+	metrics := []string{"foo.bar", "foo.baz", "qux.bar"}
+	hashes := index.HashMetrics(metrics)
+	err := in.AddMetrics(metrics, hashes)
+	if err != nil {
+		t.Errorf("addmetrics returned an error: %v", err)
+		return
+	}
+
+	result, err := in.Query(index.NewQuery([]string{"text-match:foo", "!text-match:baz"}))
+	if err != nil {
+		t.Errorf("negated query returned an error: %v", err)
+		return
+	}
+	if len(result) != 1 || result[0] != hashes[0] {
+		t.Errorf("negated query test: expected only 'foo.bar', but got %v", result)
+	}
+
+	_, err = in.Query(index.NewQuery([]string{"!text-match:baz"}))
+	if err == nil {
+		t.Errorf("negated query test: a query with only negated tags should be an error")
+	}
+}
+
+func TestSearchRegex(t *testing.T) {
+	in := NewIndex()
+	metrics := []string{
+		"server.hostname-1234.cpu.i7z",
+		"server.hostname-1235.cpu.i7z",
+		"server.hostname-abcd.cpu.i7z",
+		"lb.www.requests",
+		"monitors.lb_pool.www.lhr",
+	}
+	hashes := index.HashMetrics(metrics)
+	err := in.AddMetrics(metrics, hashes)
+	if err != nil {
+		t.Errorf("addmetrics returned an error: %v", err)
+		return
+	}
+
+	names := map[index.Metric]string{}
+	for i, metric := range metrics {
+		names[hashes[i]] = metric
+	}
+
+	_, err = in.SearchRegex(`hostname-\d+`)
+	if err == nil {
+		t.Errorf("regex search test: searching without a name lookup should be an error")
+	}
+
+	in.SetNameLookup(func(metric index.Metric) (string, bool) {
+		name, ok := names[metric]
+		return name, ok
+	})
+
+	regexSearchTest(t, "digits", in, `hostname-\d+\.cpu`, metrics[:2])
+	regexSearchTest(t, "alternation", in, `^lb\.|lb_pool`, metrics[3:])
+	regexSearchTest(t, "anchored", in, `i7z$`, metrics[:3])
+	regexSearchTest(t, "case insensitive branch", in, `(?i:SERVER)\.hostname-abcd`, metrics[2:3])
+	regexSearchTest(t, "no match", in, `hostname-\d+\.mem`, []string{})
+
+	for _, pattern := range []string{`.*`, `[a-z]+`, `ab|c`, `(foo`} {
+		_, err := in.SearchRegex(pattern)
+		if err == nil {
+			t.Errorf("regex search test: %q should be an error", pattern)
+		}
+	}
+}
+
+func regexSearchTest(t *testing.T, testName string, in *Index, pattern string, expectedResults []string) {
+	results, err := in.SearchRegex(pattern)
+	if err != nil {
+		t.Errorf("regex search test %s: %q returned an error: %v", testName, pattern, err)
+		return
+	}
+
+	expected := index.HashMetrics(expectedResults)
+	index.SortMetrics(expected)
+	if len(results) != len(expected) {
+		t.Errorf("regex search test %s: expected %q to match %v, but got %v", testName, pattern, expectedResults, results)
+		return
+	}
+
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Errorf("regex search test %s: expected %q to match %v, but got %v", testName, pattern, expectedResults, results)
+			return
+		}
+	}
+}
+
 func searchTest(t *testing.T, testName string, in *Index, query string, expectedResults []string) {
 	results, err := in.Search(query)
 	if err != nil {
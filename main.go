@@ -3,6 +3,7 @@ package main
 // handle virt. namespace metric requests from carbon zipper
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -16,13 +17,17 @@ import (
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/kanatohodets/carbonsearch/consumer"
-	"github.com/kanatohodets/carbonsearch/consumer/httpapi"
-	"github.com/kanatohodets/carbonsearch/consumer/kafka"
 	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/database/deadletter"
+	"github.com/kanatohodets/carbonsearch/index"
+	"github.com/kanatohodets/carbonsearch/query"
 	"github.com/kanatohodets/carbonsearch/tag"
 	"github.com/kanatohodets/carbonsearch/util"
+	"github.com/kanatohodets/carbonsearch/util/glob"
+	"github.com/kanatohodets/carbonsearch/util/graphite"
 
 	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
 	"github.com/gogo/protobuf/proto"
@@ -37,18 +42,24 @@ var stats *util.Stats
 
 var virtPrefix string
 
+var virtV2Prefix string
+
+// how long shutting down waits for queries in flight to finish
+const shutdownTimeout = 30 * time.Second
+
 // TODO(btyler) convert tags to byte slices right away so hash functions don't need casting
 func parseQuery(queryLimit int, query string) (map[string][]string, error) {
 	/*
 		parse something like this:
-			'virt.v1.server-state:live.server-hw:intel.lb-pool:www'
+			'virt.v1.server-state:live.server-hw:intel.lb-pool:www.!lb-state:drained'
 		into a map of 'tags' like this:
 			{
 				"server": [ "server-state:live", "server-hw:intel"],
-				"lb": ["lb-pool:www"]
+				"lb": ["lb-pool:www", "!lb-state:drained"]
 			}
 
 		where a 'tag' is a complete "prefix-key:value" item, such as "server-state:live".
+		tags starting with '!' exclude the metrics they match.
 
 		these will be used to search the "left" side of our indexes: tag -> [$join_key, $join_key...]
 	*/
@@ -72,7 +83,8 @@ func parseQuery(queryLimit int, query string) (map[string][]string, error) {
 
 	tagsByService := make(map[string][]string)
 	for _, queryTag := range tags {
-		service, _, err := tag.Parse(queryTag)
+		// '!server-state:maint' excludes metrics tagged 'server-state:maint'
+		service, _, err := tag.Parse(strings.TrimPrefix(queryTag, index.NegationPrefix))
 		if err != nil {
 			return nil, err
 		}
@@ -89,13 +101,119 @@ func parseQuery(queryLimit int, query string) (map[string][]string, error) {
 	return tagsByService, nil
 }
 
-func handleQuery(rawQuery string, query map[string][]string) (pb.GlobResponse, error) {
-	metrics, err := db.Query(query)
+// parseExpr parses a v2 query, like 'virt.v2.(lb-pool:www|lb-pool:api).!server-state:maint'.
+// see the query package for the grammar.
+func parseExpr(queryLimit int, rawQuery string) (query.Expr, error) {
+	expr, err := query.Parse(strings.TrimPrefix(rawQuery, virtV2Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	tags := query.Tags(expr)
+	if len(tags) > queryLimit {
+		return nil, fmt.Errorf(
+			"parseExpr: max query size is %v, but this query has %v tags. try again with a smaller query",
+			queryLimit,
+			len(tags),
+		)
+	}
+
+	for _, queryTag := range tags {
+		service, _, err := tag.Parse(queryTag)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.QueryTagsByService.Add(service, 1)
+	}
+	return expr, nil
+}
+
+// browsing reports whether a query is walking the virtual namespace, like
+// 'virt.v1.*' or 'virt.v1.lb-pool:www.server-dc:*': a last component which
+// doesn't name a whole tag yet, because it's a glob for tag names ('*',
+// 'server-*') or for every value of one ('server-dc:*'), asks for tags rather
+// than metrics. A glob in a tag value, like 'server-dc:us-*', still selects
+// metrics, and so do text filters and regexes, whatever they contain.
+func browsing(rawQuery string) bool {
+	if !strings.HasPrefix(rawQuery, virtPrefix) {
+		return false
+	}
+
+	components := strings.Split(strings.TrimPrefix(rawQuery, virtPrefix), ".")
+	last := components[len(components)-1]
+	if strings.HasPrefix(last, index.NegationPrefix) || strings.HasPrefix(last, "text-") {
+		return false
+	}
+
+	kvMarker := strings.Index(last, ":")
+	if kvMarker == -1 {
+		return glob.IsGlob(last)
+	}
+	return last[kvMarker+1:] == "*"
+}
+
+// handleBrowse finds the tags matching the glob at the end of the query that
+// could be ANDed with the tags before it, and returns them as non-leaf nodes.
+func handleBrowse(queryLimit int, rawQuery string) (pb.GlobResponse, error) {
 	var result pb.GlobResponse
+	components := strings.Split(strings.TrimPrefix(rawQuery, virtPrefix), ".")
+	selected := components[:len(components)-1]
+	pattern := components[len(components)-1]
+
+	queryTags := map[string][]string{}
+	if len(selected) > 0 {
+		var err error
+		queryTags, err = parseQuery(queryLimit, virtPrefix+strings.Join(selected, "."))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	tags, err := db.NextTags(queryTags, pattern)
 	if err != nil {
 		return result, err
 	}
 
+	result.Name = &rawQuery
+	result.Matches = make([]*pb.GlobMatch, 0, len(tags))
+	for _, nextTag := range tags {
+		path := virtPrefix + strings.Join(append(selected, nextTag), ".")
+		result.Matches = append(result.Matches, &pb.GlobMatch{Path: proto.String(path), IsLeaf: proto.Bool(false)})
+	}
+
+	return result, nil
+}
+
+func handleQuery(queryLimit int, rawQuery string) (pb.GlobResponse, error) {
+	if browsing(rawQuery) {
+		return handleBrowse(queryLimit, rawQuery)
+	}
+
+	var result pb.GlobResponse
+	var metrics []string
+	if strings.HasPrefix(rawQuery, virtV2Prefix) {
+		expr, err := parseExpr(queryLimit, rawQuery)
+		if err != nil {
+			return result, err
+		}
+
+		metrics, err = db.QueryExpr(expr)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		queryTags, err := parseQuery(queryLimit, rawQuery)
+		if err != nil {
+			return result, err
+		}
+
+		metrics, err = db.Query(queryTags)
+		if err != nil {
+			return result, err
+		}
+	}
+
 	result.Name = &rawQuery
 	result.Matches = make([]*pb.GlobMatch, 0, len(metrics))
 	for _, metric := range metrics {
@@ -132,22 +250,14 @@ func findHandler(queryLimit int, w http.ResponseWriter, req *http.Request) {
 	}
 
 	rawQuery := queries[0]
-	queryTags, err := parseQuery(queryLimit, rawQuery)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	result, err := handleQuery(rawQuery, queryTags)
+	start := time.Now()
+	result, err := handleQuery(queryLimit, rawQuery)
+	stats.QueryDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	stats.QueryResults.Observe(float64(len(result.Matches)))
 
 	if format == "protobuf" {
 		w.Header().Set("Content-Type", "application/x-protobuf")
@@ -163,13 +273,85 @@ func findHandler(queryLimit int, w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// prometheusHandler exposes the same stats as /debug/vars, for prometheus to
+// scrape
+func prometheusHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := stats.WritePrometheus(w)
+	if err != nil {
+		log.Printf("main: could not write prometheus stats: %s", err)
+	}
+}
+
+// explainHandler answers a v1 query with a breakdown of how the result was
+// reached, rather than the result itself
+func explainHandler(queryLimit int, w http.ResponseWriter, req *http.Request) {
+	rawQuery := req.URL.Query().Get("query")
+	if rawQuery == "" {
+		err := fmt.Errorf("req validation: there must be a 'query' url param")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.HasPrefix(rawQuery, virtV2Prefix) || browsing(rawQuery) {
+		err := fmt.Errorf("main: only v1 queries for metrics can be explained, like %q", virtPrefix+"lb-pool:www.server-dc:lhr")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queryTags, err := parseQuery(queryLimit, rawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(db.Explain(queryTags))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type Config struct {
+	Port             int    `yaml:"port"`
+	QueryLimit       int    `yaml:"query_limit"`
+	ResultLimit      int    `yaml:"result_limit"`
+	SnapshotPath     string `yaml:"snapshot_path"`
+	SnapshotInterval string `yaml:"snapshot_interval"`
+	WALDir           string `yaml:"wal_dir"`
+	RequireReady     bool   `yaml:"require_ready"`
+	Expiry           struct {
+		SweepInterval string            `yaml:"sweep_interval"`
+		DefaultTTL    string            `yaml:"default_ttl"`
+		TTL           map[string]string `yaml:"ttl"`
+	} `yaml:"expiry"`
+	Graphite struct {
+		Address  string `yaml:"address"`
+		Interval string `yaml:"interval"`
+		Prefix   string `yaml:"prefix"`
+	} `yaml:"graphite"`
+	DeadLetters struct {
+		Keep  int    `yaml:"keep"`
+		File  string `yaml:"file"`
+		Kafka struct {
+			BrokerList []string `yaml:"broker_list"`
+			Topic      string   `yaml:"topic"`
+		} `yaml:"kafka"`
+	} `yaml:"dead_letters"`
+	Consumers map[string]string `yaml:"consumers"`
+}
+
 func main() {
 	configPath := flag.String("config", "config.yaml", "Path to the `config file`.")
 	blockingProfile := flag.String("blockProfile", "", "Path to `block profile output file`. Block profiler disabled if empty.")
 	cpuProfile := flag.String("cpuProfile", "", "Path to `cpu profile output file`. CPU profiler disabled if empty.")
-	virtPrefix = *flag.String("prefix", "virt.v1.", "Query prefix")
+	prefix := flag.String("prefix", "virt.v1.", "Query prefix")
+	prefixV2 := flag.String("prefixV2", "virt.v2.", "Query prefix for the boolean (v2) query language")
 	flag.Parse()
 
+	virtPrefix = *prefix
+	virtV2Prefix = *prefixV2
+
 	if *configPath == "" {
 		printUsageErrorAndExit("Can't run without a config file")
 	}
@@ -193,13 +375,6 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	type Config struct {
-		Port        int               `yaml:"port"`
-		QueryLimit  int               `yaml:"query_limit"`
-		ResultLimit int               `yaml:"result_limit"`
-		Consumers   map[string]string `yaml:"consumers"`
-	}
-
 	conf := &Config{}
 	err := util.ReadConfig(*configPath, conf)
 	if err != nil {
@@ -214,65 +389,204 @@ func main() {
 
 	wg := &sync.WaitGroup{}
 	db = database.New(conf.ResultLimit, stats)
-	quit := make(chan bool)
-
-	constructors := map[string]func(string) (consumer.Consumer, error){
-		"kafka": func(confPath string) (consumer.Consumer, error) {
-			c, err := kafka.New(confPath)
-			return c, err
-		},
-		"httpapi": func(confPath string) (consumer.Consumer, error) {
-			c, err := httpapi.New(confPath)
-			return c, err
-		},
-	}
-
-	consumers := []consumer.Consumer{}
-	for consumerName, consumerConfigPath := range conf.Consumers {
-		constructor, ok := constructors[consumerName]
-		if !ok {
-			printErrorAndExit(1, "carbonsearch doesn't know how to create consumer %q. talk to the authors, or remove %q from the list of consumers in %q", consumerName, consumerName, *configPath)
+	applyLimits(conf)
+
+	var snapshotInterval time.Duration
+	if conf.SnapshotPath != "" {
+		snapshotInterval, err = time.ParseDuration(conf.SnapshotInterval)
+		if err != nil {
+			printErrorAndExit(1, "could not parse snapshot_interval %q: %s", conf.SnapshotInterval, err)
+		}
+		if snapshotInterval <= 0 {
+			printErrorAndExit(1, "snapshot_interval must be positive, but it is %q", conf.SnapshotInterval)
 		}
-		consumer, err := constructor(consumerConfigPath)
+
+		err = db.LoadSnapshot(conf.SnapshotPath)
 		if err != nil {
-			printErrorAndExit(1, "could not create new %s consumer: %s", consumerName, err)
+			if !os.IsNotExist(err) {
+				printErrorAndExit(1, "could not load snapshot: %s", err)
+			}
+			log.Printf("no snapshot found at %q, starting with an empty database", conf.SnapshotPath)
+		} else {
+			log.Printf("loaded snapshot from %q", conf.SnapshotPath)
 		}
+	}
 
-		err = consumer.Start(wg, db)
+	// replay anything that arrived after the snapshot was taken
+	if conf.WALDir != "" {
+		err = db.OpenLog(conf.WALDir)
 		if err != nil {
-			printErrorAndExit(1, "could not start %s consumer: %s", consumerName, err)
+			printErrorAndExit(1, "could not open write-ahead log: %s", err)
 		}
+	}
 
-		consumers = append(consumers, consumer)
+	if conf.SnapshotPath != "" {
+		go writeSnapshots(conf.SnapshotPath, snapshotInterval)
 	}
 
-	go func() {
-		http.HandleFunc("/metrics/find/", func(w http.ResponseWriter, req *http.Request) {
-			findHandler(conf.QueryLimit, w, req)
-		})
+	// closed at shutdown, so that nothing is expired after the final snapshot
+	stopSweep := make(chan bool)
+	if conf.Expiry.SweepInterval != "" {
+		sweepInterval, err := time.ParseDuration(conf.Expiry.SweepInterval)
+		if err != nil || sweepInterval <= 0 {
+			printErrorAndExit(1, "expiry sweep_interval should be a positive duration, but it is %q", conf.Expiry.SweepInterval)
+		}
 
-		portStr := fmt.Sprintf(":%d", conf.Port)
-		log.Println("Starting carbonsearch", BuildVersion)
-		log.Printf("listening on %s\n", portStr)
-		log.Println(http.ListenAndServe(portStr, nil))
-	}()
+		ttls := database.TTLs{ByKey: map[string]time.Duration{}}
+		if conf.Expiry.DefaultTTL != "" {
+			ttls.Default, err = time.ParseDuration(conf.Expiry.DefaultTTL)
+			if err != nil {
+				printErrorAndExit(1, "could not parse expiry default_ttl %q: %s", conf.Expiry.DefaultTTL, err)
+			}
+		}
 
-	go func() {
-		signals := make(chan os.Signal, 1)
-		signal.Notify(signals, os.Kill, os.Interrupt)
-		<-signals
-		log.Println("Shutting down...")
-		for _, consumer := range consumers {
-			err := consumer.Stop()
+		for key, rawTTL := range conf.Expiry.TTL {
+			ttls.ByKey[key], err = time.ParseDuration(rawTTL)
 			if err != nil {
-				log.Printf("Failed to close consumer %s: %s", consumer.Name(), err)
+				printErrorAndExit(1, "could not parse expiry ttl for %q (%q): %s", key, rawTTL, err)
 			}
 		}
 
-		quit <- true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.Sweep(sweepInterval, ttls, stopSweep)
+		}()
+	}
+
+	if conf.Graphite.Address != "" {
+		interval, err := time.ParseDuration(conf.Graphite.Interval)
+		if err != nil {
+			printErrorAndExit(1, "could not parse graphite interval %q: %s", conf.Graphite.Interval, err)
+		}
+
+		reporter, err := graphite.New(conf.Graphite.Address, interval, conf.Graphite.Prefix)
+		if err != nil {
+			printErrorAndExit(1, "could not set up graphite reporting: %s", err)
+		}
+		go reporter.Run()
+	}
+
+	if conf.DeadLetters.Keep > 0 {
+		sink, err := deadLetterSink(conf.DeadLetters.File, conf.DeadLetters.Kafka.BrokerList, conf.DeadLetters.Kafka.Topic)
+		if err != nil {
+			printErrorAndExit(1, "could not set up dead letters: %s", err)
+		}
+
+		queue, err := deadletter.NewQueue(sink, conf.DeadLetters.Keep)
+		if err != nil {
+			printErrorAndExit(1, "could not set up dead letters: %s", err)
+		}
+		db.SetDeadLetters(queue)
+	}
+
+	consumers := newConsumerSet(wg)
+	err = consumers.Sync(conf.Consumers)
+	if err != nil {
+		printErrorAndExit(1, "%s (in %q)", err, *configPath)
+	}
+
+	ready := newReadiness(consumers.List)
+	reloader := &reloader{path: *configPath, consumers: consumers}
+
+	http.HandleFunc("/metrics/find/", ready.gate(conf.RequireReady, func(w http.ResponseWriter, req *http.Request) {
+		findHandler(loadQueryLimit(), w, req)
+	}))
+	http.HandleFunc("/metrics/explain/", ready.gate(conf.RequireReady, func(w http.ResponseWriter, req *http.Request) {
+		explainHandler(loadQueryLimit(), w, req)
+	}))
+	http.HandleFunc("/metrics", prometheusHandler)
+	http.HandleFunc("/tags", ready.gate(conf.RequireReady, tagsHandler))
+	http.HandleFunc("/tags/", ready.gate(conf.RequireReady, tagsHandler))
+	http.HandleFunc("/metrics/tags/", ready.gate(conf.RequireReady, metricTagsHandler))
+	http.HandleFunc("/admin/deadletters", deadLettersHandler)
+	http.HandleFunc("/admin/deadletters/replay", replayDeadLettersHandler)
+	http.HandleFunc("/health/live", liveHandler)
+	http.HandleFunc("/health/ready", ready.readyHandler)
+	http.HandleFunc("/admin/reload", reloader.reloadHandler)
+
+	portStr := fmt.Sprintf(":%d", conf.Port)
+	server := &http.Server{Addr: portStr}
+	go func() {
+		log.Println("Starting carbonsearch", BuildVersion)
+		log.Printf("listening on %s\n", portStr)
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Println(err)
+		}
 	}()
 
+	// os.Kill can't be caught, so SIGTERM is the polite way to ask
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	var sig os.Signal
+	for sig = range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		err := reloader.Reload()
+		if err != nil {
+			log.Printf("failed to reload: %s", err)
+		}
+	}
+	log.Printf("got %s, shutting down...", sig)
+	// a second SIGTERM or interrupt kills carbonsearch straight away, in case
+	// the drain hangs. a SIGHUP would too, so those are ignored from now on
+	signal.Stop(signals)
+	signal.Ignore(syscall.SIGHUP)
+
+	// queries are still answered while the consumers finish what they have
+	consumers.StopAll()
+	close(stopSweep)
 	wg.Wait()
+
+	// with the consumers and the sweep stopped, this has everything they ever
+	// applied, and nothing is expired behind its back
+	if conf.SnapshotPath != "" {
+		start := time.Now()
+		err := db.WriteSnapshot(conf.SnapshotPath)
+		if err != nil {
+			log.Printf("failed to write final snapshot: %s", err)
+		} else {
+			log.Printf("wrote final snapshot to %q in %v", conf.SnapshotPath, time.Since(start))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	err = server.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("failed to finish serving queries: %s", err)
+	}
+
+	err = db.CloseLog()
+	if err != nil {
+		log.Printf("failed to close write-ahead log: %s", err)
+	}
+
+	if queue := db.DeadLetters(); queue != nil {
+		err = queue.Close()
+		if err != nil {
+			log.Printf("failed to close dead letters: %s", err)
+		}
+	}
+
+	log.Println("carbonsearch stopped")
+}
+
+func writeSnapshots(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		err := db.WriteSnapshot(path)
+		if err != nil {
+			log.Printf("failed to write snapshot: %s", err)
+			continue
+		}
+		log.Printf("wrote snapshot to %q in %v", path, time.Since(start))
+	}
 }
 
 func printErrorAndExit(code int, format string, values ...interface{}) {
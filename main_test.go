@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	m "github.com/kanatohodets/carbonsearch/consumer/message"
+	"github.com/kanatohodets/carbonsearch/database"
+	"github.com/kanatohodets/carbonsearch/util"
+
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+)
+
+func TestMain(main *testing.M) {
+	virtPrefix = "virt.v1."
+	virtV2Prefix = "virt.v2."
+	stats = util.InitStats()
+	db = database.New(100, stats)
+
+	err := db.InsertMetrics(&m.KeyMetric{
+		Key:     "fqdn",
+		Value:   "hostname-1234",
+		Metrics: []string{"server.hostname-1234.cpu", "server.hostname-1234.replication.delay"},
+	})
+	if err == nil {
+		err = db.InsertTags(&m.KeyTag{
+			Key:   "fqdn",
+			Value: "hostname-1234",
+			Tags:  []string{"server-state:live", "server-dc:us-east"},
+		})
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	os.Exit(main.Run())
+}
+
+// matches returns the paths in a response, sorted, and whether they're all
+// leaves (or all not)
+func matches(t *testing.T, result pb.GlobResponse, leaf bool) []string {
+	paths := []string{}
+	for _, match := range result.Matches {
+		if *match.IsLeaf != leaf {
+			t.Errorf("main test: expected %s to have IsLeaf %v", *match.Path, leaf)
+		}
+		paths = append(paths, *match.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestHandleQuery(t *testing.T) {
+	tests := map[string][]string{
+		`virt.v1.text-regex:hostname-[0-9]+\Wcpu`:        {"server.hostname-1234.cpu"},
+		"virt.v1.server-state:live.text-filter:repl*":    {"server.hostname-1234.replication.delay"},
+		"virt.v1.server-dc:us-*":                         {"server.hostname-1234.cpu", "server.hostname-1234.replication.delay"},
+		"virt.v1.server-dc:us-*.!text-filter:replicat*":  {"server.hostname-1234.cpu"},
+		"virt.v1.server-state:live.server-dc:{us,eu}-*":  {"server.hostname-1234.cpu", "server.hostname-1234.replication.delay"},
+		"virt.v1.server-state:live.server-dc:eu-[a-z]*":  {},
+		"virt.v1.server-dc:us-east.text-regex:cpu[0-9]*": {"server.hostname-1234.cpu"},
+	}
+
+	for query, expected := range tests {
+		result, err := handleQuery(100, query)
+		if err != nil {
+			t.Errorf("main test: %q failed: %s", query, err)
+			continue
+		}
+		paths := matches(t, result, true)
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("main test: expected %q to find metrics %v, but got %v", query, expected, paths)
+		}
+	}
+}
+
+func TestTagsHandler(t *testing.T) {
+	names := func() string {
+		w := httptest.NewRecorder()
+		tagsHandler(w, httptest.NewRequest("GET", "/tags/autoComplete/tags", nil))
+		return strings.TrimSpace(w.Body.String())
+	}
+
+	expected := `["server-dc","server-state"]`
+	if got := names(); got != expected {
+		t.Errorf("main test: expected the tag names %s, but got %s", expected, got)
+	}
+
+	// the cached tags are rebuilt once the database's tags change
+	rack := &m.KeyTag{Key: "fqdn", Value: "hostname-1234", Tags: []string{"server-rack:r1"}}
+	err := db.InsertTags(rack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteTags(&m.DeleteKeyTag{Key: rack.Key, Value: rack.Value, Tags: rack.Tags})
+
+	expected = `["server-dc","server-rack","server-state"]`
+	if got := names(); got != expected {
+		t.Errorf("main test: expected the tag names %s after adding one, but got %s", expected, got)
+	}
+}
+
+func TestHandleBrowse(t *testing.T) {
+	tests := map[string][]string{
+		"virt.v1.*":                             {"virt.v1.server-dc:us-east", "virt.v1.server-state:live"},
+		"virt.v1.server-*":                      {"virt.v1.server-dc:us-east", "virt.v1.server-state:live"},
+		"virt.v1.server-dc:*":                   {"virt.v1.server-dc:us-east"},
+		"virt.v1.server-state:live.server-dc:*": {"virt.v1.server-state:live.server-dc:us-east"},
+	}
+
+	for query, expected := range tests {
+		result, err := handleQuery(100, query)
+		if err != nil {
+			t.Errorf("main test: %q failed: %s", query, err)
+			continue
+		}
+		paths := matches(t, result, false)
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("main test: expected %q to list tags %v, but got %v", query, expected, paths)
+		}
+	}
+}
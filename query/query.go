@@ -0,0 +1,211 @@
+package query
+
+/*
+
+this package parses the v2 query language: boolean expressions over tags that
+still fit in a graphite metric path. the query is split on full stops, and
+each component is ANDed together, just like v1:
+
+	virt.v2.lb-pool:www.server-state:live
+
+inside a component, tags can be combined with '|' (or), '&' (and) and '!'
+(not), and grouped with parentheses. '!' binds tightest, then '&', then '|':
+
+	virt.v2.(lb-pool:www|lb-pool:api).!server-state:maint
+
+the query is parsed into a tree of Exprs, which the database evaluates.
+
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expr is a node in a parsed query.
+type Expr interface {
+	String() string
+}
+
+// Tag matches the metrics associated with a single "service-key:value" tag.
+type Tag struct {
+	Raw string
+}
+
+// And matches the metrics matched by every one of its children.
+type And struct {
+	Children []Expr
+}
+
+// Or matches the metrics matched by any of its children.
+type Or struct {
+	Children []Expr
+}
+
+// Not matches every metric that its child doesn't match.
+type Not struct {
+	Child Expr
+}
+
+func (t *Tag) String() string { return t.Raw }
+func (a *And) String() string { return join(a.Children, "&") }
+func (o *Or) String() string  { return join(o.Children, "|") }
+func (n *Not) String() string { return "!" + n.Child.String() }
+
+func join(children []Expr, op string) string {
+	parts := make([]string, len(children))
+	for i, child := range children {
+		parts[i] = child.String()
+	}
+	return "(" + strings.Join(parts, op) + ")"
+}
+
+// Tags returns every tag mentioned in the expression, in the order they appear.
+func Tags(expr Expr) []string {
+	tags := []string{}
+	var walk func(Expr)
+	walk = func(expr Expr) {
+		switch e := expr.(type) {
+		case *Tag:
+			tags = append(tags, e.Raw)
+		case *And:
+			for _, child := range e.Children {
+				walk(child)
+			}
+		case *Or:
+			for _, child := range e.Children {
+				walk(child)
+			}
+		case *Not:
+			walk(e.Child)
+		}
+	}
+	walk(expr)
+	return tags
+}
+
+// Parse parses a v2 query (without the 'virt.v2.' prefix) into an expression.
+func Parse(raw string) (Expr, error) {
+	components := strings.Split(raw, ".")
+	exprs := make([]Expr, 0, len(components))
+	for i, component := range components {
+		if component == "" {
+			return nil, fmt.Errorf("query: component %d of %q is empty", i+1, raw)
+		}
+
+		p := &parser{input: component}
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.pos != len(p.input) {
+			return nil, p.errorf("unexpected %q", p.input[p.pos])
+		}
+		exprs = append(exprs, expr)
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return &And{Children: exprs}, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query: error in %q at position %d: %s", p.input, p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// or := and ('|' and)*
+func (p *parser) parseOr() (Expr, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []Expr{first}
+	for p.peek() == '|' {
+		p.pos++
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &Or{Children: children}, nil
+}
+
+// and := unary ('&' unary)*
+func (p *parser) parseAnd() (Expr, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []Expr{first}
+	for p.peek() == '&' {
+		p.pos++
+		next, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &And{Children: children}, nil
+}
+
+// unary := '!' unary | '(' or ')' | tag
+func (p *parser) parseUnary() (Expr, error) {
+	switch p.peek() {
+	case '!':
+		p.pos++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Child: child}, nil
+	case '(':
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return expr, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune("|&!()", rune(p.input[p.pos])) {
+		p.pos++
+	}
+
+	if p.pos == start {
+		if p.pos == len(p.input) {
+			return nil, p.errorf("expected a tag, but the expression ended")
+		}
+		return nil, p.errorf("expected a tag, but got %q", p.input[p.pos])
+	}
+	return &Tag{Raw: p.input[start:p.pos]}, nil
+}
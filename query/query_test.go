@@ -0,0 +1,72 @@
+package query
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]string{
+		"lb-pool:www":                                   "lb-pool:www",
+		"lb-pool:www.server-state:live":                 "(lb-pool:www&server-state:live)",
+		"lb-pool:www|lb-pool:api":                       "(lb-pool:www|lb-pool:api)",
+		"!server-state:maint":                           "!server-state:maint",
+		"a-b:c|a-b:d&a-b:e":                             "(a-b:c|(a-b:d&a-b:e))",
+		"(a-b:c|a-b:d)&a-b:e":                           "((a-b:c|a-b:d)&a-b:e)",
+		"!(a-b:c|a-b:d)":                                "!(a-b:c|a-b:d)",
+		"(lb-pool:www|lb-pool:api).!server-state:maint": "((lb-pool:www|lb-pool:api)&!server-state:maint)",
+	}
+
+	for raw, expected := range cases {
+		expr, err := Parse(raw)
+		if err != nil {
+			t.Errorf("query test: could not parse %q: %s", raw, err)
+			continue
+		}
+
+		if expr.String() != expected {
+			t.Errorf("query test: expected %q to parse as %q, but got %q", raw, expected, expr.String())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := []string{
+		"",
+		"a-b:c..a-b:d",
+		"(a-b:c",
+		"a-b:c)",
+		"a-b:c|",
+		"&a-b:c",
+		"!",
+		"()",
+	}
+
+	for _, raw := range invalid {
+		expr, err := Parse(raw)
+		if err == nil {
+			t.Errorf("query test: %q should not parse, but it parsed as %s", raw, expr)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	expr, err := Parse("(lb-pool:www|lb-pool:api).!server-state:maint")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := []string{"lb-pool:www", "lb-pool:api", "server-state:maint"}
+	tags := Tags(expr)
+	if len(tags) != len(expected) {
+		t.Errorf("query test: expected tags %q, but got %q", expected, tags)
+		return
+	}
+
+	for i := range expected {
+		if tags[i] != expected[i] {
+			t.Errorf("query test: expected tags %q, but got %q", expected, tags)
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// reloading config.yaml without a restart, on SIGHUP or a POST to
+// /admin/reload. the limits and the consumers (including their own config
+// files) are reloaded; anything else needs a restart. the index is kept
+// either way.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+// the maximum number of tags in a query, which can change on reload
+var currentQueryLimit int64
+
+func loadQueryLimit() int {
+	return int(atomic.LoadInt64(&currentQueryLimit))
+}
+
+// checkReload makes sure that conf can be reloaded before any of it is put
+// into effect, so a mistake doesn't leave things half changed
+func checkReload(conf *Config) error {
+	if len(conf.Consumers) == 0 {
+		return fmt.Errorf("there aren't any consumers")
+	}
+	if conf.QueryLimit <= 0 {
+		return fmt.Errorf("query_limit must be positive, but it is %d", conf.QueryLimit)
+	}
+	if conf.ResultLimit <= 0 {
+		return fmt.Errorf("result_limit must be positive, but it is %d", conf.ResultLimit)
+	}
+
+	for name, path := range conf.Consumers {
+		_, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read config for %s consumer: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// applyLimits puts the limits from conf into effect
+func applyLimits(conf *Config) {
+	atomic.StoreInt64(&currentQueryLimit, int64(conf.QueryLimit))
+	db.SetQueryLimit(conf.ResultLimit)
+}
+
+type reloader struct {
+	path      string
+	consumers *consumerSet
+
+	// one reload at a time
+	mutex sync.Mutex
+}
+
+func (r *reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	conf := &Config{}
+	err := util.ReadConfig(r.path, conf)
+	if err != nil {
+		return err
+	}
+
+	err = checkReload(conf)
+	if err != nil {
+		return fmt.Errorf("%q wasn't reloaded: %s", r.path, err)
+	}
+
+	// the limits are left alone unless the whole reload works
+	err = r.consumers.Sync(conf.Consumers)
+	if err != nil {
+		return fmt.Errorf("%q was only partly reloaded, and the limits weren't changed: %s", r.path, err)
+	}
+
+	applyLimits(conf)
+	log.Printf("reloaded %q: query_limit is %d, result_limit is %d", r.path, conf.QueryLimit, conf.ResultLimit)
+	return nil
+}
+
+func (r *reloader) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "reloading needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.Reload()
+	if err != nil {
+		log.Printf("failed to reload: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "reloaded")
+}
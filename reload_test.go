@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kanatohodets/carbonsearch/consumer"
+	"github.com/kanatohodets/carbonsearch/database"
+)
+
+// reloadConsumer does nothing, except fail to start if its config says so
+type reloadConsumer struct {
+	name string
+	fail bool
+}
+
+func init() {
+	consumer.Register("reload-test", func(name string, configPath string) (consumer.Consumer, error) {
+		config, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		return &reloadConsumer{name: name, fail: strings.Contains(string(config), "fail")}, nil
+	})
+}
+
+func (r *reloadConsumer) Start(*sync.WaitGroup, *database.Database) error {
+	if r.fail {
+		return fmt.Errorf("reload-test consumer: failing, as configured")
+	}
+	return nil
+}
+
+func (r *reloadConsumer) Stop() error    { return nil }
+func (r *reloadConsumer) CaughtUp() bool { return true }
+func (r *reloadConsumer) Name() string   { return r.name }
+
+func writeConfig(t *testing.T, path string, contents string) {
+	err := ioutil.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runningNames(consumers *consumerSet) []string {
+	consumers.mutex.Lock()
+	defer consumers.mutex.Unlock()
+	return consumers.runningNames()
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonsearch-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig(t, filepath.Join(dir, "good.yaml"), "type: reload-test\n")
+	writeConfig(t, filepath.Join(dir, "bad.yaml"), "type: reload-test\n# fail\n")
+
+	path := filepath.Join(dir, "config.yaml")
+	r := &reloader{path: path, consumers: newConsumerSet(&sync.WaitGroup{})}
+
+	writeConfig(t, path, fmt.Sprintf(`
+query_limit: 50
+result_limit: 1000
+consumers:
+    good: %q
+`, filepath.Join(dir, "good.yaml")))
+	err = r.Reload()
+	if err != nil {
+		t.Fatalf("main test: could not reload a good config: %s", err)
+	}
+	if loadQueryLimit() != 50 {
+		t.Errorf("main test: expected query_limit to be reloaded as 50, but it is %d", loadQueryLimit())
+	}
+
+	bad := map[string]string{
+		"a missing result_limit": fmt.Sprintf(`
+query_limit: 60
+consumers:
+    good: %q
+    other: %q
+`, filepath.Join(dir, "good.yaml"), filepath.Join(dir, "good.yaml")),
+		"a missing consumer config": fmt.Sprintf(`
+query_limit: 60
+result_limit: 1000
+consumers:
+    good: %q
+    other: %q
+`, filepath.Join(dir, "good.yaml"), filepath.Join(dir, "missing.yaml")),
+	}
+	for desc, config := range bad {
+		writeConfig(t, path, config)
+		err = r.Reload()
+		if err == nil {
+			t.Errorf("main test: expected an error reloading a config with %s", desc)
+		}
+		if loadQueryLimit() != 50 {
+			t.Errorf("main test: the limits were changed by reloading a config with %s", desc)
+		}
+		names := runningNames(r.consumers)
+		if len(names) != 1 || names[0] != "good" {
+			t.Errorf("main test: the consumers were changed by reloading a config with %s: %v are running", desc, names)
+		}
+	}
+
+	writeConfig(t, path, fmt.Sprintf(`
+query_limit: 60
+result_limit: 1000
+consumers:
+    good: %q
+    bad: %q
+`, filepath.Join(dir, "good.yaml"), filepath.Join(dir, "bad.yaml")))
+	err = r.Reload()
+	if err == nil || !strings.Contains(err.Error(), "left stopped: bad") {
+		t.Errorf("main test: expected an error saying the bad consumer is left stopped, but got %v", err)
+	}
+	if loadQueryLimit() != 50 {
+		t.Errorf("main test: the limits were changed by a reload which failed to start a consumer")
+	}
+	names := runningNames(r.consumers)
+	if len(names) != 1 || names[0] != "good" {
+		t.Errorf("main test: expected only the good consumer to be running, but %v are", names)
+	}
+}
+
+func TestReloadAfterStopAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbonsearch-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig(t, filepath.Join(dir, "good.yaml"), "type: reload-test\n")
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, fmt.Sprintf(`
+query_limit: 50
+result_limit: 1000
+consumers:
+    good: %q
+`, filepath.Join(dir, "good.yaml")))
+
+	r := &reloader{path: path, consumers: newConsumerSet(&sync.WaitGroup{})}
+	err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.consumers.StopAll()
+	err = r.Reload()
+	if err == nil {
+		t.Errorf("main test: expected an error reloading after the consumers were stopped for shutdown")
+	}
+	if names := runningNames(r.consumers); len(names) != 0 {
+		t.Errorf("main test: a reload after StopAll started %v", names)
+	}
+}
@@ -23,3 +23,15 @@ func Parse(tag string) (string, string, error) {
 	kv := tag[serviceDelimiter+1:]
 	return service, kv, nil
 }
+
+// Split separates a "service-key:value" tag into its name, "service-key", and
+// its value. If the tag is malformed an error is returned.
+func Split(tag string) (string, string, error) {
+	_, _, err := Parse(tag)
+	if err != nil {
+		return "", "", err
+	}
+
+	kvMarker := strings.Index(tag, ":")
+	return tag[:kvMarker], tag[kvMarker+1:], nil
+}
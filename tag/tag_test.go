@@ -47,3 +47,27 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestSplit(t *testing.T) {
+	validCases := map[string][]string{
+		"server-state:live":                          {"server-state", "live"},
+		"server-interfaces:eth1:ip_address:10_1_2_3": {"server-interfaces", "eth1:ip_address:10_1_2_3"},
+	}
+
+	for valid, expected := range validCases {
+		name, value, err := Split(valid)
+		if err != nil {
+			t.Errorf("tag test: %q failed to split: %q", valid, err)
+			continue
+		}
+
+		if name != expected[0] || value != expected[1] {
+			t.Errorf("tag test: %q ought to split into %q, but it split into %q and %q", valid, expected, name, value)
+		}
+	}
+
+	_, _, err := Split("dc:lhr")
+	if err == nil {
+		t.Errorf("tag test: 'dc:lhr' should not split, since it isn't a valid tag")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+// graphite-style tag discovery, so that dashboards can find out which tags exist:
+//
+//	/tags                               every tag name ("server-dc")
+//	/tags/server-dc                     the values of one tag, with counts
+//	/tags/autoComplete/tags?tagPrefix=server-
+//	/tags/autoComplete/values?tag=server-dc&valuePrefix=us-
+//
+// and the reverse, for finding out why a metric shows up in a query:
+//
+//	/metrics/tags/?metric=server.hostname-1234.cpu.i7z
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kanatohodets/carbonsearch/tag"
+
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/gogo/protobuf/proto"
+)
+
+// graphite's default for the autoComplete endpoints
+const defaultAutoCompleteLimit = 100
+
+type tagName struct {
+	Tag string `json:"tag"`
+}
+
+type tagValue struct {
+	Count int    `json:"count"`
+	Value string `json:"value"`
+}
+
+type tagValues struct {
+	Tag    string     `json:"tag"`
+	Values []tagValue `json:"values"`
+}
+
+// tagDictionary is every tag in the database, grouped by name. it's only
+// rebuilt when the database's tags change, rather than on every request.
+type tagDictionary struct {
+	version uint64
+	// like this:
+	//
+	//	{
+	//		"server-dc": {"lhr": 3, "ams": 5},
+	//		"lb-pool": {"www": 10}
+	//	}
+	byName map[string]map[string]int
+	// the number of values of each name
+	names map[string]int
+}
+
+var (
+	tagDictionaryMutex sync.Mutex
+	cachedTags         *tagDictionary
+)
+
+// currentTags returns the tag dictionary, rebuilding it if the database's tags
+// have changed since it was last built. It must not be modified.
+func currentTags() *tagDictionary {
+	// read before the tags, so that a change while they're being read makes
+	// the next request rebuild it again
+	version := db.TagsVersion()
+
+	tagDictionaryMutex.Lock()
+	defer tagDictionaryMutex.Unlock()
+
+	if cachedTags != nil && cachedTags.version == version {
+		return cachedTags
+	}
+
+	byName := tagsByName()
+	names := make(map[string]int, len(byName))
+	for name, values := range byName {
+		names[name] = len(values)
+	}
+	cachedTags = &tagDictionary{version: version, byName: byName, names: names}
+	return cachedTags
+}
+
+// tagsByName groups every tag in the database by name
+func tagsByName() map[string]map[string]int {
+	byName := map[string]map[string]int{}
+	for fullTag, count := range db.TagCounts() {
+		name, value, err := tag.Split(fullTag)
+		if err != nil {
+			// only valid tags make it into the indexes
+			log.Printf("tags: skipping invalid tag in the database: %s", err)
+			continue
+		}
+
+		values, ok := byName[name]
+		if !ok {
+			values = map[string]int{}
+			byName[name] = values
+		}
+		values[value] = count
+	}
+	return byName
+}
+
+// matching returns the sorted keys of set which start with prefix, up to
+// limit of them (0 means no limit)
+func matching(set map[string]int, prefix string, limit int) []string {
+	keys := []string{}
+	for key := range set {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+func tagsHandler(w http.ResponseWriter, req *http.Request) {
+	stats.TagQueriesHandled.Add(1)
+	params := req.URL.Query()
+
+	format := params.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "protobuf" && format != "json" {
+		err := fmt.Errorf("main: %q is not a recognized format: known formats are 'protobuf' and 'json'", format)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/tags"), "/")
+
+	limit := 0
+	if strings.HasPrefix(path, "autoComplete/") {
+		limit = defaultAutoCompleteLimit
+	}
+	if rawLimit := params.Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 0 {
+			err := fmt.Errorf("req validation: 'limit' should be a number of results, but it is %q", rawLimit)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tags := currentTags()
+	byName := tags.byName
+	names := tags.names
+
+	switch path {
+	case "":
+		found := matching(names, params.Get("filter"), limit)
+		result := make([]tagName, len(found))
+		for i, name := range found {
+			result[i] = tagName{name}
+		}
+		writeTags(w, format, req.URL.Path, found, false, result)
+
+	case "autoComplete/tags":
+		found := matching(names, params.Get("tagPrefix"), limit)
+		writeTags(w, format, req.URL.Path, found, false, found)
+
+	case "autoComplete/values":
+		name := params.Get("tag")
+		if name == "" {
+			err := fmt.Errorf("req validation: there must be a 'tag' url param")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		found := matching(byName[name], params.Get("valuePrefix"), limit)
+		writeTags(w, format, req.URL.Path, found, true, found)
+
+	default:
+		values := byName[path]
+		found := matching(values, params.Get("filter"), limit)
+		result := tagValues{Tag: path, Values: make([]tagValue, len(found))}
+		for i, value := range found {
+			result.Values[i] = tagValue{Count: values[value], Value: value}
+		}
+		writeTags(w, format, req.URL.Path, found, true, result)
+	}
+}
+
+// metricTagsHandler lists every tag which would select a metric
+func metricTagsHandler(w http.ResponseWriter, req *http.Request) {
+	stats.TagQueriesHandled.Add(1)
+
+	metric := req.URL.Query().Get("metric")
+	if metric == "" {
+		err := fmt.Errorf("req validation: there must be a 'metric' url param")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.TagsForMetric(metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeTags sends either the JSON result, or a protobuf glob response with one
+// match per name
+func writeTags(w http.ResponseWriter, format string, query string, names []string, leaf bool, result interface{}) {
+	if format == "protobuf" {
+		response := pb.GlobResponse{
+			Name:    proto.String(query),
+			Matches: make([]*pb.GlobMatch, 0, len(names)),
+		}
+		for _, name := range names {
+			response.Matches = append(response.Matches, &pb.GlobMatch{Path: proto.String(name), IsLeaf: proto.Bool(leaf)})
+		}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		b, _ := response.Marshal()
+		w.Write(b)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,82 @@
+package glob
+
+// graphite-style globs, for matching tag values: 'server-dc:us-*', 'server-hw:{dell,hp}'
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const specialChars = "*?{["
+
+// IsGlob reports whether s has any glob syntax in it. Strings without any are
+// matched exactly.
+func IsGlob(s string) bool {
+	return strings.ContainsAny(s, specialChars)
+}
+
+// Compile turns a glob into a regular expression which matches whole strings.
+// '*' matches any number of characters, '?' matches exactly one, '{a,b}'
+// matches either alternative, and '[a-z]' matches a character class. As in
+// graphite, none of them match a full stop.
+func Compile(pattern string) (*regexp.Regexp, error) {
+	var expr bytes.Buffer
+	expr.WriteString("^")
+
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*':
+			expr.WriteString(`[^.]*`)
+		case c == '?':
+			expr.WriteString(`[^.]`)
+		case c == '{':
+			depth++
+			expr.WriteString("(?:")
+		case c == '}' && depth > 0:
+			depth--
+			expr.WriteString(")")
+		case c == ',' && depth > 0:
+			expr.WriteString("|")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("glob: %q has an unclosed '['", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if class == "" {
+				return nil, fmt.Errorf("glob: %q has an empty character class", pattern)
+			}
+			expr.WriteString("[")
+			expr.WriteString(strings.Replace(class, `\`, `\\`, -1))
+			expr.WriteString("]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if depth != 0 {
+		return nil, fmt.Errorf("glob: %q has an unclosed '{'", pattern)
+	}
+
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("glob: could not compile %q: %s", pattern, err)
+	}
+	return re, nil
+}
+
+// Literal returns the part of pattern before the first glob character: every
+// string the glob matches starts with it.
+func Literal(pattern string) string {
+	end := strings.IndexAny(pattern, specialChars)
+	if end == -1 {
+		return pattern
+	}
+	return pattern[:end]
+}
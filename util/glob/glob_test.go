@@ -0,0 +1,63 @@
+package glob
+
+import (
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	cases := []struct {
+		pattern string
+		matches []string
+		misses  []string
+	}{
+		{"server-dc:us-*", []string{"server-dc:us-east", "server-dc:us-"}, []string{"server-dc:eu-west", "server-dc:us"}},
+		{"server-rack:?1", []string{"server-rack:a1", "server-rack:b1"}, []string{"server-rack:1", "server-rack:ab1"}},
+		{"server-hw:{dell,hp}", []string{"server-hw:dell", "server-hw:hp"}, []string{"server-hw:ibm", "server-hw:dellhp"}},
+		{"server-hw:{dell,hp-{g8,g9}}", []string{"server-hw:hp-g9"}, []string{"server-hw:hp-g7"}},
+		{"server-rack:[a-c]1", []string{"server-rack:b1"}, []string{"server-rack:d1"}},
+		{"lb-pool:w.w", []string{"lb-pool:w.w"}, []string{"lb-pool:wxw"}},
+		{"server-dc:*", []string{"server-dc:lhr"}, []string{"server-dc:a.b"}},
+	}
+
+	for _, c := range cases {
+		re, err := Compile(c.pattern)
+		if err != nil {
+			t.Errorf("glob test: could not compile %q: %s", c.pattern, err)
+			continue
+		}
+
+		for _, match := range c.matches {
+			if !re.MatchString(match) {
+				t.Errorf("glob test: expected %q to match %q", c.pattern, match)
+			}
+		}
+
+		for _, miss := range c.misses {
+			if re.MatchString(miss) {
+				t.Errorf("glob test: expected %q not to match %q", c.pattern, miss)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"server-hw:{dell", "server-rack:[a-c", "server-rack:[]"} {
+		_, err := Compile(invalid)
+		if err == nil {
+			t.Errorf("glob test: %q should not compile", invalid)
+		}
+	}
+}
+
+func TestLiteral(t *testing.T) {
+	cases := map[string]string{
+		"server-dc:us-*":      "server-dc:us-",
+		"server-hw:{dell,hp}": "server-hw:",
+		"server-dc:lhr":       "server-dc:lhr",
+	}
+
+	for pattern, expected := range cases {
+		literal := Literal(pattern)
+		if literal != expected {
+			t.Errorf("glob test: expected the literal prefix of %q to be %q, but got %q", pattern, expected, literal)
+		}
+	}
+}
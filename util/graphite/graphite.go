@@ -0,0 +1,144 @@
+package graphite
+
+// reports carbonsearch's own stats to graphite, as carbon plaintext lines:
+//
+//	carbonsearch.hostname-1234.QueriesHandled 42 1500000000
+//	carbonsearch.hostname-1234.SplitIndexes.fqdn-metrics 1234 1500000000
+//	carbonsearch.hostname-1234.runtime.goroutines 12 1500000000
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+// HostPlaceholder in a prefix is replaced by the hostname, with any dots
+// turned into underscores so it stays one node of the metric name.
+const HostPlaceholder = "{host}"
+
+const dialTimeout = 5 * time.Second
+
+// replaces characters that would break up a node of the metric name, or the line
+var nodeReplacer = strings.NewReplacer(".", "_", " ", "_", "\n", "_")
+
+type Reporter struct {
+	address  string
+	prefix   string
+	interval time.Duration
+}
+
+// New makes a reporter which sends stats to the carbon plaintext listener at
+// address (host:port) every interval, with every metric name starting with
+// prefix.
+func New(address string, interval time.Duration, prefix string) (*Reporter, error) {
+	if address == "" {
+		return nil, fmt.Errorf("graphite: there's no address to send stats to")
+	}
+
+	if interval <= 0 {
+		return nil, fmt.Errorf("graphite: the reporting interval must be positive, but it is %v", interval)
+	}
+
+	if strings.Contains(prefix, HostPlaceholder) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("graphite: could not get the hostname for the prefix %q: %s", prefix, err)
+		}
+		prefix = strings.Replace(prefix, HostPlaceholder, nodeReplacer.Replace(hostname), -1)
+	}
+
+	return &Reporter{
+		address:  address,
+		prefix:   strings.TrimSuffix(prefix, "."),
+		interval: interval,
+	}, nil
+}
+
+// Run reports stats every interval, forever. Failures are logged, and the
+// stats are sent again next time.
+func (r *Reporter) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		err := r.Report(now)
+		if err != nil {
+			log.Printf("graphite: %s", err)
+		}
+	}
+}
+
+// Report sends the current value of every stat, timestamped with now.
+func (r *Reporter) Report(now time.Time) error {
+	var buf bytes.Buffer
+	r.write(&buf, now)
+
+	conn, err := net.DialTimeout("tcp", r.address, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %s", r.address, err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(r.interval))
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not send stats to %s: %s", r.address, err)
+	}
+	return nil
+}
+
+// write formats every published expvar that's a number (or map of numbers, or
+// histogram), plus some runtime stats, as carbon plaintext lines
+func (r *Reporter) write(buf *bytes.Buffer, now time.Time) {
+	timestamp := now.Unix()
+	line := func(value string, path ...string) {
+		for i, node := range path {
+			path[i] = nodeReplacer.Replace(node)
+		}
+		fmt.Fprintf(buf, "%s.%s %s %d\n", r.prefix, strings.Join(path, "."), value, timestamp)
+	}
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			line(v.String(), kv.Key)
+		case *expvar.Map:
+			v.Do(func(entry expvar.KeyValue) {
+				if p, ok := entry.Value.(*util.PartitionStats); ok {
+					partition := strconv.Itoa(int(p.Partition))
+					p.Do(func(name string, value int64) {
+						line(strconv.FormatInt(value, 10), kv.Key, p.Consumer, p.Topic, partition, name)
+					})
+					return
+				}
+
+				value := entry.Value.String()
+				// maps can hold strings too, like ServicesByIndex
+				if _, err := strconv.ParseFloat(value, 64); err == nil {
+					line(value, kv.Key, entry.Key)
+				}
+			})
+		case *util.Histogram:
+			bounds, cumulative, sum := v.Buckets()
+			line(strconv.FormatUint(cumulative[len(bounds)], 10), kv.Key, "count")
+			line(strconv.FormatFloat(sum, 'g', -1, 64), kv.Key, "sum")
+		}
+	})
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	line(strconv.Itoa(runtime.NumGoroutine()), "runtime", "goroutines")
+	line(strconv.FormatUint(mem.Alloc, 10), "runtime", "alloc_bytes")
+	line(strconv.FormatUint(mem.HeapObjects, 10), "runtime", "heap_objects")
+	line(strconv.FormatUint(mem.Sys, 10), "runtime", "sys_bytes")
+	line(strconv.FormatUint(uint64(mem.NumGC), 10), "runtime", "gc_count")
+	line(strconv.FormatUint(mem.PauseTotalNs, 10), "runtime", "gc_pause_total_ns")
+}
@@ -0,0 +1,76 @@
+package graphite
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kanatohodets/carbonsearch/util"
+)
+
+func TestReport(t *testing.T) {
+	stats := util.InitStats()
+	stats.QueriesHandled.Add(3)
+	stats.SplitIndexes.Set("fqdn-metrics", util.ExpInt(10))
+	stats.ServicesByIndex.Set("server", util.ExpString("fqdn"))
+	stats.QueryResults.Observe(5)
+	stats.KafkaPartition("kafka", "carbonsearch_metrics", 0).Consumed(41, 50)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	r, err := New(listener.Addr().String(), time.Minute, "carbonsearch."+HostPlaceholder+".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Report(time.Unix(1500000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := <-received
+
+	hostname, _ := os.Hostname()
+	prefix := "carbonsearch." + strings.Replace(hostname, ".", "_", -1) + "."
+	expected := []string{
+		prefix + "QueriesHandled 3 1500000000\n",
+		prefix + "SplitIndexes.fqdn-metrics 10 1500000000\n",
+		prefix + "QueryResults.count 1 1500000000\n",
+		prefix + "QueryResults.sum 5 1500000000\n",
+		prefix + "KafkaPartitions.kafka.carbonsearch_metrics.0.Messages 1 1500000000\n",
+		prefix + "KafkaPartitions.kafka.carbonsearch_metrics.0.Lag 8 1500000000\n",
+		prefix + "runtime.goroutines ",
+	}
+	for _, line := range expected {
+		if !strings.Contains(lines, line) {
+			t.Errorf("graphite test: expected the stats to contain %q, but got:\n%s", line, lines)
+		}
+	}
+
+	if strings.Contains(lines, "ServicesByIndex") {
+		t.Errorf("graphite test: string stats like ServicesByIndex shouldn't be sent, but got:\n%s", lines)
+	}
+
+	_, err = New("", time.Minute, "carbonsearch")
+	if err == nil {
+		t.Errorf("graphite test: a reporter without an address should be an error")
+	}
+}
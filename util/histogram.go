@@ -0,0 +1,78 @@
+package util
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// Histogram counts observations into buckets, like a prometheus histogram.
+// It's published as an expvar, so it shows up on /debug/vars too.
+type Histogram struct {
+	mutex sync.Mutex
+	// upper bounds of each bucket, in increasing order. there's an implicit
+	// +Inf bucket at the end
+	bounds []float64
+	// observations in each bucket (not cumulative), one more than bounds
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(name string, bounds []float64) *Histogram {
+	h := &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+	expvar.Publish(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	bucket := len(h.bounds)
+	for i, bound := range h.bounds {
+		if value <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	h.counts[bucket]++
+	h.sum += value
+	h.count++
+}
+
+// Buckets returns the upper bound of each bucket, the cumulative count of
+// observations for each of them (the last one is +Inf, and so is the total),
+// and the sum of all observations.
+func (h *Histogram) Buckets() ([]float64, []uint64, float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	cumulative := make([]uint64, len(h.counts))
+	var total uint64
+	for i, count := range h.counts {
+		total += count
+		cumulative[i] = total
+	}
+	return h.bounds, cumulative, h.sum
+}
+
+// String implements expvar.Var, as JSON like this:
+//
+//	{"count": 3, "sum": 0.25, "buckets": {"0.1": 2, "1": 3, "+Inf": 3}}
+func (h *Histogram) String() string {
+	bounds, cumulative, sum := h.Buckets()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"count": %d, "sum": %g, "buckets": {`, cumulative[len(cumulative)-1], sum)
+	for i, bound := range bounds {
+		fmt.Fprintf(&buf, `"%g": %d, `, bound, cumulative[i])
+	}
+	fmt.Fprintf(&buf, `"+Inf": %d}}`, cumulative[len(cumulative)-1])
+	return buf.String()
+}
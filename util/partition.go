@@ -0,0 +1,115 @@
+package util
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"strconv"
+)
+
+// PartitionStats tracks how consuming one partition of a kafka topic is going.
+// They're kept in Stats.KafkaPartitions, under "consumer/topic/partition".
+type PartitionStats struct {
+	// the name of the kafka consumer, since there can be more than one
+	Consumer  string
+	Topic     string
+	Partition int32
+
+	Messages     expvar.Int
+	DecodeErrors expvar.Int
+	InsertErrors expvar.Int
+	// errors from kafka itself, rather than from the messages
+	ConsumeErrors expvar.Int
+
+	// the offset of the next message to consume, and of the next message to
+	// be produced to the partition
+	Offset        expvar.Int
+	HighWaterMark expvar.Int
+
+	// the high-water mark when consuming started. the partition is caught up
+	// once Offset reaches it, and stays that way
+	target   expvar.Int
+	caughtUp expvar.Int
+}
+
+// KafkaPartition finds (or creates) the stats for a partition read by the
+// named consumer.
+func (s *Stats) KafkaPartition(consumer string, topic string, partition int32) *PartitionStats {
+	s.partitionMutex.Lock()
+	defer s.partitionMutex.Unlock()
+
+	key := consumer + "/" + topic + "/" + strconv.Itoa(int(partition))
+	if p, ok := s.KafkaPartitions.Get(key).(*PartitionStats); ok {
+		return p
+	}
+
+	p := &PartitionStats{Consumer: consumer, Topic: topic, Partition: partition}
+	s.KafkaPartitions.Set(key, p)
+	return p
+}
+
+// Start records where consuming the partition starts from, and the
+// high-water mark that counts as caught up.
+func (p *PartitionStats) Start(offset int64, highWaterMark int64) {
+	p.target.Set(highWaterMark)
+	p.update(offset, highWaterMark)
+}
+
+// Consumed records that the message at offset has been dealt with.
+func (p *PartitionStats) Consumed(offset int64, highWaterMark int64) {
+	p.Messages.Add(1)
+	p.update(offset+1, highWaterMark)
+}
+
+func (p *PartitionStats) update(offset int64, highWaterMark int64) {
+	p.Offset.Set(offset)
+	// the high-water mark isn't known until the first fetch
+	if highWaterMark > p.HighWaterMark.Value() {
+		p.HighWaterMark.Set(highWaterMark)
+	}
+	if offset >= p.target.Value() {
+		p.caughtUp.Set(1)
+	}
+}
+
+// Lag is how many messages in the partition haven't been consumed yet.
+func (p *PartitionStats) Lag() int64 {
+	lag := p.HighWaterMark.Value() - p.Offset.Value()
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
+// CaughtUp reports whether everything that was in the partition when
+// consuming started has been consumed.
+func (p *PartitionStats) CaughtUp() bool {
+	return p.caughtUp.Value() == 1
+}
+
+// Do calls f for each of the stats, in a fixed order.
+func (p *PartitionStats) Do(f func(name string, value int64)) {
+	f("Messages", p.Messages.Value())
+	f("DecodeErrors", p.DecodeErrors.Value())
+	f("InsertErrors", p.InsertErrors.Value())
+	f("ConsumeErrors", p.ConsumeErrors.Value())
+	f("Offset", p.Offset.Value())
+	f("HighWaterMark", p.HighWaterMark.Value())
+	f("Lag", p.Lag())
+	f("CaughtUp", p.caughtUp.Value())
+}
+
+func (p *PartitionStats) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	first := true
+	p.Do(func(name string, value int64) {
+		if !first {
+			buf.WriteString(", ")
+		}
+		first = false
+		fmt.Fprintf(&buf, "%q: %d", name, value)
+	})
+	buf.WriteString("}")
+	return buf.String()
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPartitionStats(t *testing.T) {
+	p := &PartitionStats{Topic: "carbonsearch_metrics", Partition: 0}
+
+	// 10 messages to catch up on
+	p.Start(0, 10)
+	if p.CaughtUp() {
+		t.Errorf("partition stats test: caught up before consuming anything")
+	}
+	if p.Lag() != 10 {
+		t.Errorf("partition stats test: expected a lag of 10 at the start, but got %d", p.Lag())
+	}
+
+	p.Consumed(4, 12)
+	if p.Lag() != 7 {
+		t.Errorf("partition stats test: expected a lag of 7 after consuming offset 4 of 12, but got %d", p.Lag())
+	}
+	if p.CaughtUp() {
+		t.Errorf("partition stats test: caught up halfway through")
+	}
+
+	p.Consumed(9, 12)
+	if !p.CaughtUp() {
+		t.Errorf("partition stats test: not caught up after reaching the starting high-water mark")
+	}
+
+	// more messages arriving doesn't un-catch it up
+	p.Consumed(11, 20)
+	if !p.CaughtUp() || p.Lag() != 8 {
+		t.Errorf("partition stats test: expected to stay caught up with a lag of 8, but got %v and %d", p.CaughtUp(), p.Lag())
+	}
+
+	if p.Messages.Value() != 3 {
+		t.Errorf("partition stats test: expected 3 messages, but got %d", p.Messages.Value())
+	}
+
+	if !strings.Contains(p.String(), `"Lag": 8`) {
+		t.Errorf("partition stats test: expected the lag in the JSON, but got %s", p.String())
+	}
+
+	empty := &PartitionStats{}
+	empty.Start(5, 5)
+	if !empty.CaughtUp() {
+		t.Errorf("partition stats test: a partition with nothing to consume should be caught up")
+	}
+}
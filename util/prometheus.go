@@ -0,0 +1,200 @@
+package util
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// index sizes are kept in SplitIndexes under keys like 'fqdn-metrics' and
+// 'fqdn-tags'; prometheus gets the index name as a label instead
+const (
+	splitMetricsSuffix = "-metrics"
+	splitTagsSuffix    = "-tags"
+)
+
+// the index label for FullIndexTags and FullIndexMetrics
+const fullIndexLabel = "full"
+
+// WritePrometheus writes every stat in the prometheus text exposition format,
+// for scraping from /metrics.
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	var buf bytes.Buffer
+
+	counters := []struct {
+		name string
+		help string
+		v    *expvar.Int
+	}{
+		{"carbonsearch_tag_messages_total", "Tag messages inserted.", s.TagMessages},
+		{"carbonsearch_tags_indexed_total", "Tags inserted by tag messages.", s.TagsIndexed},
+		{"carbonsearch_metric_messages_total", "Metric messages inserted.", s.MetricMessages},
+		{"carbonsearch_metrics_indexed_total", "Metrics inserted by metric messages.", s.MetricsIndexed},
+		{"carbonsearch_custom_messages_total", "Custom messages inserted.", s.CustomMessages},
+		{"carbonsearch_delete_messages_total", "Delete messages of any type applied.", s.DeleteMessages},
+		{"carbonsearch_metrics_forgotten_total", "Metrics dropped from the database because nothing refers to them.", s.MetricsForgotten},
+		{"carbonsearch_expired_tags_total", "Tag associations removed by expiry.", s.ExpiredTags},
+		{"carbonsearch_expired_metrics_total", "Metric associations removed by expiry.", s.ExpiredMetrics},
+		{"carbonsearch_expired_custom_total", "Custom associations removed by expiry.", s.ExpiredCustom},
+		{"carbonsearch_queries_total", "Queries handled by /metrics/find/.", s.QueriesHandled},
+		{"carbonsearch_tag_queries_total", "Requests handled by the tag discovery endpoints.", s.TagQueriesHandled},
+		{"carbonsearch_snapshots_written_total", "Snapshots written to disk.", s.SnapshotsWritten},
+		{"carbonsearch_log_entries_written_total", "Entries appended to the write-ahead log.", s.LogEntriesWritten},
+		{"carbonsearch_log_entries_replayed_total", "Entries replayed from the write-ahead log on startup.", s.LogEntriesReplayed},
+		{"carbonsearch_dead_letters_total", "Messages from consumers which could not be applied, kept as dead letters.", s.DeadLetters},
+		{"carbonsearch_dead_letters_replayed_total", "Dead letters which applied cleanly when replayed.", s.DeadLettersReplayed},
+	}
+	for _, c := range counters {
+		writeHeader(&buf, c.name, c.help, "counter")
+		writeSample(&buf, c.name, "", c.v.String())
+	}
+
+	writeHeader(&buf, "carbonsearch_query_tags_total", "Tags used in queries, by service.", "counter")
+	s.QueryTagsByService.Do(func(kv expvar.KeyValue) {
+		writeSample(&buf, "carbonsearch_query_tags_total", labels("service", kv.Key), kv.Value.String())
+	})
+
+	writeHeader(&buf, "carbonsearch_consumer_messages_total", "Messages received, by consumer.", "counter")
+	s.ConsumerMessages.Do(func(kv expvar.KeyValue) {
+		writeSample(&buf, "carbonsearch_consumer_messages_total", labels("consumer", kv.Key), kv.Value.String())
+	})
+
+	writeHeader(&buf, "carbonsearch_consumer_errors_total", "Messages which could not be applied, by consumer.", "counter")
+	s.ConsumerErrors.Do(func(kv expvar.KeyValue) {
+		writeSample(&buf, "carbonsearch_consumer_errors_total", labels("consumer", kv.Key), kv.Value.String())
+	})
+
+	writeKafkaPartitions(&buf, s.KafkaPartitions)
+
+	// gauges for the size of each index
+	indexTags := []sample{{labels("index", fullIndexLabel), s.FullIndexTags.String()}}
+	indexMetrics := []sample{{labels("index", fullIndexLabel), s.FullIndexMetrics.String()}}
+	s.SplitIndexes.Do(func(kv expvar.KeyValue) {
+		switch {
+		case strings.HasSuffix(kv.Key, splitTagsSuffix):
+			name := strings.TrimSuffix(kv.Key, splitTagsSuffix)
+			indexTags = append(indexTags, sample{labels("index", name), kv.Value.String()})
+		case strings.HasSuffix(kv.Key, splitMetricsSuffix):
+			name := strings.TrimSuffix(kv.Key, splitMetricsSuffix)
+			indexMetrics = append(indexMetrics, sample{labels("index", name), kv.Value.String()})
+		}
+	})
+
+	writeHeader(&buf, "carbonsearch_index_tags", "Tags in each index.", "gauge")
+	for _, gauge := range indexTags {
+		writeSample(&buf, "carbonsearch_index_tags", gauge.labels, gauge.value)
+	}
+
+	writeHeader(&buf, "carbonsearch_index_metrics", "Metric associations in each index.", "gauge")
+	for _, gauge := range indexMetrics {
+		writeSample(&buf, "carbonsearch_index_metrics", gauge.labels, gauge.value)
+	}
+
+	writeHeader(&buf, "carbonsearch_service_index", "Which index the tags for each service are in. Always 1.", "gauge")
+	s.ServicesByIndex.Do(func(kv expvar.KeyValue) {
+		// the values are quoted for expvar's JSON
+		name, err := strconv.Unquote(kv.Value.String())
+		if err != nil {
+			name = kv.Value.String()
+		}
+		writeSample(&buf, "carbonsearch_service_index", labels("service", kv.Key, "index", name), "1")
+	})
+
+	writeHistogram(&buf, "carbonsearch_query_duration_seconds", "How long /metrics/find/ queries took.", s.QueryDuration)
+	writeHistogram(&buf, "carbonsearch_query_results", "How many metrics /metrics/find/ queries returned.", s.QueryResults)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// the prometheus name, help and type for each of the PartitionStats
+var partitionMetrics = map[string][3]string{
+	"Messages":      {"carbonsearch_kafka_messages_total", "Messages consumed, by kafka partition.", "counter"},
+	"DecodeErrors":  {"carbonsearch_kafka_decode_errors_total", "Messages which could not be decoded, by kafka partition.", "counter"},
+	"InsertErrors":  {"carbonsearch_kafka_insert_errors_total", "Messages which were decoded but could not be applied, by kafka partition.", "counter"},
+	"ConsumeErrors": {"carbonsearch_kafka_consume_errors_total", "Errors from kafka while consuming, by kafka partition.", "counter"},
+	"Offset":        {"carbonsearch_kafka_offset", "The offset of the next message to consume from each kafka partition.", "gauge"},
+	"HighWaterMark": {"carbonsearch_kafka_high_water_mark", "The offset of the next message to be produced to each kafka partition.", "gauge"},
+	"Lag":           {"carbonsearch_kafka_lag", "Messages in each kafka partition which haven't been consumed yet.", "gauge"},
+	"CaughtUp":      {"carbonsearch_kafka_caught_up", "Whether everything in each kafka partition when consuming started has been consumed.", "gauge"},
+}
+
+func writeKafkaPartitions(buf *bytes.Buffer, partitions *expvar.Map) {
+	// prometheus wants all the samples for a metric together
+	samples := make(map[string][]sample)
+	names := []string{}
+	partitions.Do(func(kv expvar.KeyValue) {
+		p, ok := kv.Value.(*PartitionStats)
+		if !ok {
+			return
+		}
+		partitionLabels := labels("consumer", p.Consumer, "topic", p.Topic, "partition", strconv.Itoa(int(p.Partition)))
+		p.Do(func(name string, value int64) {
+			if _, ok := samples[name]; !ok {
+				names = append(names, name)
+			}
+			samples[name] = append(samples[name], sample{partitionLabels, strconv.FormatInt(value, 10)})
+		})
+	})
+
+	for _, name := range names {
+		metric, ok := partitionMetrics[name]
+		if !ok {
+			continue
+		}
+		writeHeader(buf, metric[0], metric[1], metric[2])
+		for _, s := range samples[name] {
+			writeSample(buf, metric[0], s.labels, s.value)
+		}
+	}
+}
+
+type sample struct {
+	labels string
+	value  string
+}
+
+func writeHeader(buf *bytes.Buffer, name string, help string, metricType string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, metricType)
+}
+
+func writeSample(buf *bytes.Buffer, name string, labels string, value string) {
+	fmt.Fprintf(buf, "%s%s %s\n", name, labels, value)
+}
+
+func writeHistogram(buf *bytes.Buffer, name string, help string, h *Histogram) {
+	bounds, cumulative, sum := h.Buckets()
+
+	writeHeader(buf, name, help, "histogram")
+	for i, bound := range bounds {
+		writeSample(buf, name+"_bucket", labels("le", formatFloat(bound)), strconv.FormatUint(cumulative[i], 10))
+	}
+	total := strconv.FormatUint(cumulative[len(cumulative)-1], 10)
+	writeSample(buf, name+"_bucket", labels("le", "+Inf"), total)
+	writeSample(buf, name+"_sum", "", formatFloat(sum))
+	writeSample(buf, name+"_count", "", total)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name/value pairs as a prometheus label set: {name="value"}
+func labels(pairs ...string) string {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
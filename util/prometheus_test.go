@@ -0,0 +1,65 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	stats := InitStats()
+
+	stats.QueriesHandled.Add(3)
+	stats.SplitIndexes.Set("fqdn-metrics", ExpInt(10))
+	stats.SplitIndexes.Set("fqdn-tags", ExpInt(4))
+	stats.ServicesByIndex.Set("server", ExpString("fqdn"))
+	stats.ConsumerMessages.Add("kafka", 2)
+	stats.ConsumerErrors.Add("kafka", 1)
+	stats.QueryDuration.Observe(0.003)
+	stats.QueryDuration.Observe(0.2)
+	stats.QueryResults.Observe(0)
+	partition := stats.KafkaPartition("kafka", "carbonsearch_metrics", 3)
+	partition.Start(0, 5)
+	partition.Consumed(0, 5)
+	partition.DecodeErrors.Add(1)
+
+	var buf bytes.Buffer
+	err := stats.WritePrometheus(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+
+	expected := []string{
+		"# TYPE carbonsearch_queries_total counter\ncarbonsearch_queries_total 3\n",
+		`carbonsearch_index_metrics{index="fqdn"} 10`,
+		`carbonsearch_index_tags{index="fqdn"} 4`,
+		`carbonsearch_index_tags{index="full"} 0`,
+		`carbonsearch_service_index{service="server",index="fqdn"} 1`,
+		`carbonsearch_consumer_messages_total{consumer="kafka"} 2`,
+		`carbonsearch_consumer_errors_total{consumer="kafka"} 1`,
+		`carbonsearch_query_duration_seconds_bucket{le="0.0025"} 0`,
+		`carbonsearch_query_duration_seconds_bucket{le="0.005"} 1`,
+		`carbonsearch_query_duration_seconds_bucket{le="0.25"} 2`,
+		`carbonsearch_query_duration_seconds_bucket{le="+Inf"} 2`,
+		`carbonsearch_query_duration_seconds_count 2`,
+		`carbonsearch_query_results_bucket{le="0"} 1`,
+		`carbonsearch_kafka_messages_total{consumer="kafka",topic="carbonsearch_metrics",partition="3"} 1`,
+		`carbonsearch_kafka_decode_errors_total{consumer="kafka",topic="carbonsearch_metrics",partition="3"} 1`,
+		`carbonsearch_kafka_lag{consumer="kafka",topic="carbonsearch_metrics",partition="3"} 4`,
+		`carbonsearch_kafka_caught_up{consumer="kafka",topic="carbonsearch_metrics",partition="3"} 0`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("prometheus test: expected the output to contain %q, but got:\n%s", line, output)
+		}
+	}
+
+	if stats.KafkaPartition("kafka", "carbonsearch_metrics", 3) != partition {
+		t.Errorf("prometheus test: expected the same stats for the same partition")
+	}
+
+	if labels("index", `a"b\c`) != `{index="a\"b\\c"}` {
+		t.Errorf("prometheus test: label values weren't escaped: %s", labels("index", `a"b\c`))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strconv"
+	"sync"
 
 	"github.com/dchest/siphash"
 	"gopkg.in/yaml.v2"
@@ -21,12 +22,40 @@ type Stats struct {
 	FullIndexTags    *expvar.Int
 	FullIndexMetrics *expvar.Int
 
+	DeleteMessages   *expvar.Int
+	MetricsForgotten *expvar.Int
+
+	ExpiredTags    *expvar.Int
+	ExpiredMetrics *expvar.Int
+	ExpiredCustom  *expvar.Int
+
 	QueriesHandled     *expvar.Int
 	QueryTagsByService *expvar.Map
+	TagQueriesHandled  *expvar.Int
+
+	// seconds per /metrics/find/ query, and how many metrics each returned
+	QueryDuration *Histogram
+	QueryResults  *Histogram
+
+	// messages received and messages which couldn't be applied, by consumer name
+	ConsumerMessages *expvar.Map
+	ConsumerErrors   *expvar.Map
+
+	// a *PartitionStats for each kafka partition being consumed
+	KafkaPartitions *expvar.Map
+	partitionMutex  sync.Mutex
 
 	ServicesByIndex *expvar.Map
 
 	SplitIndexes *expvar.Map
+
+	SnapshotsWritten *expvar.Int
+
+	DeadLetters         *expvar.Int
+	DeadLettersReplayed *expvar.Int
+
+	LogEntriesWritten  *expvar.Int
+	LogEntriesReplayed *expvar.Int
 }
 
 func InitStats() *Stats {
@@ -41,12 +70,36 @@ func InitStats() *Stats {
 		FullIndexTags:    expvar.NewInt("FullIndexTags"),
 		FullIndexMetrics: expvar.NewInt("FullIndexMetrics"),
 
+		DeleteMessages:   expvar.NewInt("DeleteMessages"),
+		MetricsForgotten: expvar.NewInt("MetricsForgotten"),
+
+		ExpiredTags:    expvar.NewInt("ExpiredTags"),
+		ExpiredMetrics: expvar.NewInt("ExpiredMetrics"),
+		ExpiredCustom:  expvar.NewInt("ExpiredCustom"),
+
 		QueriesHandled:     expvar.NewInt("QueriesHandled"),
 		QueryTagsByService: expvar.NewMap("QueryTagsByService"),
+		TagQueriesHandled:  expvar.NewInt("TagQueriesHandled"),
+
+		QueryDuration: NewHistogram("QueryDuration", []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}),
+		QueryResults:  NewHistogram("QueryResults", []float64{0, 1, 10, 100, 1000, 10000, 100000}),
+
+		ConsumerMessages: expvar.NewMap("ConsumerMessages"),
+		ConsumerErrors:   expvar.NewMap("ConsumerErrors"),
+
+		KafkaPartitions: expvar.NewMap("KafkaPartitions"),
 
 		SplitIndexes: expvar.NewMap("SplitIndexes"),
 
 		ServicesByIndex: expvar.NewMap("ServicesByIndex"),
+
+		SnapshotsWritten: expvar.NewInt("SnapshotsWritten"),
+
+		DeadLetters:         expvar.NewInt("DeadLetters"),
+		DeadLettersReplayed: expvar.NewInt("DeadLettersReplayed"),
+
+		LogEntriesWritten:  expvar.NewInt("LogEntriesWritten"),
+		LogEntriesReplayed: expvar.NewInt("LogEntriesReplayed"),
 	}
 }
 